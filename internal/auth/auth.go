@@ -93,3 +93,30 @@ func GetSession(ctx context.Context, db *sql.DB, token string) (Session, error)
 
 	return session, nil
 }
+
+// SessionTokens returns the tokens of userID's unexpired sessions.
+func SessionTokens(ctx context.Context, db *sql.DB, userID int64) ([]string, error) {
+	rows, err := db.QueryContext(
+		ctx,
+		`SELECT token FROM sessions WHERE user_id = ? AND expires_at > ?`,
+		userID,
+		time.Now().UTC().Format(time.RFC3339),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("list sessions: %w", err)
+	}
+	defer rows.Close()
+
+	var tokens []string
+	for rows.Next() {
+		var token string
+		if err := rows.Scan(&token); err != nil {
+			return nil, fmt.Errorf("scan session: %w", err)
+		}
+		tokens = append(tokens, token)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list sessions: %w", err)
+	}
+	return tokens, nil
+}
@@ -0,0 +1,133 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// Category groups channels in the sidebar. Channels reference it through
+// channels.category_id.
+type Category struct {
+	ID       int64  `json:"id"`
+	Name     string `json:"name"`
+	Position int    `json:"position"`
+}
+
+func ListCategories(ctx context.Context, db *sql.DB) ([]Category, error) {
+	rows, err := db.QueryContext(ctx, `SELECT id, name, position FROM channel_categories ORDER BY position ASC, id ASC`)
+	if err != nil {
+		return nil, fmt.Errorf("query categories: %w", err)
+	}
+	defer rows.Close()
+
+	categories := make([]Category, 0)
+	for rows.Next() {
+		var category Category
+		if err := rows.Scan(&category.ID, &category.Name, &category.Position); err != nil {
+			return nil, fmt.Errorf("scan category: %w", err)
+		}
+		categories = append(categories, category)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate categories: %w", err)
+	}
+	return categories, nil
+}
+
+func CreateCategory(ctx context.Context, db *sql.DB, name string) (Category, error) {
+	category := Category{Name: name}
+	err := db.QueryRowContext(ctx, `
+INSERT INTO channel_categories (name, position)
+VALUES (?, (SELECT COALESCE(MAX(position), 0) + 1 FROM channel_categories))
+RETURNING id, position`, name).Scan(&category.ID, &category.Position)
+	if err != nil {
+		return Category{}, fmt.Errorf("insert category: %w", err)
+	}
+	return category, nil
+}
+
+// UpdateCategory renames and/or moves a category; nil fields are left alone.
+func UpdateCategory(ctx context.Context, db *sql.DB, categoryID int64, name *string, position *int) (Category, error) {
+	var category Category
+	err := db.QueryRowContext(ctx, `
+UPDATE channel_categories
+SET name = COALESCE(?, name), position = COALESCE(?, position)
+WHERE id = ?
+RETURNING id, name, position`, name, position, categoryID).Scan(&category.ID, &category.Name, &category.Position)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Category{}, ErrCategoryNotFound
+		}
+		return Category{}, fmt.Errorf("update category: %w", err)
+	}
+	return category, nil
+}
+
+// DeleteCategory removes a category. Its channels are kept and become
+// uncategorised; their IDs are returned so clients can be told.
+func DeleteCategory(ctx context.Context, db *sql.DB, categoryID int64) ([]int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("begin delete category: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if err := requireCategory(ctx, tx, categoryID); err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx, `UPDATE channels SET category_id = NULL WHERE category_id = ? RETURNING id`, categoryID)
+	if err != nil {
+		return nil, fmt.Errorf("uncategorise channels: %w", err)
+	}
+	moved := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan uncategorised channel: %w", err)
+		}
+		moved = append(moved, id)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return nil, fmt.Errorf("iterate uncategorised channels: %w", err)
+	}
+	rows.Close()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM channel_categories WHERE id = ?`, categoryID); err != nil {
+		return nil, fmt.Errorf("delete category: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit delete category: %w", err)
+	}
+	return moved, nil
+}
+
+func requireCategory(ctx context.Context, tx *sql.Tx, categoryID int64) error {
+	var exists int
+	if err := tx.QueryRowContext(ctx, `SELECT 1 FROM channel_categories WHERE id = ?`, categoryID).Scan(&exists); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrCategoryNotFound
+		}
+		return fmt.Errorf("lookup category: %w", err)
+	}
+	return nil
+}
+
+// resolveCategory maps a requested category ID onto the stored column value,
+// where zero means no category.
+func resolveCategory(ctx context.Context, tx *sql.Tx, categoryID int64) (*int64, error) {
+	if categoryID == 0 {
+		return nil, nil
+	}
+	if err := requireCategory(ctx, tx, categoryID); err != nil {
+		return nil, err
+	}
+	return &categoryID, nil
+}
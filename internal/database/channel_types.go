@@ -0,0 +1,97 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// Server channel types. Text and announcement channels carry messages,
+// voice and stage channels carry audio and video, and forum channels only
+// hold threads.
+const (
+	ChannelTypeText         = "text"
+	ChannelTypeVoice        = "voice"
+	ChannelTypeAnnouncement = "announcement"
+	ChannelTypeStage        = "stage"
+	ChannelTypeForum        = "forum"
+)
+
+// ServerChannelTypes lists the types accepted when creating a channel.
+var ServerChannelTypes = []string{
+	ChannelTypeText,
+	ChannelTypeVoice,
+	ChannelTypeAnnouncement,
+	ChannelTypeStage,
+	ChannelTypeForum,
+}
+
+// Voice modes decide how media travels in a voice or stage channel. In mesh
+// mode every participant connects to every other one directly; in sfu mode
+// each connects once to the server, which forwards their tracks.
+const (
+	VoiceModeMesh = "mesh"
+	VoiceModeSFU  = "sfu"
+)
+
+var (
+	ErrNotVoiceChannel   = errors.New("this is not a voice channel")
+	ErrNotTextChannel    = errors.New("messages cannot be posted in this channel")
+	ErrPostingRestricted = errors.New("only moderators can post in this channel")
+	ErrInvalidVoiceMode  = errors.New("voice_mode must be mesh or sfu")
+)
+
+func IsServerChannelType(channelType string) bool {
+	for _, t := range ServerChannelTypes {
+		if t == channelType {
+			return true
+		}
+	}
+	return false
+}
+
+// SupportsVoice reports whether users can connect audio and video to a
+// channel of this type.
+func SupportsVoice(channelType string) bool {
+	return channelType == ChannelTypeVoice || channelType == ChannelTypeStage
+}
+
+func IsVoiceMode(mode string) bool {
+	return mode == VoiceModeMesh || mode == VoiceModeSFU
+}
+
+// ChannelVoiceMode returns how media travels in a voice channel.
+func ChannelVoiceMode(ctx context.Context, db *sql.DB, channelID int64) (string, error) {
+	var mode string
+	if err := db.QueryRowContext(ctx, `SELECT voice_mode FROM channels WHERE id = ?`, channelID).Scan(&mode); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrChannelNotFound
+		}
+		return "", fmt.Errorf("fetch voice mode: %w", err)
+	}
+	return mode, nil
+}
+
+// SupportsMessages reports whether messages may be posted directly into a
+// channel of this type. Announcement channels do, but only for members
+// allowed to manage messages.
+func SupportsMessages(channelType string) bool {
+	switch channelType {
+	case ChannelTypeText, ChannelTypeAnnouncement, ChannelTypeDM, ChannelTypeGroupDM:
+		return true
+	default:
+		return false
+	}
+}
+
+func ChannelType(ctx context.Context, db *sql.DB, channelID int64) (string, error) {
+	var channelType string
+	if err := db.QueryRowContext(ctx, `SELECT type FROM channels WHERE id = ?`, channelID).Scan(&channelType); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrChannelNotFound
+		}
+		return "", fmt.Errorf("fetch channel type: %w", err)
+	}
+	return channelType, nil
+}
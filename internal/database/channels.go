@@ -0,0 +1,493 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	ChannelTypeDM      = "dm"
+	ChannelTypeGroupDM = "group_dm"
+)
+
+var (
+	ErrChannelNotFound      = errors.New("channel not found")
+	ErrNotChannelMember     = errors.New("you are not a member of this channel")
+	ErrChannelNotPrivate    = errors.New("channel membership can only be changed on private channels")
+	ErrAlreadyChannelMember = errors.New("user is already a member of this channel")
+	ErrMemberNotFound       = errors.New("user is not a member of this channel")
+	ErrChannelNameTaken     = errors.New("channel already exists")
+	ErrDMNotManageable      = errors.New("direct conversations cannot be changed this way")
+	ErrCategoryNotFound     = errors.New("category not found")
+)
+
+// Channel is a server channel as listed to clients. CategoryID is nil for
+// channels outside any category.
+type Channel struct {
+	ID         int64  `json:"id"`
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	Private    bool   `json:"private"`
+	Topic      string `json:"topic"`
+	Position   int    `json:"position"`
+	CategoryID *int64 `json:"category_id"`
+	// VoiceMode is only set on voice and stage channels.
+	VoiceMode string `json:"voice_mode,omitempty"`
+}
+
+// ChannelUpdate holds the fields of a PATCH; nil fields are left alone. A
+// CategoryID pointing at zero moves the channel out of its category.
+type ChannelUpdate struct {
+	Name       *string
+	Topic      *string
+	CategoryID *int64
+	VoiceMode  *string
+}
+
+// ChannelPosition is one entry of a bulk reorder. CategoryID follows the
+// same rules as in ChannelUpdate.
+type ChannelPosition struct {
+	ID         int64  `json:"id"`
+	Position   int    `json:"position"`
+	CategoryID *int64 `json:"category_id"`
+}
+
+const channelSelect = `SELECT id, name, type, private, topic, position, category_id, voice_mode FROM channels`
+
+// IsDMType reports whether channelType is one of the private conversation
+// types whose access is governed by channel_members.
+func IsDMType(channelType string) bool {
+	return channelType == ChannelTypeDM || channelType == ChannelTypeGroupDM
+}
+
+// CheckChannelAccess returns nil when userID may read and post in channelID,
+// ErrChannelNotFound when the channel does not exist and ErrNotChannelMember
+// when it is restricted to members the user is not one of. Private channels
+// and DMs are restricted; everything else is open to every user.
+func CheckChannelAccess(ctx context.Context, db *sql.DB, channelID, userID int64) error {
+	var (
+		channelType string
+		private     bool
+	)
+	if err := db.QueryRowContext(ctx, `SELECT type, private FROM channels WHERE id = ?`, channelID).Scan(&channelType, &private); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrChannelNotFound
+		}
+		return fmt.Errorf("fetch channel: %w", err)
+	}
+
+	if !private && !IsDMType(channelType) {
+		return nil
+	}
+
+	member, err := IsChannelMember(ctx, db, channelID, userID)
+	if err != nil {
+		return err
+	}
+	if !member {
+		return ErrNotChannelMember
+	}
+	return nil
+}
+
+func IsChannelMember(ctx context.Context, db *sql.DB, channelID, userID int64) (bool, error) {
+	var exists int
+	err := db.QueryRowContext(ctx, `SELECT 1 FROM channel_members WHERE channel_id = ? AND user_id = ?`, channelID, userID).Scan(&exists)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, fmt.Errorf("check channel membership: %w", err)
+	}
+	return true, nil
+}
+
+// AddChannelMember grants userID access to the private channel channelID.
+func AddChannelMember(ctx context.Context, db *sql.DB, channelID, userID int64) error {
+	if err := requirePrivateChannel(ctx, db, channelID); err != nil {
+		return err
+	}
+
+	var exists int
+	if err := db.QueryRowContext(ctx, `SELECT 1 FROM users WHERE id = ?`, userID).Scan(&exists); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrUserNotFound
+		}
+		return fmt.Errorf("lookup user: %w", err)
+	}
+
+	result, err := db.ExecContext(ctx, `INSERT OR IGNORE INTO channel_members (channel_id, user_id) VALUES (?, ?)`, channelID, userID)
+	if err != nil {
+		return fmt.Errorf("insert channel member: %w", err)
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return ErrAlreadyChannelMember
+	}
+	return nil
+}
+
+// RemoveChannelMember revokes userID's access to the private channel
+// channelID.
+func RemoveChannelMember(ctx context.Context, db *sql.DB, channelID, userID int64) error {
+	if err := requirePrivateChannel(ctx, db, channelID); err != nil {
+		return err
+	}
+
+	result, err := db.ExecContext(ctx, `DELETE FROM channel_members WHERE channel_id = ? AND user_id = ?`, channelID, userID)
+	if err != nil {
+		return fmt.Errorf("delete channel member: %w", err)
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return ErrMemberNotFound
+	}
+	return nil
+}
+
+// ChannelCreator returns the user who created channelID, or zero when the
+// channel predates creator tracking or its creator has been deleted.
+func ChannelCreator(ctx context.Context, db *sql.DB, channelID int64) (int64, error) {
+	var creator sql.NullInt64
+	if err := db.QueryRowContext(ctx, `SELECT created_by FROM channels WHERE id = ?`, channelID).Scan(&creator); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrChannelNotFound
+		}
+		return 0, fmt.Errorf("fetch channel creator: %w", err)
+	}
+	return creator.Int64, nil
+}
+
+func requirePrivateChannel(ctx context.Context, db *sql.DB, channelID int64) error {
+	var (
+		channelType string
+		private     bool
+	)
+	if err := db.QueryRowContext(ctx, `SELECT type, private FROM channels WHERE id = ?`, channelID).Scan(&channelType, &private); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrChannelNotFound
+		}
+		return fmt.Errorf("fetch channel: %w", err)
+	}
+	if !private || IsDMType(channelType) {
+		return ErrChannelNotPrivate
+	}
+	return nil
+}
+
+// ListChannels returns the server channels visible admits, in display
+// order. DMs are excluded.
+func ListChannels(ctx context.Context, db *sql.DB, visible Visibility) ([]Channel, error) {
+	cond, args := visible("id")
+	rows, err := db.QueryContext(ctx, channelSelect+`
+WHERE type NOT IN (?, ?) AND `+cond+`
+ORDER BY position ASC, id ASC`, append([]any{ChannelTypeDM, ChannelTypeGroupDM}, args...)...)
+	if err != nil {
+		return nil, fmt.Errorf("query channels: %w", err)
+	}
+	defer rows.Close()
+
+	channels := make([]Channel, 0)
+	for rows.Next() {
+		channel, err := scanChannel(rows)
+		if err != nil {
+			return nil, err
+		}
+		channels = append(channels, channel)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate channels: %w", err)
+	}
+	return channels, nil
+}
+
+func GetChannel(ctx context.Context, db *sql.DB, channelID int64) (Channel, error) {
+	channel, err := scanChannel(db.QueryRowContext(ctx, channelSelect+` WHERE id = ?`, channelID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Channel{}, ErrChannelNotFound
+		}
+		return Channel{}, err
+	}
+	return channel, nil
+}
+
+// CreateChannel inserts a server channel after every existing one. The
+// creator becomes the first member of a private channel.
+func CreateChannel(ctx context.Context, db *sql.DB, creatorID int64, channel Channel) (Channel, error) {
+	if channel.VoiceMode == "" {
+		channel.VoiceMode = VoiceModeMesh
+	}
+	if !IsVoiceMode(channel.VoiceMode) {
+		return Channel{}, ErrInvalidVoiceMode
+	}
+	if !SupportsVoice(channel.Type) && channel.VoiceMode != VoiceModeMesh {
+		return Channel{}, ErrNotVoiceChannel
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return Channel{}, fmt.Errorf("begin create channel: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if channel.CategoryID != nil {
+		if err := requireCategory(ctx, tx, *channel.CategoryID); err != nil {
+			return Channel{}, err
+		}
+	}
+	if err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(position), 0) + 1 FROM channels`).Scan(&channel.Position); err != nil {
+		return Channel{}, fmt.Errorf("next channel position: %w", err)
+	}
+
+	result, err := tx.ExecContext(ctx, `INSERT INTO channels (name, type, private, created_by, topic, position, category_id, voice_mode) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		channel.Name, channel.Type, channel.Private, creatorID, channel.Topic, channel.Position, channel.CategoryID, channel.VoiceMode)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return Channel{}, ErrChannelNameTaken
+		}
+		return Channel{}, fmt.Errorf("insert channel: %w", err)
+	}
+	channel.ID, err = result.LastInsertId()
+	if err != nil {
+		return Channel{}, fmt.Errorf("get channel id: %w", err)
+	}
+
+	if !SupportsVoice(channel.Type) {
+		channel.VoiceMode = ""
+	}
+
+	if channel.Private {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO channel_members (channel_id, user_id) VALUES (?, ?)`, channel.ID, creatorID); err != nil {
+			return Channel{}, fmt.Errorf("insert channel member: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Channel{}, fmt.Errorf("commit create channel: %w", err)
+	}
+	return channel, nil
+}
+
+func UpdateChannel(ctx context.Context, db *sql.DB, channelID int64, update ChannelUpdate) (Channel, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return Channel{}, fmt.Errorf("begin update channel: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	channel, err := manageableChannel(ctx, tx, channelID)
+	if err != nil {
+		return Channel{}, err
+	}
+	if update.Name != nil {
+		channel.Name = *update.Name
+	}
+	if update.Topic != nil {
+		channel.Topic = *update.Topic
+	}
+	if update.CategoryID != nil {
+		if channel.CategoryID, err = resolveCategory(ctx, tx, *update.CategoryID); err != nil {
+			return Channel{}, err
+		}
+	}
+	if update.VoiceMode != nil {
+		if !SupportsVoice(channel.Type) {
+			return Channel{}, ErrNotVoiceChannel
+		}
+		if !IsVoiceMode(*update.VoiceMode) {
+			return Channel{}, ErrInvalidVoiceMode
+		}
+		channel.VoiceMode = *update.VoiceMode
+		if _, err := tx.ExecContext(ctx, `UPDATE channels SET voice_mode = ? WHERE id = ?`, channel.VoiceMode, channel.ID); err != nil {
+			return Channel{}, fmt.Errorf("update voice mode: %w", err)
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE channels SET name = ?, topic = ?, category_id = ? WHERE id = ?`,
+		channel.Name, channel.Topic, channel.CategoryID, channel.ID); err != nil {
+		if isUniqueViolation(err) {
+			return Channel{}, ErrChannelNameTaken
+		}
+		return Channel{}, fmt.Errorf("update channel: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Channel{}, fmt.Errorf("commit update channel: %w", err)
+	}
+	return channel, nil
+}
+
+// DeleteChannel removes a server channel together with everything stored
+// against it.
+func DeleteChannel(ctx context.Context, db *sql.DB, channelID int64) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin delete channel: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if _, err := manageableChannel(ctx, tx, channelID); err != nil {
+		return err
+	}
+
+	for _, stmt := range []string{
+		`DELETE FROM message_reactions WHERE message_id IN (SELECT id FROM messages WHERE channel_id = ?)`,
+		`DELETE FROM message_mentions WHERE message_id IN (SELECT id FROM messages WHERE channel_id = ?)`,
+		`DELETE FROM mention_notifications WHERE channel_id = ?`,
+		`DELETE FROM messages WHERE channel_id = ?`,
+		`DELETE FROM thread_members WHERE thread_id IN (SELECT id FROM threads WHERE channel_id = ?)`,
+		`DELETE FROM threads WHERE channel_id = ?`,
+		`DELETE FROM channel_read_states WHERE channel_id = ?`,
+		`DELETE FROM channel_members WHERE channel_id = ?`,
+		`DELETE FROM channel_permission_overrides WHERE channel_id = ?`,
+		`DELETE FROM recording_tracks WHERE recording_id IN (SELECT id FROM recordings WHERE channel_id = ?)`,
+		`DELETE FROM recordings WHERE channel_id = ?`,
+		`DELETE FROM channels WHERE id = ?`,
+	} {
+		if _, err := tx.ExecContext(ctx, stmt, channelID); err != nil {
+			return fmt.Errorf("delete channel: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit delete channel: %w", err)
+	}
+	return nil
+}
+
+// ReorderChannels applies a batch of positions atomically and returns the
+// channels as they now stand, in the order given.
+func ReorderChannels(ctx context.Context, db *sql.DB, positions []ChannelPosition) ([]Channel, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("begin reorder channels: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	channels := make([]Channel, 0, len(positions))
+	for _, entry := range positions {
+		channel, err := manageableChannel(ctx, tx, entry.ID)
+		if err != nil {
+			return nil, err
+		}
+		channel.Position = entry.Position
+		if entry.CategoryID != nil {
+			if channel.CategoryID, err = resolveCategory(ctx, tx, *entry.CategoryID); err != nil {
+				return nil, err
+			}
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE channels SET position = ?, category_id = ? WHERE id = ?`, channel.Position, channel.CategoryID, channel.ID); err != nil {
+			return nil, fmt.Errorf("update channel position: %w", err)
+		}
+		channels = append(channels, channel)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit reorder channels: %w", err)
+	}
+	return channels, nil
+}
+
+// manageableChannel loads a server channel for modification, refusing DMs.
+func manageableChannel(ctx context.Context, tx *sql.Tx, channelID int64) (Channel, error) {
+	channel, err := scanChannel(tx.QueryRowContext(ctx, channelSelect+` WHERE id = ?`, channelID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Channel{}, ErrChannelNotFound
+		}
+		return Channel{}, err
+	}
+	if IsDMType(channel.Type) {
+		return Channel{}, ErrDMNotManageable
+	}
+	return channel, nil
+}
+
+func scanChannel(row rowScanner) (Channel, error) {
+	var (
+		channel  Channel
+		category sql.NullInt64
+	)
+	if err := row.Scan(&channel.ID, &channel.Name, &channel.Type, &channel.Private, &channel.Topic, &channel.Position, &category, &channel.VoiceMode); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Channel{}, err
+		}
+		return Channel{}, fmt.Errorf("scan channel: %w", err)
+	}
+	if category.Valid {
+		channel.CategoryID = &category.Int64
+	}
+	if !SupportsVoice(channel.Type) {
+		channel.VoiceMode = ""
+	}
+	return channel, nil
+}
+
+func isUniqueViolation(err error) bool {
+	return strings.Contains(strings.ToLower(err.Error()), "unique")
+}
+
+// maxIDsPerQuery bounds the IDs bound into one IN list.
+const maxIDsPerQuery = 500
+
+// Visibility restricts column to the rows someone may see, returning a SQL
+// condition and its arguments. The permissions package builds them, since it
+// owns the rules for who may read which channel.
+type Visibility func(column string) (string, []any)
+
+// ChannelViewers returns every user viewers admits.
+func ChannelViewers(ctx context.Context, db *sql.DB, viewers Visibility) ([]int64, error) {
+	cond, args := viewers("id")
+	ids, err := queryIDs(ctx, db, `SELECT id FROM users WHERE `+cond+` ORDER BY id`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("list channel viewers: %w", err)
+	}
+	return ids, nil
+}
+
+// FilterChannelViewers returns the users among userIDs that viewers admits.
+func FilterChannelViewers(ctx context.Context, db *sql.DB, viewers Visibility, userIDs []int64) ([]int64, error) {
+	filtered := make([]int64, 0, len(userIDs))
+	for start := 0; start < len(userIDs); start += maxIDsPerQuery {
+		batch := userIDs[start:min(start+maxIDsPerQuery, len(userIDs))]
+		cond, args := viewers("id")
+		for _, id := range batch {
+			args = append(args, id)
+		}
+		ids, err := queryIDs(ctx, db, `SELECT id FROM users WHERE `+cond+` AND id IN (`+placeholders(len(batch))+`) ORDER BY id`, args...)
+		if err != nil {
+			return nil, fmt.Errorf("filter channel viewers: %w", err)
+		}
+		filtered = append(filtered, ids...)
+	}
+	return filtered, nil
+}
+
+// FilterVisibleChannels returns the channels among channelIDs that visible
+// admits.
+func FilterVisibleChannels(ctx context.Context, db *sql.DB, visible Visibility, channelIDs []int64) ([]int64, error) {
+	filtered := make([]int64, 0, len(channelIDs))
+	for start := 0; start < len(channelIDs); start += maxIDsPerQuery {
+		batch := channelIDs[start:min(start+maxIDsPerQuery, len(channelIDs))]
+		cond, args := visible("id")
+		for _, id := range batch {
+			args = append(args, id)
+		}
+		ids, err := queryIDs(ctx, db, `SELECT id FROM channels WHERE `+cond+` AND id IN (`+placeholders(len(batch))+`) ORDER BY id`, args...)
+		if err != nil {
+			return nil, fmt.Errorf("filter visible channels: %w", err)
+		}
+		filtered = append(filtered, ids...)
+	}
+	return filtered, nil
+}
@@ -3,28 +3,127 @@ package database
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
-	"strings"
 	"time"
 
 	_ "modernc.org/sqlite"
 )
 
-const startupTimeout = 5 * time.Second
+const (
+	startupTimeout      = 5 * time.Second
+	DefaultHistoryLimit = 50
+	MaxHistoryLimit     = 100
+)
+
+var (
+	ErrMessageNotFound  = errors.New("message not found")
+	ErrNotMessageAuthor = errors.New("only the author can change this message")
+	ErrInvalidReply     = errors.New("replies must point at a message in the same conversation")
+)
 
+// Message is a channel message as stored and delivered to clients. Deleted
+// messages are kept as tombstones with empty content and DeletedAt set.
+// ThreadID is set for messages posted inside a thread; Thread summarises the
+// thread spawned from this message, if any. Reactions holds the per-emoji
+// counts, Mentions what the content refers to, and PinnedAt/PinnedBy are set
+// while Pinned.
 type Message struct {
-	ID        int64     `json:"id"`
-	ChannelID int64     `json:"channel_id"`
-	UserID    int64     `json:"user_id"`
-	Username  string    `json:"username"`
-	AvatarURL string    `json:"avatar_url"`
-	Content   string    `json:"content"`
-	CreatedAt time.Time `json:"created_at"`
+	ID        int64             `json:"id"`
+	ChannelID int64             `json:"channel_id"`
+	UserID    int64             `json:"user_id"`
+	Username  string            `json:"username"`
+	AvatarURL string            `json:"avatar_url"`
+	Content   string            `json:"content"`
+	CreatedAt time.Time         `json:"created_at"`
+	EditedAt  *time.Time        `json:"edited_at,omitempty"`
+	DeletedAt *time.Time        `json:"deleted_at,omitempty"`
+	Deleted   bool              `json:"deleted"`
+	ThreadID  *int64            `json:"thread_id,omitempty"`
+	ReplyToID *int64            `json:"reply_to_id,omitempty"`
+	ReplyTo   *MessageReference `json:"reply_to,omitempty"`
+	Thread    *ThreadSummary    `json:"thread,omitempty"`
+	Reactions []ReactionCount   `json:"reactions,omitempty"`
+	Mentions  *Mentions         `json:"mentions,omitempty"`
+	Pinned    bool              `json:"pinned"`
+	PinnedAt  *time.Time        `json:"pinned_at,omitempty"`
+	PinnedBy  *int64            `json:"pinned_by,omitempty"`
 }
 
+// MessageReference is the quoted parent of a reply. Content is cut to
+// replyPreviewLength runes and empty once the parent is deleted.
+type MessageReference struct {
+	ID       int64  `json:"id"`
+	UserID   int64  `json:"user_id"`
+	Username string `json:"username"`
+	Content  string `json:"content"`
+	Deleted  bool   `json:"deleted"`
+}
+
+// MessageOptions carries the optional placement of a new message and the
+// mentions resolved from its content. MentionRecipients are the users whose
+// inbox receives it.
+type MessageOptions struct {
+	ThreadID          int64
+	ReplyToID         int64
+	Mentions          Mentions
+	MentionRecipients []int64
+}
+
+const replyPreviewLength = 200
+
+const messageSelect = `
+SELECT m.id, m.channel_id, m.user_id, u.username, COALESCE(u.avatar_url, ''), m.content, m.created_at, m.edited_at, m.deleted_at,
+	m.thread_id, m.reply_to_id, r.user_id, ru.username, r.content, r.deleted_at,
+	t.id, t.name, t.message_count, t.last_message_at, m.pinned_at, m.pinned_by
+FROM messages m
+JOIN users u ON u.id = m.user_id
+LEFT JOIN messages r ON r.id = m.reply_to_id
+LEFT JOIN users ru ON ru.id = r.user_id
+LEFT JOIN threads t ON t.parent_message_id = m.id`
+
+// messageScope restricts history to one stream: a channel's top level or a
+// single thread.
+type messageScope struct {
+	cond string
+	arg  int64
+}
+
+func channelScope(channelID int64) messageScope {
+	return messageScope{cond: `m.channel_id = ? AND m.thread_id IS NULL`, arg: channelID}
+}
+
+func threadScope(threadID int64) messageScope {
+	return messageScope{cond: `m.thread_id = ?`, arg: threadID}
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// InitDB opens the database and brings its schema up to date.
 func InitDB(dbPath string) (*sql.DB, error) {
+	db, err := OpenDB(dbPath)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), startupTimeout)
+	defer cancel()
+
+	if _, err := Migrate(ctx, db, false); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("migrate schema: %w", err)
+	}
+
+	return db, nil
+}
+
+// OpenDB opens the database without touching its schema, for tooling that
+// only inspects migration state.
+func OpenDB(dbPath string) (*sql.DB, error) {
 	if dbPath == "" {
 		return nil, fmt.Errorf("database path is required")
 	}
@@ -54,16 +153,37 @@ func InitDB(dbPath string) (*sql.DB, error) {
 		return nil, fmt.Errorf("enable wal mode: %w", err)
 	}
 
-	if err := createSchema(ctx, db); err != nil {
-		_ = db.Close()
-		return nil, err
-	}
-
 	return db, nil
 }
 
-func CreateMessage(ctx context.Context, db *sql.DB, userID, channelID int64, content string) (Message, error) {
-	result, err := db.ExecContext(ctx, `INSERT INTO messages (channel_id, user_id, content) VALUES (?, ?, ?)`, channelID, userID, content)
+// CreateMessage stores a message in channelID, inside a thread of that
+// channel and/or as a reply when opts says so. Posting in a thread bumps its
+// counters and makes the author a participant.
+func CreateMessage(ctx context.Context, db *sql.DB, userID, channelID int64, content string, opts MessageOptions) (Message, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return Message{}, fmt.Errorf("begin create message: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var threadID, replyToID *int64
+	if opts.ThreadID > 0 {
+		if err := requireThreadInChannel(ctx, tx, opts.ThreadID, channelID); err != nil {
+			return Message{}, err
+		}
+		threadID = &opts.ThreadID
+	}
+	if opts.ReplyToID > 0 {
+		if err := checkReplyTarget(ctx, tx, opts.ReplyToID, channelID, opts.ThreadID); err != nil {
+			return Message{}, err
+		}
+		replyToID = &opts.ReplyToID
+	}
+
+	result, err := tx.ExecContext(ctx, `INSERT INTO messages (channel_id, user_id, content, thread_id, reply_to_id) VALUES (?, ?, ?, ?, ?)`,
+		channelID, userID, content, threadID, replyToID)
 	if err != nil {
 		return Message{}, fmt.Errorf("insert message: %w", err)
 	}
@@ -73,7 +193,26 @@ func CreateMessage(ctx context.Context, db *sql.DB, userID, channelID int64, con
 		return Message{}, fmt.Errorf("get message id: %w", err)
 	}
 
-	message, err := getMessageByID(ctx, db, messageID)
+	if !opts.Mentions.empty() || len(opts.MentionRecipients) > 0 {
+		if err := saveMentions(ctx, tx, messageID, channelID, opts.Mentions, opts.MentionRecipients); err != nil {
+			return Message{}, err
+		}
+	}
+
+	if threadID != nil {
+		if _, err := tx.ExecContext(ctx, `UPDATE threads SET message_count = message_count + 1, last_message_at = CURRENT_TIMESTAMP WHERE id = ?`, *threadID); err != nil {
+			return Message{}, fmt.Errorf("update thread counters: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO thread_members (thread_id, user_id) VALUES (?, ?)`, *threadID, userID); err != nil {
+			return Message{}, fmt.Errorf("add thread participant: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Message{}, fmt.Errorf("commit message: %w", err)
+	}
+
+	message, err := GetMessage(ctx, db, messageID)
 	if err != nil {
 		return Message{}, err
 	}
@@ -81,138 +220,394 @@ func CreateMessage(ctx context.Context, db *sql.DB, userID, channelID int64, con
 	return message, nil
 }
 
-func GetMessages(ctx context.Context, db *sql.DB, channelID int64, limit int) ([]Message, error) {
+// EditMessage replaces the content of a live message owned by userID along
+// with the mentions resolved from the new content.
+func EditMessage(ctx context.Context, db *sql.DB, messageID, userID int64, content string, mentions Mentions) (Message, error) {
+	if err := checkMessageAuthor(ctx, db, messageID, userID); err != nil {
+		return Message{}, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return Message{}, fmt.Errorf("begin edit message: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if _, err := tx.ExecContext(ctx, `UPDATE messages SET content = ?, edited_at = CURRENT_TIMESTAMP WHERE id = ? AND deleted_at IS NULL`, content, messageID); err != nil {
+		return Message{}, fmt.Errorf("update message: %w", err)
+	}
+	if err := saveMentions(ctx, tx, messageID, 0, mentions, nil); err != nil {
+		return Message{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Message{}, fmt.Errorf("commit edit message: %w", err)
+	}
+	return GetMessage(ctx, db, messageID)
+}
+
+// DeleteMessage tombstones a live message. Unless moderator is set, userID
+// must be its author. The row is kept so history keeps its shape, but the
+// content, reactions, mentions and any pin are discarded.
+func DeleteMessage(ctx context.Context, db *sql.DB, messageID, userID int64, moderator bool) (Message, error) {
+	if err := checkMessageAuthor(ctx, db, messageID, userID); err != nil {
+		if !moderator || !errors.Is(err, ErrNotMessageAuthor) {
+			return Message{}, err
+		}
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return Message{}, fmt.Errorf("begin delete message: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	result, err := tx.ExecContext(ctx, `UPDATE messages SET content = '', deleted_at = CURRENT_TIMESTAMP, pinned_at = NULL, pinned_by = NULL WHERE id = ? AND deleted_at IS NULL`, messageID)
+	if err != nil {
+		return Message{}, fmt.Errorf("delete message: %w", err)
+	}
+	// Thread counts only cover live messages.
+	if affected, err := result.RowsAffected(); err == nil && affected > 0 {
+		if _, err := tx.ExecContext(ctx, `
+UPDATE threads SET message_count = MAX(message_count - 1, 0)
+WHERE id = (SELECT thread_id FROM messages WHERE id = ?)`, messageID); err != nil {
+			return Message{}, fmt.Errorf("update thread counters: %w", err)
+		}
+	}
+	for _, stmt := range []string{
+		`DELETE FROM message_reactions WHERE message_id = ?`,
+		`DELETE FROM message_mentions WHERE message_id = ?`,
+		`DELETE FROM mention_notifications WHERE message_id = ?`,
+	} {
+		if _, err := tx.ExecContext(ctx, stmt, messageID); err != nil {
+			return Message{}, fmt.Errorf("delete message details: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Message{}, fmt.Errorf("commit delete message: %w", err)
+	}
+
+	return GetMessage(ctx, db, messageID)
+}
+
+// HistoryQuery selects a page of channel history. At most one of Before,
+// After and Around may be set; with none set the newest page is returned.
+type HistoryQuery struct {
+	Before int64
+	After  int64
+	Around int64
+	Limit  int
+}
+
+// HistoryPage is a slice of history in ascending ID order. HasMore reports
+// whether further messages exist in the direction being paged: older for
+// Before and the default query, newer for After. Around pages both ways, so
+// HasMoreBefore and HasMoreAfter are set for it instead; HasMore is then
+// true when either side has more.
+type HistoryPage struct {
+	Messages      []Message `json:"messages"`
+	HasMore       bool      `json:"has_more"`
+	HasMoreBefore *bool     `json:"has_more_before,omitempty"`
+	HasMoreAfter  *bool     `json:"has_more_after,omitempty"`
+}
+
+// GetMessages pages through the top level of a channel. Thread messages are
+// left out; their parents carry a thread summary instead.
+func GetMessages(ctx context.Context, db *sql.DB, channelID int64, query HistoryQuery) (HistoryPage, error) {
+	return getMessages(ctx, db, channelScope(channelID), query)
+}
+
+// GetThreadMessages pages through the messages of one thread.
+func GetThreadMessages(ctx context.Context, db *sql.DB, threadID int64, query HistoryQuery) (HistoryPage, error) {
+	return getMessages(ctx, db, threadScope(threadID), query)
+}
+
+func getMessages(ctx context.Context, db *sql.DB, scope messageScope, query HistoryQuery) (HistoryPage, error) {
+	limit := query.Limit
 	if limit <= 0 {
-		limit = 50
+		limit = DefaultHistoryLimit
+	}
+	if limit > MaxHistoryLimit {
+		limit = MaxHistoryLimit
 	}
 
-	rows, err := db.QueryContext(ctx, `
-SELECT m.id, m.channel_id, m.user_id, u.username, COALESCE(u.avatar_url, ''), m.content, m.created_at
-FROM messages m
-JOIN users u ON u.id = m.user_id
-WHERE m.channel_id = ?
-ORDER BY m.id DESC
-LIMIT ?`, channelID, limit)
+	cursors := 0
+	for _, cursor := range []int64{query.Before, query.After, query.Around} {
+		if cursor < 0 {
+			return HistoryPage{}, fmt.Errorf("invalid history cursor")
+		}
+		if cursor > 0 {
+			cursors++
+		}
+	}
+	if cursors > 1 {
+		return HistoryPage{}, fmt.Errorf("only one of before, after or around may be set")
+	}
+
+	switch {
+	case query.After > 0:
+		newer, more, err := queryMessagePage(ctx, db, scope, "ASC", limit, `m.id > ?`, query.After)
+		if err != nil {
+			return HistoryPage{}, err
+		}
+		return HistoryPage{Messages: newer, HasMore: more}, nil
+	case query.Around > 0:
+		// The anchor counts toward the older half so a page of one still
+		// contains the requested message.
+		olderLimit := (limit + 1) / 2
+		older, moreOlder, err := queryMessagePage(ctx, db, scope, "DESC", olderLimit, `m.id <= ?`, query.Around)
+		if err != nil {
+			return HistoryPage{}, err
+		}
+		newer, moreNewer, err := queryMessagePage(ctx, db, scope, "ASC", limit-olderLimit, `m.id > ?`, query.Around)
+		if err != nil {
+			return HistoryPage{}, err
+		}
+		reverseMessages(older)
+		return HistoryPage{
+			Messages:      append(older, newer...),
+			HasMore:       moreOlder || moreNewer,
+			HasMoreBefore: &moreOlder,
+			HasMoreAfter:  &moreNewer,
+		}, nil
+	case query.Before > 0:
+		older, more, err := queryMessagePage(ctx, db, scope, "DESC", limit, `m.id < ?`, query.Before)
+		if err != nil {
+			return HistoryPage{}, err
+		}
+		reverseMessages(older)
+		return HistoryPage{Messages: older, HasMore: more}, nil
+	default:
+		latest, more, err := queryMessagePage(ctx, db, scope, "DESC", limit, "")
+		if err != nil {
+			return HistoryPage{}, err
+		}
+		reverseMessages(latest)
+		return HistoryPage{Messages: latest, HasMore: more}, nil
+	}
+}
+
+// queryMessagePage fetches up to limit messages matching the optional cond
+// in the given order, probing one row further to learn whether more remain.
+func queryMessagePage(ctx context.Context, db *sql.DB, scope messageScope, order string, limit int, cond string, condArgs ...any) ([]Message, bool, error) {
+	if limit <= 0 {
+		return []Message{}, false, nil
+	}
+
+	where := `WHERE ` + scope.cond
+	if cond != "" {
+		where += ` AND ` + cond
+	}
+	args := append([]any{scope.arg}, condArgs...)
+	args = append(args, limit+1)
+
+	rows, err := db.QueryContext(ctx, messageSelect+`
+`+where+`
+ORDER BY m.id `+order+`
+LIMIT ?`, args...)
 	if err != nil {
-		return nil, fmt.Errorf("query messages: %w", err)
+		return nil, false, fmt.Errorf("query messages: %w", err)
 	}
 	defer rows.Close()
 
-	messages := make([]Message, 0, limit)
+	messages := make([]Message, 0, limit+1)
 	for rows.Next() {
-		var msg Message
-		if err := rows.Scan(&msg.ID, &msg.ChannelID, &msg.UserID, &msg.Username, &msg.AvatarURL, &msg.Content, &msg.CreatedAt); err != nil {
-			return nil, fmt.Errorf("scan message: %w", err)
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, false, err
 		}
 		messages = append(messages, msg)
 	}
 
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("iterate messages: %w", err)
+		return nil, false, fmt.Errorf("iterate messages: %w", err)
 	}
 
+	more := len(messages) > limit
+	if more {
+		messages = messages[:limit]
+	}
+	if err := attachMessageDetails(ctx, db, messages); err != nil {
+		return nil, false, err
+	}
+	return messages, more, nil
+}
+
+func reverseMessages(messages []Message) {
 	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
 		messages[i], messages[j] = messages[j], messages[i]
 	}
-
-	return messages, nil
 }
 
-func getMessageByID(ctx context.Context, db *sql.DB, id int64) (Message, error) {
-	var msg Message
-	err := db.QueryRowContext(ctx, `
-SELECT m.id, m.channel_id, m.user_id, u.username, COALESCE(u.avatar_url, ''), m.content, m.created_at
-FROM messages m
-JOIN users u ON u.id = m.user_id
-WHERE m.id = ?`, id).Scan(&msg.ID, &msg.ChannelID, &msg.UserID, &msg.Username, &msg.AvatarURL, &msg.Content, &msg.CreatedAt)
+func GetMessage(ctx context.Context, db *sql.DB, id int64) (Message, error) {
+	msg, err := scanMessage(db.QueryRowContext(ctx, messageSelect+`
+WHERE m.id = ?`, id))
 	if err != nil {
-		return Message{}, fmt.Errorf("fetch message: %w", err)
+		if errors.Is(err, sql.ErrNoRows) {
+			return Message{}, ErrMessageNotFound
+		}
+		return Message{}, err
 	}
-	return msg, nil
-}
 
-func createSchema(ctx context.Context, db *sql.DB) error {
-	const schemaSQL = `
-CREATE TABLE IF NOT EXISTS users (
-	id INTEGER PRIMARY KEY AUTOINCREMENT,
-	username TEXT NOT NULL UNIQUE,
-	password_hash TEXT NOT NULL,
-	avatar_url TEXT NOT NULL DEFAULT '',
-	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
-);
-
-CREATE TABLE IF NOT EXISTS sessions (
-	token TEXT PRIMARY KEY,
-	user_id INTEGER NOT NULL,
-	expires_at DATETIME NOT NULL,
-	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
-	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
-);
-
-CREATE TABLE IF NOT EXISTS channels (
-	id INTEGER PRIMARY KEY AUTOINCREMENT,
-	name TEXT NOT NULL UNIQUE,
-	type TEXT NOT NULL,
-	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
-);
-
-CREATE TABLE IF NOT EXISTS messages (
-	id INTEGER PRIMARY KEY AUTOINCREMENT,
-	channel_id INTEGER NOT NULL,
-	user_id INTEGER NOT NULL,
-	content TEXT NOT NULL,
-	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
-	FOREIGN KEY (channel_id) REFERENCES channels(id) ON DELETE CASCADE,
-	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
-);
-`
-
-	if _, err := db.ExecContext(ctx, schemaSQL); err != nil {
-		return fmt.Errorf("create schema: %w", err)
-	}
-
-	if err := ensureUserAvatarColumn(ctx, db); err != nil {
-		return err
+	messages := []Message{msg}
+	if err := attachMessageDetails(ctx, db, messages); err != nil {
+		return Message{}, err
 	}
-
-	return nil
+	return messages[0], nil
 }
 
-func ensureUserAvatarColumn(ctx context.Context, db *sql.DB) error {
-	rows, err := db.QueryContext(ctx, `PRAGMA table_info(users)`) 
+// getMessagesByID loads the given messages in one query, keyed by ID.
+func getMessagesByID(ctx context.Context, db *sql.DB, ids []int64) (map[int64]Message, error) {
+	byID := make(map[int64]Message, len(ids))
+	if len(ids) == 0 {
+		return byID, nil
+	}
+
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	rows, err := db.QueryContext(ctx, messageSelect+`
+WHERE m.id IN (`+placeholders(len(ids))+`)`, args...)
 	if err != nil {
-		return fmt.Errorf("inspect users table: %w", err)
+		return nil, fmt.Errorf("query messages: %w", err)
 	}
 	defer rows.Close()
 
-	hasAvatar := false
+	messages := make([]Message, 0, len(ids))
 	for rows.Next() {
-		var (
-			cid       int
-			name      string
-			typeName  string
-			notNull   int
-			defaultV  sql.NullString
-			primaryID int
-		)
-		if err := rows.Scan(&cid, &name, &typeName, &notNull, &defaultV, &primaryID); err != nil {
-			return fmt.Errorf("scan users pragma: %w", err)
-		}
-		if strings.EqualFold(name, "avatar_url") {
-			hasAvatar = true
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
 		}
+		messages = append(messages, msg)
 	}
 	if err := rows.Err(); err != nil {
-		return fmt.Errorf("iterate users pragma: %w", err)
+		return nil, fmt.Errorf("iterate messages: %w", err)
 	}
 
-	if hasAvatar {
-		return nil
+	if err := attachMessageDetails(ctx, db, messages); err != nil {
+		return nil, err
+	}
+	for _, msg := range messages {
+		byID[msg.ID] = msg
 	}
+	return byID, nil
+}
 
-	if _, err := db.ExecContext(ctx, `ALTER TABLE users ADD COLUMN avatar_url TEXT NOT NULL DEFAULT ''`); err != nil {
-		return fmt.Errorf("add avatar_url column: %w", err)
+// attachMessageDetails fills in the data kept outside the messages table.
+func attachMessageDetails(ctx context.Context, db *sql.DB, messages []Message) error {
+	if err := attachReactions(ctx, db, messages); err != nil {
+		return err
 	}
+	return attachMentions(ctx, db, messages)
+}
 
+func checkMessageAuthor(ctx context.Context, db *sql.DB, messageID, userID int64) error {
+	var authorID int64
+	err := db.QueryRowContext(ctx, `SELECT user_id FROM messages WHERE id = ? AND deleted_at IS NULL`, messageID).Scan(&authorID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrMessageNotFound
+		}
+		return fmt.Errorf("fetch message author: %w", err)
+	}
+	if authorID != userID {
+		return ErrNotMessageAuthor
+	}
 	return nil
 }
+
+func scanMessage(row rowScanner) (Message, error) {
+	var (
+		msg            Message
+		editedAt       sql.NullTime
+		deletedAt      sql.NullTime
+		threadID       sql.NullInt64
+		replyToID      sql.NullInt64
+		replyUserID    sql.NullInt64
+		replyUsername  sql.NullString
+		replyContent   sql.NullString
+		replyDeletedAt sql.NullTime
+		summaryID      sql.NullInt64
+		summaryName    sql.NullString
+		summaryCount   sql.NullInt64
+		summaryLast    sql.NullTime
+		pinnedAt       sql.NullTime
+		pinnedBy       sql.NullInt64
+	)
+	if err := row.Scan(&msg.ID, &msg.ChannelID, &msg.UserID, &msg.Username, &msg.AvatarURL, &msg.Content, &msg.CreatedAt, &editedAt, &deletedAt,
+		&threadID, &replyToID, &replyUserID, &replyUsername, &replyContent, &replyDeletedAt,
+		&summaryID, &summaryName, &summaryCount, &summaryLast, &pinnedAt, &pinnedBy); err != nil {
+		return Message{}, fmt.Errorf("scan message: %w", err)
+	}
+	if editedAt.Valid {
+		msg.EditedAt = &editedAt.Time
+	}
+	if deletedAt.Valid {
+		msg.DeletedAt = &deletedAt.Time
+		msg.Deleted = true
+	}
+	if threadID.Valid {
+		msg.ThreadID = &threadID.Int64
+	}
+	if replyToID.Valid {
+		msg.ReplyToID = &replyToID.Int64
+		if replyUserID.Valid {
+			msg.ReplyTo = &MessageReference{
+				ID:       replyToID.Int64,
+				UserID:   replyUserID.Int64,
+				Username: replyUsername.String,
+				Content:  truncateRunes(replyContent.String, replyPreviewLength),
+				Deleted:  replyDeletedAt.Valid,
+			}
+		}
+	}
+	if pinnedAt.Valid {
+		msg.Pinned = true
+		msg.PinnedAt = &pinnedAt.Time
+		if pinnedBy.Valid {
+			msg.PinnedBy = &pinnedBy.Int64
+		}
+	}
+	if summaryID.Valid {
+		msg.Thread = &ThreadSummary{ID: summaryID.Int64, Name: summaryName.String, MessageCount: int(summaryCount.Int64)}
+		if summaryLast.Valid {
+			msg.Thread.LastMessageAt = &summaryLast.Time
+		}
+	}
+	return msg, nil
+}
+
+// checkReplyTarget requires the replied-to message to live in the same
+// channel and the same thread, or top level, as the reply.
+func checkReplyTarget(ctx context.Context, tx *sql.Tx, replyToID, channelID, threadID int64) error {
+	var (
+		parentChannel int64
+		parentThread  sql.NullInt64
+	)
+	err := tx.QueryRowContext(ctx, `SELECT channel_id, thread_id FROM messages WHERE id = ?`, replyToID).Scan(&parentChannel, &parentThread)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrInvalidReply
+		}
+		return fmt.Errorf("fetch reply target: %w", err)
+	}
+	if parentChannel != channelID || parentThread.Int64 != threadID {
+		return ErrInvalidReply
+	}
+	return nil
+}
+
+func truncateRunes(s string, limit int) string {
+	runes := []rune(s)
+	if len(runes) <= limit {
+		return s
+	}
+	return string(runes[:limit]) + "…"
+}
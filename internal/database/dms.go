@@ -0,0 +1,301 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxGroupDMMembers caps the size of a group DM, including its creator.
+const MaxGroupDMMembers = 10
+
+var (
+	ErrUserNotFound     = errors.New("user not found")
+	ErrInvalidDMMembers = errors.New("invalid conversation members")
+)
+
+type ChannelMember struct {
+	ID        int64  `json:"id"`
+	Username  string `json:"username"`
+	AvatarURL string `json:"avatar_url"`
+}
+
+type DMChannel struct {
+	ID          int64           `json:"id"`
+	Type        string          `json:"type"`
+	Members     []ChannelMember `json:"members"`
+	LastMessage *Message        `json:"last_message,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+}
+
+// OpenDM returns the conversation between exactly userIDs, creating it when
+// none exists yet. Two members make a dm, more make a group_dm. The bool
+// result reports whether a new conversation was created.
+func OpenDM(ctx context.Context, db *sql.DB, userIDs []int64) (DMChannel, bool, error) {
+	members := uniqueSortedIDs(userIDs)
+	if len(members) < 2 {
+		return DMChannel{}, false, fmt.Errorf("%w: a conversation needs at least one other user", ErrInvalidDMMembers)
+	}
+	if len(members) > MaxGroupDMMembers {
+		return DMChannel{}, false, fmt.Errorf("%w: group conversations are limited to %d members", ErrInvalidDMMembers, MaxGroupDMMembers)
+	}
+
+	channelType := ChannelTypeDM
+	if len(members) > 2 {
+		channelType = ChannelTypeGroupDM
+	}
+	key := dmKey(members)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return DMChannel{}, false, fmt.Errorf("begin dm transaction: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var channelID int64
+	err = tx.QueryRowContext(ctx, `SELECT id FROM channels WHERE name = ? AND type = ?`, key, channelType).Scan(&channelID)
+	switch {
+	case err == nil:
+		if err := tx.Commit(); err != nil {
+			return DMChannel{}, false, fmt.Errorf("commit dm lookup: %w", err)
+		}
+		dm, err := GetDM(ctx, db, channelID)
+		return dm, false, err
+	case !errors.Is(err, sql.ErrNoRows):
+		return DMChannel{}, false, fmt.Errorf("lookup dm: %w", err)
+	}
+
+	for _, id := range members {
+		var exists int
+		if err := tx.QueryRowContext(ctx, `SELECT 1 FROM users WHERE id = ?`, id).Scan(&exists); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return DMChannel{}, false, ErrUserNotFound
+			}
+			return DMChannel{}, false, fmt.Errorf("lookup dm member: %w", err)
+		}
+	}
+
+	result, err := tx.ExecContext(ctx, `INSERT INTO channels (name, type) VALUES (?, ?)`, key, channelType)
+	if err != nil {
+		if strings.Contains(strings.ToLower(err.Error()), "unique") {
+			// Another request opened the same conversation first.
+			_ = tx.Rollback()
+			if err := db.QueryRowContext(ctx, `SELECT id FROM channels WHERE name = ?`, key).Scan(&channelID); err != nil {
+				return DMChannel{}, false, fmt.Errorf("lookup dm: %w", err)
+			}
+			dm, err := GetDM(ctx, db, channelID)
+			return dm, false, err
+		}
+		return DMChannel{}, false, fmt.Errorf("insert dm channel: %w", err)
+	}
+	channelID, err = result.LastInsertId()
+	if err != nil {
+		return DMChannel{}, false, fmt.Errorf("get dm channel id: %w", err)
+	}
+
+	for _, id := range members {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO channel_members (channel_id, user_id) VALUES (?, ?)`, channelID, id); err != nil {
+			return DMChannel{}, false, fmt.Errorf("insert dm member: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return DMChannel{}, false, fmt.Errorf("commit dm: %w", err)
+	}
+
+	dm, err := GetDM(ctx, db, channelID)
+	return dm, true, err
+}
+
+func GetDM(ctx context.Context, db *sql.DB, channelID int64) (DMChannel, error) {
+	var dm DMChannel
+	err := db.QueryRowContext(ctx, `SELECT id, type, created_at FROM channels WHERE id = ? AND type IN (?, ?)`, channelID, ChannelTypeDM, ChannelTypeGroupDM).
+		Scan(&dm.ID, &dm.Type, &dm.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return DMChannel{}, ErrChannelNotFound
+		}
+		return DMChannel{}, fmt.Errorf("fetch dm: %w", err)
+	}
+
+	members, err := ListChannelMembers(ctx, db, channelID)
+	if err != nil {
+		return DMChannel{}, err
+	}
+	dm.Members = members
+
+	last, err := lastMessage(ctx, db, channelID)
+	if err != nil {
+		return DMChannel{}, err
+	}
+	dm.LastMessage = last
+
+	return dm, nil
+}
+
+// userDMs selects the conversations of the user bound to its first
+// parameter; the other two are the DM channel types.
+const userDMs = `SELECT c.id FROM channels c
+JOIN channel_members mine ON mine.channel_id = c.id AND mine.user_id = ?
+WHERE c.type IN (?, ?)`
+
+// ListDMs returns every conversation userID belongs to, most recently active
+// first, each with its latest message as a preview.
+func ListDMs(ctx context.Context, db *sql.DB, userID int64) ([]DMChannel, error) {
+	dmArgs := []any{userID, ChannelTypeDM, ChannelTypeGroupDM}
+	rows, err := db.QueryContext(ctx, `
+SELECT c.id, c.type, c.created_at
+FROM channels c
+WHERE c.id IN (`+userDMs+`)
+ORDER BY COALESCE((SELECT MAX(m.id) FROM messages m WHERE m.channel_id = c.id AND m.thread_id IS NULL AND m.deleted_at IS NULL), 0) DESC, c.id DESC`, dmArgs...)
+	if err != nil {
+		return nil, fmt.Errorf("query dms: %w", err)
+	}
+
+	dms := make([]DMChannel, 0)
+	index := make(map[int64]int)
+	for rows.Next() {
+		dm := DMChannel{Members: make([]ChannelMember, 0)}
+		if err := rows.Scan(&dm.ID, &dm.Type, &dm.CreatedAt); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan dm: %w", err)
+		}
+		index[dm.ID] = len(dms)
+		dms = append(dms, dm)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return nil, fmt.Errorf("iterate dms: %w", err)
+	}
+	rows.Close()
+	if len(dms) == 0 {
+		return dms, nil
+	}
+
+	rows, err = db.QueryContext(ctx, `
+SELECT cm.channel_id, u.id, u.username, COALESCE(u.avatar_url, '')
+FROM channel_members cm
+JOIN users u ON u.id = cm.user_id
+WHERE cm.channel_id IN (`+userDMs+`)
+ORDER BY u.username ASC`, dmArgs...)
+	if err != nil {
+		return nil, fmt.Errorf("query dm members: %w", err)
+	}
+	for rows.Next() {
+		var (
+			channelID int64
+			member    ChannelMember
+		)
+		if err := rows.Scan(&channelID, &member.ID, &member.Username, &member.AvatarURL); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan dm member: %w", err)
+		}
+		if i, ok := index[channelID]; ok {
+			dms[i].Members = append(dms[i].Members, member)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return nil, fmt.Errorf("iterate dm members: %w", err)
+	}
+	rows.Close()
+
+	rows, err = db.QueryContext(ctx, messageSelect+`
+WHERE m.id IN (
+	SELECT MAX(id) FROM messages
+	WHERE channel_id IN (`+userDMs+`) AND thread_id IS NULL AND deleted_at IS NULL
+	GROUP BY channel_id)`, dmArgs...)
+	if err != nil {
+		return nil, fmt.Errorf("query dm previews: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		if i, ok := index[msg.ChannelID]; ok {
+			dms[i].LastMessage = &msg
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate dm previews: %w", err)
+	}
+	return dms, nil
+}
+
+func ListChannelMembers(ctx context.Context, db *sql.DB, channelID int64) ([]ChannelMember, error) {
+	rows, err := db.QueryContext(ctx, `
+SELECT u.id, u.username, COALESCE(u.avatar_url, '')
+FROM channel_members cm
+JOIN users u ON u.id = cm.user_id
+WHERE cm.channel_id = ?
+ORDER BY u.username ASC`, channelID)
+	if err != nil {
+		return nil, fmt.Errorf("query channel members: %w", err)
+	}
+	defer rows.Close()
+
+	members := make([]ChannelMember, 0)
+	for rows.Next() {
+		var member ChannelMember
+		if err := rows.Scan(&member.ID, &member.Username, &member.AvatarURL); err != nil {
+			return nil, fmt.Errorf("scan channel member: %w", err)
+		}
+		members = append(members, member)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate channel members: %w", err)
+	}
+	return members, nil
+}
+
+// lastMessage returns the preview of a conversation: its latest top-level
+// message that has not been deleted.
+func lastMessage(ctx context.Context, db *sql.DB, channelID int64) (*Message, error) {
+	msg, err := scanMessage(db.QueryRowContext(ctx, messageSelect+`
+WHERE m.channel_id = ? AND m.thread_id IS NULL AND m.deleted_at IS NULL
+ORDER BY m.id DESC
+LIMIT 1`, channelID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// dmKey is stored as the channel name so a member set maps to exactly one
+// conversation. The colon keeps it outside the user channel name alphabet.
+func dmKey(members []int64) string {
+	parts := make([]string, 0, len(members))
+	for _, id := range members {
+		parts = append(parts, strconv.FormatInt(id, 10))
+	}
+	return "dm:" + strings.Join(parts, ",")
+}
+
+func uniqueSortedIDs(ids []int64) []int64 {
+	seen := make(map[int64]struct{}, len(ids))
+	unique := make([]int64, 0, len(ids))
+	for _, id := range ids {
+		if id <= 0 {
+			continue
+		}
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		unique = append(unique, id)
+	}
+	sort.Slice(unique, func(i, j int) bool { return unique[i] < unique[j] })
+	return unique
+}
@@ -0,0 +1,354 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Mention kinds as stored in message_mentions.
+const (
+	MentionUser     = "user"
+	MentionChannel  = "channel"
+	MentionEveryone = "everyone"
+	MentionHere     = "here"
+)
+
+// maxMentionTargets bounds how many distinct users and channels one message
+// can reference, so a wall of @names cannot fan out without limit.
+const maxMentionTargets = 50
+
+var (
+	userMentionPattern    = regexp.MustCompile(`(?:^|[^A-Za-z0-9_@])@([A-Za-z0-9]{3,20})\b`)
+	channelMentionPattern = regexp.MustCompile(`(?:^|[^A-Za-z0-9_&#/])#([A-Za-z0-9_-]{1,30})`)
+)
+
+// ParsedMentions is what the text of a message refers to, before the names
+// have been looked up.
+type ParsedMentions struct {
+	Usernames []string
+	Channels  []string
+	Everyone  bool
+	Here      bool
+}
+
+// Mentions is the structured mention data stored alongside a message.
+// Users and Channels only hold references that resolved to something.
+type Mentions struct {
+	Users    []int64 `json:"users,omitempty"`
+	Channels []int64 `json:"channels,omitempty"`
+	Everyone bool    `json:"everyone,omitempty"`
+	Here     bool    `json:"here,omitempty"`
+}
+
+func (m Mentions) empty() bool {
+	return len(m.Users) == 0 && len(m.Channels) == 0 && !m.Everyone && !m.Here
+}
+
+// MentionNotification is one entry of a user's mentions inbox.
+type MentionNotification struct {
+	Message   Message    `json:"message"`
+	ChannelID int64      `json:"channel_id"`
+	Read      bool       `json:"read"`
+	ReadAt    *time.Time `json:"read_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// MentionQuery selects a page of the inbox, newest first.
+type MentionQuery struct {
+	Before     int64
+	Limit      int
+	UnreadOnly bool
+}
+
+// ParseMentions extracts @user, @everyone, @here and #channel references
+// from message content. Names are de-duplicated case-insensitively.
+func ParseMentions(content string) ParsedMentions {
+	var parsed ParsedMentions
+	seen := make(map[string]bool)
+	for _, match := range userMentionPattern.FindAllStringSubmatch(content, -1) {
+		name := strings.ToLower(match[1])
+		switch name {
+		case MentionEveryone:
+			parsed.Everyone = true
+		case MentionHere:
+			parsed.Here = true
+		default:
+			if !seen[name] && len(parsed.Usernames) < maxMentionTargets {
+				seen[name] = true
+				parsed.Usernames = append(parsed.Usernames, match[1])
+			}
+		}
+	}
+
+	seen = make(map[string]bool)
+	for _, match := range channelMentionPattern.FindAllStringSubmatch(content, -1) {
+		name := strings.ToLower(match[1])
+		if !seen[name] && len(parsed.Channels) < maxMentionTargets {
+			seen[name] = true
+			parsed.Channels = append(parsed.Channels, match[1])
+		}
+	}
+	return parsed
+}
+
+// IsReservedMention reports whether a username would collide with a
+// broadcast mention.
+func IsReservedMention(username string) bool {
+	name := strings.ToLower(username)
+	return name == MentionEveryone || name == MentionHere
+}
+
+// ResolveMentions looks up the names in parsed. Unknown users are dropped,
+// as are channels visible does not admit; DMs cannot be referenced with #.
+func ResolveMentions(ctx context.Context, db *sql.DB, parsed ParsedMentions, visible Visibility) (Mentions, error) {
+	mentions := Mentions{Everyone: parsed.Everyone, Here: parsed.Here}
+
+	if len(parsed.Usernames) > 0 {
+		ids, err := queryIDs(ctx, db, `SELECT id FROM users WHERE username COLLATE NOCASE IN (`+placeholders(len(parsed.Usernames))+`) ORDER BY id`, stringArgs(parsed.Usernames)...)
+		if err != nil {
+			return Mentions{}, fmt.Errorf("resolve user mentions: %w", err)
+		}
+		mentions.Users = ids
+	}
+
+	if len(parsed.Channels) > 0 {
+		cond, visibleArgs := visible("id")
+		args := append(stringArgs(parsed.Channels), ChannelTypeDM, ChannelTypeGroupDM)
+		ids, err := queryIDs(ctx, db, `SELECT id FROM channels WHERE name COLLATE NOCASE IN (`+placeholders(len(parsed.Channels))+`) AND type NOT IN (?, ?) AND `+cond+` ORDER BY id`, append(args, visibleArgs...)...)
+		if err != nil {
+			return Mentions{}, fmt.Errorf("resolve channel mentions: %w", err)
+		}
+		mentions.Channels = ids
+	}
+
+	return mentions, nil
+}
+
+// ListMentions pages through userID's inbox. Entries from channels visible
+// no longer admits are left out. HasMore reports whether older entries
+// remain.
+func ListMentions(ctx context.Context, db *sql.DB, userID int64, visible Visibility, query MentionQuery) ([]MentionNotification, bool, error) {
+	limit := query.Limit
+	if limit <= 0 {
+		limit = DefaultHistoryLimit
+	}
+	if limit > MaxHistoryLimit {
+		limit = MaxHistoryLimit
+	}
+
+	cond, visibleArgs := visible("n.channel_id")
+	where := `WHERE n.user_id = ? AND ` + cond
+	args := append([]any{userID}, visibleArgs...)
+	if query.Before > 0 {
+		where += ` AND n.message_id < ?`
+		args = append(args, query.Before)
+	}
+	if query.UnreadOnly {
+		where += ` AND n.read_at IS NULL`
+	}
+	args = append(args, limit+1)
+
+	rows, err := db.QueryContext(ctx, `SELECT n.message_id, n.channel_id, n.read_at, n.created_at FROM mention_notifications n
+`+where+`
+ORDER BY n.message_id DESC
+LIMIT ?`, args...)
+	if err != nil {
+		return nil, false, fmt.Errorf("query mentions: %w", err)
+	}
+	defer rows.Close()
+
+	notifications := make([]MentionNotification, 0, limit+1)
+	ids := make([]int64, 0, limit+1)
+	for rows.Next() {
+		var (
+			notification MentionNotification
+			readAt       sql.NullTime
+		)
+		if err := rows.Scan(&notification.Message.ID, &notification.ChannelID, &readAt, &notification.CreatedAt); err != nil {
+			return nil, false, fmt.Errorf("scan mention: %w", err)
+		}
+		if readAt.Valid {
+			notification.Read = true
+			notification.ReadAt = &readAt.Time
+		}
+		notifications = append(notifications, notification)
+		ids = append(ids, notification.Message.ID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, fmt.Errorf("iterate mentions: %w", err)
+	}
+
+	more := len(notifications) > limit
+	if more {
+		notifications = notifications[:limit]
+		ids = ids[:limit]
+	}
+	messages, err := getMessagesByID(ctx, db, ids)
+	if err != nil {
+		return nil, false, err
+	}
+	for i := range notifications {
+		notifications[i].Message = messages[notifications[i].Message.ID]
+	}
+	return notifications, more, nil
+}
+
+// UnreadMentionCount counts the unread entries in userID's inbox, leaving
+// out channels visible no longer admits.
+func UnreadMentionCount(ctx context.Context, db *sql.DB, userID int64, visible Visibility) (int, error) {
+	cond, visibleArgs := visible("channel_id")
+	var count int
+	err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM mention_notifications WHERE user_id = ? AND read_at IS NULL AND `+cond,
+		append([]any{userID}, visibleArgs...)...).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("count unread mentions: %w", err)
+	}
+	return count, nil
+}
+
+// MarkMentionsRead marks the given inbox entries read, or all of them when
+// messageIDs is empty, and returns how many changed.
+func MarkMentionsRead(ctx context.Context, db *sql.DB, userID int64, messageIDs []int64) (int64, error) {
+	stmt := `UPDATE mention_notifications SET read_at = CURRENT_TIMESTAMP WHERE user_id = ? AND read_at IS NULL`
+	args := []any{userID}
+	if len(messageIDs) > 0 {
+		stmt += ` AND message_id IN (` + placeholders(len(messageIDs)) + `)`
+		for _, id := range messageIDs {
+			args = append(args, id)
+		}
+	}
+
+	result, err := db.ExecContext(ctx, stmt, args...)
+	if err != nil {
+		return 0, fmt.Errorf("mark mentions read: %w", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("mark mentions read: %w", err)
+	}
+	return affected, nil
+}
+
+// saveMentions replaces the stored references of a message and files a
+// notification for each recipient. Edits pass no recipients: changing a
+// message updates what it refers to but pings nobody.
+func saveMentions(ctx context.Context, tx *sql.Tx, messageID, channelID int64, mentions Mentions, recipients []int64) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM message_mentions WHERE message_id = ?`, messageID); err != nil {
+		return fmt.Errorf("clear mentions: %w", err)
+	}
+
+	refs := make([][2]any, 0, len(mentions.Users)+len(mentions.Channels)+2)
+	for _, id := range mentions.Users {
+		refs = append(refs, [2]any{MentionUser, id})
+	}
+	for _, id := range mentions.Channels {
+		refs = append(refs, [2]any{MentionChannel, id})
+	}
+	if mentions.Everyone {
+		refs = append(refs, [2]any{MentionEveryone, 0})
+	}
+	if mentions.Here {
+		refs = append(refs, [2]any{MentionHere, 0})
+	}
+	for _, ref := range refs {
+		if _, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO message_mentions (message_id, kind, target_id) VALUES (?, ?, ?)`, messageID, ref[0], ref[1]); err != nil {
+			return fmt.Errorf("insert mention: %w", err)
+		}
+	}
+
+	for _, userID := range recipients {
+		if _, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO mention_notifications (user_id, message_id, channel_id) VALUES (?, ?, ?)`, userID, messageID, channelID); err != nil {
+			return fmt.Errorf("insert mention notification: %w", err)
+		}
+	}
+	return nil
+}
+
+// attachMentions fills in the stored mention data of each message.
+func attachMentions(ctx context.Context, db *sql.DB, messages []Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	index := make(map[int64]int, len(messages))
+	args := make([]any, 0, len(messages))
+	for i, msg := range messages {
+		index[msg.ID] = i
+		args = append(args, msg.ID)
+	}
+
+	rows, err := db.QueryContext(ctx, `
+SELECT message_id, kind, target_id
+FROM message_mentions
+WHERE message_id IN (`+placeholders(len(args))+`)
+ORDER BY message_id, kind, target_id`, args...)
+	if err != nil {
+		return fmt.Errorf("query mentions: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			messageID, targetID int64
+			kind                string
+		)
+		if err := rows.Scan(&messageID, &kind, &targetID); err != nil {
+			return fmt.Errorf("scan mention: %w", err)
+		}
+		i, ok := index[messageID]
+		if !ok {
+			continue
+		}
+		if messages[i].Mentions == nil {
+			messages[i].Mentions = &Mentions{}
+		}
+		switch kind {
+		case MentionUser:
+			messages[i].Mentions.Users = append(messages[i].Mentions.Users, targetID)
+		case MentionChannel:
+			messages[i].Mentions.Channels = append(messages[i].Mentions.Channels, targetID)
+		case MentionEveryone:
+			messages[i].Mentions.Everyone = true
+		case MentionHere:
+			messages[i].Mentions.Here = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("iterate mentions: %w", err)
+	}
+	return nil
+}
+
+func queryIDs(ctx context.Context, db *sql.DB, query string, args ...any) ([]int64, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+func stringArgs(values []string) []any {
+	args := make([]any, len(values))
+	for i, value := range values {
+		args[i] = value
+	}
+	return args
+}
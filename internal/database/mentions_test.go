@@ -0,0 +1,50 @@
+package database_test
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"openvoice/internal/database"
+	"openvoice/internal/permissions"
+)
+
+func TestResolveMentionsSkipsHiddenChannels(t *testing.T) {
+	ctx := context.Background()
+	db, err := database.InitDB(filepath.Join(t.TempDir(), "openvoice.db"))
+	if err != nil {
+		t.Fatalf("init db: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	if _, err := db.ExecContext(ctx, `INSERT INTO users (id, username, password_hash) VALUES (1, 'alice', ''), (2, 'bob', '')`); err != nil {
+		t.Fatalf("insert users: %v", err)
+	}
+
+	// alice creates, and so joins, both channels; bob only sees the public one.
+	lobby, err := database.CreateChannel(ctx, db, 1, database.Channel{Name: "lobby", Type: database.ChannelTypeText})
+	if err != nil {
+		t.Fatalf("create lobby: %v", err)
+	}
+	secret, err := database.CreateChannel(ctx, db, 1, database.Channel{Name: "secret", Type: database.ChannelTypeText, Private: true})
+	if err != nil {
+		t.Fatalf("create secret: %v", err)
+	}
+
+	parsed := database.ParseMentions("see #lobby and #secret")
+	for _, tc := range []struct {
+		author int64
+		want   []int64
+	}{
+		{1, []int64{lobby.ID, secret.ID}},
+		{2, []int64{lobby.ID}},
+	} {
+		mentions, err := database.ResolveMentions(ctx, db, parsed, permissions.VisibleChannels(tc.author))
+		if err != nil {
+			t.Fatalf("resolve mentions for user %d: %v", tc.author, err)
+		}
+		if !slices.Equal(mentions.Channels, tc.want) {
+			t.Errorf("user %d resolved channels %v, want %v", tc.author, mentions.Channels, tc.want)
+		}
+	}
+}
@@ -0,0 +1,682 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+type migrationFunc func(ctx context.Context, tx *sql.Tx) error
+
+type migration struct {
+	version int
+	name    string
+	up      migrationFunc
+	down    migrationFunc
+}
+
+type MigrationStatus struct {
+	Version   int       `json:"version"`
+	Name      string    `json:"name"`
+	Applied   bool      `json:"applied"`
+	AppliedAt time.Time `json:"applied_at"`
+}
+
+// migrations is the ordered list of schema changes. Versions must be
+// contiguous and start at 1; append new entries, never edit applied ones.
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "initial_schema",
+		up: execSQL(`
+CREATE TABLE IF NOT EXISTS users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	username TEXT NOT NULL UNIQUE,
+	password_hash TEXT NOT NULL,
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS sessions (
+	token TEXT PRIMARY KEY,
+	user_id INTEGER NOT NULL,
+	expires_at DATETIME NOT NULL,
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS channels (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL UNIQUE,
+	type TEXT NOT NULL,
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS messages (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	channel_id INTEGER NOT NULL,
+	user_id INTEGER NOT NULL,
+	content TEXT NOT NULL,
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (channel_id) REFERENCES channels(id) ON DELETE CASCADE,
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+`),
+		down: execSQL(`
+DROP TABLE IF EXISTS messages;
+DROP TABLE IF EXISTS channels;
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS users;
+`),
+	},
+	{
+		// Databases created before migrations existed may already carry the
+		// column, so the up step checks before altering.
+		version: 2,
+		name:    "users_avatar_url",
+		up: func(ctx context.Context, tx *sql.Tx) error {
+			hasAvatar, err := columnExists(ctx, tx, "users", "avatar_url")
+			if err != nil {
+				return err
+			}
+			if hasAvatar {
+				return nil
+			}
+			if _, err := tx.ExecContext(ctx, `ALTER TABLE users ADD COLUMN avatar_url TEXT NOT NULL DEFAULT ''`); err != nil {
+				return fmt.Errorf("add avatar_url column: %w", err)
+			}
+			return nil
+		},
+		down: execSQL(`ALTER TABLE users DROP COLUMN avatar_url`),
+	},
+	{
+		version: 3,
+		name:    "messages_edit_delete",
+		up: execSQL(`
+ALTER TABLE messages ADD COLUMN edited_at DATETIME;
+ALTER TABLE messages ADD COLUMN deleted_at DATETIME;
+`),
+		down: execSQL(`
+ALTER TABLE messages DROP COLUMN deleted_at;
+ALTER TABLE messages DROP COLUMN edited_at;
+`),
+	},
+	{
+		// messages_fts is an external-content index over messages.content;
+		// the triggers keep it in step with inserts, edits and deletes.
+		version: 4,
+		name:    "messages_fts",
+		up: execSQL(`
+CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(content, content='messages', content_rowid='id');
+
+CREATE TRIGGER IF NOT EXISTS messages_fts_ai AFTER INSERT ON messages BEGIN
+	INSERT INTO messages_fts(rowid, content) VALUES (new.id, new.content);
+END;
+
+CREATE TRIGGER IF NOT EXISTS messages_fts_ad AFTER DELETE ON messages BEGIN
+	INSERT INTO messages_fts(messages_fts, rowid, content) VALUES ('delete', old.id, old.content);
+END;
+
+CREATE TRIGGER IF NOT EXISTS messages_fts_au AFTER UPDATE OF content ON messages BEGIN
+	INSERT INTO messages_fts(messages_fts, rowid, content) VALUES ('delete', old.id, old.content);
+	INSERT INTO messages_fts(rowid, content) VALUES (new.id, new.content);
+END;
+
+INSERT INTO messages_fts(messages_fts) VALUES ('rebuild');
+`),
+		down: execSQL(`
+DROP TRIGGER IF EXISTS messages_fts_au;
+DROP TRIGGER IF EXISTS messages_fts_ad;
+DROP TRIGGER IF EXISTS messages_fts_ai;
+DROP TABLE IF EXISTS messages_fts;
+`),
+	},
+	{
+		version: 5,
+		name:    "channel_members",
+		up: execSQL(`
+CREATE TABLE IF NOT EXISTS channel_members (
+	channel_id INTEGER NOT NULL,
+	user_id INTEGER NOT NULL,
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (channel_id, user_id),
+	FOREIGN KEY (channel_id) REFERENCES channels(id) ON DELETE CASCADE,
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_channel_members_user ON channel_members(user_id);
+`),
+		down: execSQL(`
+DROP INDEX IF EXISTS idx_channel_members_user;
+DROP TABLE IF EXISTS channel_members;
+`),
+	},
+	{
+		version: 6,
+		name:    "private_channels",
+		up: execSQL(`
+ALTER TABLE channels ADD COLUMN private INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE channels ADD COLUMN created_by INTEGER REFERENCES users(id) ON DELETE SET NULL;
+`),
+		down: execSQL(`
+ALTER TABLE channels DROP COLUMN created_by;
+ALTER TABLE channels DROP COLUMN private;
+`),
+	},
+	{
+		// Seeds the built-in roles. Permission values mirror the bit layout in
+		// internal/permissions; the oldest account becomes the owner.
+		version: 7,
+		name:    "roles_and_permissions",
+		up: execSQL(`
+CREATE TABLE IF NOT EXISTS roles (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL UNIQUE,
+	permissions INTEGER NOT NULL DEFAULT 0,
+	position INTEGER NOT NULL DEFAULT 0,
+	builtin INTEGER NOT NULL DEFAULT 0,
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS user_roles (
+	user_id INTEGER NOT NULL,
+	role_id INTEGER NOT NULL,
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (user_id, role_id),
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+	FOREIGN KEY (role_id) REFERENCES roles(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS channel_permission_overrides (
+	channel_id INTEGER NOT NULL,
+	role_id INTEGER NOT NULL,
+	allow INTEGER NOT NULL DEFAULT 0,
+	deny INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (channel_id, role_id),
+	FOREIGN KEY (channel_id) REFERENCES channels(id) ON DELETE CASCADE,
+	FOREIGN KEY (role_id) REFERENCES roles(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS bans (
+	user_id INTEGER PRIMARY KEY,
+	banned_by INTEGER,
+	reason TEXT NOT NULL DEFAULT '',
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+INSERT OR IGNORE INTO roles (name, permissions, position, builtin) VALUES
+	('owner', 2048, 1000, 1),
+	('admin', 2048, 100, 1),
+	('moderator', 711, 50, 1),
+	('member', 7, 0, 1);
+
+INSERT OR IGNORE INTO user_roles (user_id, role_id)
+SELECT (SELECT MIN(id) FROM users), (SELECT id FROM roles WHERE name = 'owner')
+WHERE EXISTS (SELECT 1 FROM users);
+`),
+		down: execSQL(`
+DROP TABLE IF EXISTS bans;
+DROP TABLE IF EXISTS channel_permission_overrides;
+DROP TABLE IF EXISTS user_roles;
+DROP TABLE IF EXISTS roles;
+`),
+	},
+	{
+		// Existing channels keep their creation order as their position.
+		version: 8,
+		name:    "channel_management",
+		up: execSQL(`
+CREATE TABLE IF NOT EXISTS channel_categories (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL,
+	position INTEGER NOT NULL DEFAULT 0,
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+ALTER TABLE channels ADD COLUMN topic TEXT NOT NULL DEFAULT '';
+ALTER TABLE channels ADD COLUMN position INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE channels ADD COLUMN category_id INTEGER;
+
+UPDATE channels SET position = id;
+`),
+		down: execSQL(`
+ALTER TABLE channels DROP COLUMN category_id;
+ALTER TABLE channels DROP COLUMN position;
+ALTER TABLE channels DROP COLUMN topic;
+DROP TABLE IF EXISTS channel_categories;
+`),
+	},
+	{
+		// Channel types used to be free-form. Anything unrecognised becomes a
+		// text channel, which is how it already behaved.
+		version: 9,
+		name:    "normalize_channel_types",
+		up: execSQL(`
+UPDATE channels SET type = 'text'
+WHERE type NOT IN ('text', 'voice', 'announcement', 'stage', 'forum', 'dm', 'group_dm');
+`),
+		// The original values are not kept, so there is nothing to restore.
+		down: func(context.Context, *sql.Tx) error { return nil },
+	},
+	{
+		// Thread messages keep the channel_id of their parent channel so
+		// access checks and search treat them like any other message.
+		version: 10,
+		name:    "threads_and_replies",
+		up: execSQL(`
+ALTER TABLE messages ADD COLUMN thread_id INTEGER;
+ALTER TABLE messages ADD COLUMN reply_to_id INTEGER;
+CREATE INDEX IF NOT EXISTS idx_messages_thread ON messages(thread_id, id);
+
+CREATE TABLE IF NOT EXISTS threads (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	channel_id INTEGER NOT NULL,
+	parent_message_id INTEGER UNIQUE,
+	name TEXT NOT NULL,
+	created_by INTEGER,
+	message_count INTEGER NOT NULL DEFAULT 0,
+	last_message_at DATETIME,
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (channel_id) REFERENCES channels(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_threads_channel ON threads(channel_id);
+
+CREATE TABLE IF NOT EXISTS thread_members (
+	thread_id INTEGER NOT NULL,
+	user_id INTEGER NOT NULL,
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (thread_id, user_id),
+	FOREIGN KEY (thread_id) REFERENCES threads(id) ON DELETE CASCADE,
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+`),
+		down: execSQL(`
+DROP TABLE IF EXISTS thread_members;
+DROP INDEX IF EXISTS idx_threads_channel;
+DROP TABLE IF EXISTS threads;
+DROP INDEX IF EXISTS idx_messages_thread;
+ALTER TABLE messages DROP COLUMN reply_to_id;
+ALTER TABLE messages DROP COLUMN thread_id;
+`),
+	},
+	{
+		version: 11,
+		name:    "message_reactions",
+		up: execSQL(`
+CREATE TABLE IF NOT EXISTS message_reactions (
+	message_id INTEGER NOT NULL,
+	user_id INTEGER NOT NULL,
+	emoji TEXT NOT NULL,
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (message_id, user_id, emoji),
+	FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE,
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_message_reactions_emoji ON message_reactions(message_id, emoji, created_at);
+`),
+		down: execSQL(`
+DROP INDEX IF EXISTS idx_message_reactions_emoji;
+DROP TABLE IF EXISTS message_reactions;
+`),
+	},
+	{
+		version: 12,
+		name:    "message_pins",
+		up: execSQL(`
+ALTER TABLE messages ADD COLUMN pinned_at DATETIME;
+ALTER TABLE messages ADD COLUMN pinned_by INTEGER;
+CREATE INDEX IF NOT EXISTS idx_messages_pinned ON messages(channel_id, pinned_at) WHERE pinned_at IS NOT NULL;
+`),
+		down: execSQL(`
+DROP INDEX IF EXISTS idx_messages_pinned;
+ALTER TABLE messages DROP COLUMN pinned_by;
+ALTER TABLE messages DROP COLUMN pinned_at;
+`),
+	},
+	{
+		// message_mentions records what a message refers to; the
+		// notifications are the per-user inbox those references produced.
+		// Moderators gain mention_everyone (4096) so @everyone and @here
+		// keep working for the people who used to moderate.
+		version: 13,
+		name:    "mentions",
+		up: execSQL(`
+CREATE TABLE IF NOT EXISTS message_mentions (
+	message_id INTEGER NOT NULL,
+	kind TEXT NOT NULL,
+	target_id INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (message_id, kind, target_id),
+	FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS mention_notifications (
+	user_id INTEGER NOT NULL,
+	message_id INTEGER NOT NULL,
+	channel_id INTEGER NOT NULL,
+	read_at DATETIME,
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (user_id, message_id),
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+	FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_mention_notifications_unread ON mention_notifications(user_id, read_at, message_id);
+CREATE INDEX IF NOT EXISTS idx_mention_notifications_message ON mention_notifications(message_id);
+
+UPDATE roles SET permissions = permissions | 4096 WHERE name = 'moderator' AND builtin = 1;
+`),
+		down: execSQL(`
+UPDATE roles SET permissions = permissions & ~4096;
+UPDATE channel_permission_overrides SET allow = allow & ~4096, deny = deny & ~4096;
+DROP INDEX IF EXISTS idx_mention_notifications_message;
+DROP INDEX IF EXISTS idx_mention_notifications_unread;
+DROP TABLE IF EXISTS mention_notifications;
+DROP TABLE IF EXISTS message_mentions;
+`),
+	},
+	{
+		version: 14,
+		name:    "channel_read_states",
+		up: execSQL(`
+CREATE TABLE IF NOT EXISTS channel_read_states (
+	user_id INTEGER NOT NULL,
+	channel_id INTEGER NOT NULL,
+	last_read_message_id INTEGER NOT NULL DEFAULT 0,
+	updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (user_id, channel_id),
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+	FOREIGN KEY (channel_id) REFERENCES channels(id) ON DELETE CASCADE
+);
+`),
+		down: execSQL(`DROP TABLE IF EXISTS channel_read_states;`),
+	},
+	{
+		version: 15,
+		name:    "user_presence",
+		up: execSQL(`
+CREATE TABLE IF NOT EXISTS user_presence (
+	user_id INTEGER PRIMARY KEY,
+	status TEXT NOT NULL DEFAULT 'online',
+	custom_status TEXT NOT NULL DEFAULT '',
+	custom_status_expires_at DATETIME,
+	updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+`),
+		down: execSQL(`DROP TABLE IF EXISTS user_presence;`),
+	},
+	{
+		// Every channel starts out in mesh mode, which is how voice worked
+		// before the server could forward media.
+		version: 16,
+		name:    "channel_voice_mode",
+		up:      execSQL(`ALTER TABLE channels ADD COLUMN voice_mode TEXT NOT NULL DEFAULT 'mesh';`),
+		down:    execSQL(`ALTER TABLE channels DROP COLUMN voice_mode;`),
+	},
+	{
+		// A recording has one file per participant track, kept in
+		// recording_tracks. Moderators gain record_voice (8192).
+		version: 17,
+		name:    "voice_recordings",
+		up: execSQL(`
+CREATE TABLE IF NOT EXISTS recordings (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	channel_id INTEGER NOT NULL,
+	started_by INTEGER,
+	video INTEGER NOT NULL DEFAULT 0,
+	started_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	ended_at DATETIME,
+	FOREIGN KEY (channel_id) REFERENCES channels(id) ON DELETE CASCADE,
+	FOREIGN KEY (started_by) REFERENCES users(id) ON DELETE SET NULL
+);
+CREATE INDEX IF NOT EXISTS idx_recordings_channel ON recordings(channel_id, id);
+
+CREATE TABLE IF NOT EXISTS recording_tracks (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	recording_id INTEGER NOT NULL,
+	user_id INTEGER NOT NULL,
+	kind TEXT NOT NULL,
+	file_name TEXT NOT NULL,
+	size INTEGER NOT NULL DEFAULT 0,
+	started_at DATETIME NOT NULL,
+	ended_at DATETIME NOT NULL,
+	FOREIGN KEY (recording_id) REFERENCES recordings(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_recording_tracks_recording ON recording_tracks(recording_id);
+
+UPDATE roles SET permissions = permissions | 8192 WHERE name = 'moderator' AND builtin = 1;
+`),
+		down: execSQL(`
+UPDATE roles SET permissions = permissions & ~8192;
+UPDATE channel_permission_overrides SET allow = allow & ~8192, deny = deny & ~8192;
+DROP INDEX IF EXISTS idx_recording_tracks_recording;
+DROP TABLE IF EXISTS recording_tracks;
+DROP INDEX IF EXISTS idx_recordings_channel;
+DROP TABLE IF EXISTS recordings;
+`),
+	},
+}
+
+// Migrate applies every pending migration in order, each in its own
+// transaction. With dryRun set nothing is written and the pending
+// migrations are only reported. It refuses to run when the database has
+// been migrated by a newer binary.
+func Migrate(ctx context.Context, db *sql.DB, dryRun bool) ([]MigrationStatus, error) {
+	if err := ensureMigrationsTable(ctx, db); err != nil {
+		return nil, err
+	}
+
+	current, err := currentVersion(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	if latest := LatestVersion(); current > latest {
+		return nil, fmt.Errorf("database schema version %d is newer than this binary supports (%d)", current, latest)
+	}
+
+	pending := make([]MigrationStatus, 0)
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		status := MigrationStatus{Version: m.version, Name: m.name}
+		if !dryRun {
+			if err := runMigration(ctx, db, m.version, m.name, m.up, true); err != nil {
+				return pending, err
+			}
+			status.Applied = true
+			status.AppliedAt = time.Now().UTC()
+		}
+		pending = append(pending, status)
+	}
+
+	return pending, nil
+}
+
+// Rollback reverts applied migrations, newest first, until the schema is at
+// target. With dryRun set it only reports what would be reverted.
+func Rollback(ctx context.Context, db *sql.DB, target int, dryRun bool) ([]MigrationStatus, error) {
+	if target < 0 {
+		return nil, fmt.Errorf("invalid target version %d", target)
+	}
+	if err := ensureMigrationsTable(ctx, db); err != nil {
+		return nil, err
+	}
+
+	current, err := currentVersion(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	if current > LatestVersion() {
+		return nil, fmt.Errorf("database schema version %d is newer than this binary supports (%d)", current, LatestVersion())
+	}
+
+	reverted := make([]MigrationStatus, 0)
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.version > current || m.version <= target {
+			continue
+		}
+		status := MigrationStatus{Version: m.version, Name: m.name, Applied: true}
+		if !dryRun {
+			if err := runMigration(ctx, db, m.version, m.name, m.down, false); err != nil {
+				return reverted, err
+			}
+			status.Applied = false
+		}
+		reverted = append(reverted, status)
+	}
+
+	return reverted, nil
+}
+
+// Status reports every known migration and whether it has been applied.
+func Status(ctx context.Context, db *sql.DB) ([]MigrationStatus, error) {
+	if err := ensureMigrationsTable(ctx, db); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT version, name, applied_at FROM schema_migrations ORDER BY version ASC`)
+	if err != nil {
+		return nil, fmt.Errorf("query schema migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]MigrationStatus)
+	for rows.Next() {
+		var status MigrationStatus
+		if err := rows.Scan(&status.Version, &status.Name, &status.AppliedAt); err != nil {
+			return nil, fmt.Errorf("scan schema migration: %w", err)
+		}
+		status.Applied = true
+		applied[status.Version] = status
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate schema migrations: %w", err)
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		if status, ok := applied[m.version]; ok {
+			statuses = append(statuses, status)
+			delete(applied, m.version)
+			continue
+		}
+		statuses = append(statuses, MigrationStatus{Version: m.version, Name: m.name})
+	}
+	// Versions recorded by a newer binary are still listed so the operator
+	// can see why startup is refused.
+	unknown := make([]int, 0, len(applied))
+	for version := range applied {
+		unknown = append(unknown, version)
+	}
+	sort.Ints(unknown)
+	for _, version := range unknown {
+		statuses = append(statuses, applied[version])
+	}
+
+	return statuses, nil
+}
+
+func LatestVersion() int {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].version
+}
+
+func runMigration(ctx context.Context, db *sql.DB, version int, name string, step migrationFunc, up bool) error {
+	direction := "down"
+	if up {
+		direction = "up"
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin migration %d: %w", version, err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if err := step(ctx, tx); err != nil {
+		return fmt.Errorf("migration %d (%s) %s: %w", version, name, direction, err)
+	}
+
+	if up {
+		_, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, name) VALUES (?, ?)`, version, name)
+	} else {
+		_, err = tx.ExecContext(ctx, `DELETE FROM schema_migrations WHERE version = ?`, version)
+	}
+	if err != nil {
+		return fmt.Errorf("record migration %d: %w", version, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit migration %d: %w", version, err)
+	}
+	return nil
+}
+
+func ensureMigrationsTable(ctx context.Context, db *sql.DB) error {
+	const stmt = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+	version INTEGER PRIMARY KEY,
+	name TEXT NOT NULL,
+	applied_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);`
+	if _, err := db.ExecContext(ctx, stmt); err != nil {
+		return fmt.Errorf("create schema_migrations table: %w", err)
+	}
+	return nil
+}
+
+func currentVersion(ctx context.Context, db *sql.DB) (int, error) {
+	var version int
+	if err := db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return 0, fmt.Errorf("read schema version: %w", err)
+	}
+	return version, nil
+}
+
+func execSQL(stmt string) migrationFunc {
+	return func(ctx context.Context, tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+		return nil
+	}
+}
+
+func columnExists(ctx context.Context, tx *sql.Tx, table, column string) (bool, error) {
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf(`PRAGMA table_info(%s)`, table))
+	if err != nil {
+		return false, fmt.Errorf("inspect %s table: %w", table, err)
+	}
+	defer rows.Close()
+
+	found := false
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			typeName  string
+			notNull   int
+			defaultV  sql.NullString
+			primaryID int
+		)
+		if err := rows.Scan(&cid, &name, &typeName, &notNull, &defaultV, &primaryID); err != nil {
+			return false, fmt.Errorf("scan %s pragma: %w", table, err)
+		}
+		if strings.EqualFold(name, column) {
+			found = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return false, fmt.Errorf("iterate %s pragma: %w", table, err)
+	}
+
+	return found, nil
+}
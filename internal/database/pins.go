@@ -0,0 +1,109 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// MaxPinsPerChannel caps how many messages one channel can have pinned.
+const MaxPinsPerChannel = 50
+
+var ErrTooManyPins = errors.New("this channel has reached the pin limit")
+
+// PinMessage pins a live message in its channel on behalf of userID. It
+// reports whether the message was newly pinned; pinning twice is not an
+// error and does not count against the limit again.
+func PinMessage(ctx context.Context, db *sql.DB, messageID, userID int64) (Message, bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return Message{}, false, fmt.Errorf("begin pin message: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var (
+		channelID int64
+		pinned    bool
+	)
+	err = tx.QueryRowContext(ctx, `SELECT channel_id, pinned_at IS NOT NULL FROM messages WHERE id = ? AND deleted_at IS NULL`, messageID).Scan(&channelID, &pinned)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Message{}, false, ErrMessageNotFound
+		}
+		return Message{}, false, fmt.Errorf("fetch message: %w", err)
+	}
+
+	if !pinned {
+		var count int
+		if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM messages WHERE channel_id = ? AND pinned_at IS NOT NULL`, channelID).Scan(&count); err != nil {
+			return Message{}, false, fmt.Errorf("count pins: %w", err)
+		}
+		if count >= MaxPinsPerChannel {
+			return Message{}, false, ErrTooManyPins
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE messages SET pinned_at = CURRENT_TIMESTAMP, pinned_by = ? WHERE id = ?`, userID, messageID); err != nil {
+			return Message{}, false, fmt.Errorf("pin message: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Message{}, false, fmt.Errorf("commit pin message: %w", err)
+	}
+
+	message, err := GetMessage(ctx, db, messageID)
+	if err != nil {
+		return Message{}, false, err
+	}
+	return message, !pinned, nil
+}
+
+// UnpinMessage removes the pin from a message and reports whether it was
+// pinned.
+func UnpinMessage(ctx context.Context, db *sql.DB, messageID int64) (Message, bool, error) {
+	result, err := db.ExecContext(ctx, `UPDATE messages SET pinned_at = NULL, pinned_by = NULL WHERE id = ? AND pinned_at IS NOT NULL`, messageID)
+	if err != nil {
+		return Message{}, false, fmt.Errorf("unpin message: %w", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return Message{}, false, fmt.Errorf("unpin message: %w", err)
+	}
+
+	message, err := GetMessage(ctx, db, messageID)
+	if err != nil {
+		return Message{}, false, err
+	}
+	return message, affected > 0, nil
+}
+
+// ListPins returns the pinned messages of a channel, including those inside
+// its threads, most recently pinned first.
+func ListPins(ctx context.Context, db *sql.DB, channelID int64) ([]Message, error) {
+	rows, err := db.QueryContext(ctx, messageSelect+`
+WHERE m.channel_id = ? AND m.pinned_at IS NOT NULL
+ORDER BY m.pinned_at DESC, m.id DESC`, channelID)
+	if err != nil {
+		return nil, fmt.Errorf("query pins: %w", err)
+	}
+	defer rows.Close()
+
+	messages := make([]Message, 0)
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate pins: %w", err)
+	}
+
+	if err := attachMessageDetails(ctx, db, messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
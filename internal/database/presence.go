@@ -0,0 +1,113 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Presence statuses. Users choose online, idle, dnd or invisible; offline
+// is what others see when a user has no connections or is invisible.
+const (
+	PresenceOnline    = "online"
+	PresenceIdle      = "idle"
+	PresenceDND       = "dnd"
+	PresenceInvisible = "invisible"
+	PresenceOffline   = "offline"
+)
+
+// MaxCustomStatusLength caps the custom status text, in runes.
+const MaxCustomStatusLength = 128
+
+var (
+	ErrInvalidPresence     = errors.New("status must be one of online, idle, dnd or invisible")
+	ErrInvalidCustomStatus = errors.New("custom status must be at most 128 characters and expire in the future")
+)
+
+// CustomStatus is a short user-chosen line shown next to their presence.
+// It disappears once ExpiresAt has passed.
+type CustomStatus struct {
+	Text      string     `json:"text"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// Expired reports whether the status has run out at now.
+func (c *CustomStatus) Expired(now time.Time) bool {
+	return c != nil && c.ExpiresAt != nil && !now.Before(*c.ExpiresAt)
+}
+
+// PresenceSettings is what a user has chosen, as opposed to what their
+// connections currently report.
+type PresenceSettings struct {
+	Status       string
+	CustomStatus *CustomStatus
+}
+
+// IsSelectablePresence reports whether users may choose status themselves.
+func IsSelectablePresence(status string) bool {
+	switch status {
+	case PresenceOnline, PresenceIdle, PresenceDND, PresenceInvisible:
+		return true
+	default:
+		return false
+	}
+}
+
+// GetPresenceSettings loads userID's chosen status, defaulting to online.
+// An expired custom status is dropped.
+func GetPresenceSettings(ctx context.Context, db *sql.DB, userID int64) (PresenceSettings, error) {
+	var (
+		settings  PresenceSettings
+		text      string
+		expiresAt sql.NullTime
+	)
+	err := db.QueryRowContext(ctx, `SELECT status, custom_status, custom_status_expires_at FROM user_presence WHERE user_id = ?`, userID).Scan(&settings.Status, &text, &expiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return PresenceSettings{Status: PresenceOnline}, nil
+		}
+		return PresenceSettings{}, fmt.Errorf("fetch presence: %w", err)
+	}
+	if !IsSelectablePresence(settings.Status) {
+		settings.Status = PresenceOnline
+	}
+	if text != "" {
+		settings.CustomStatus = &CustomStatus{Text: text}
+		if expiresAt.Valid {
+			settings.CustomStatus.ExpiresAt = &expiresAt.Time
+		}
+		if settings.CustomStatus.Expired(time.Now()) {
+			settings.CustomStatus = nil
+		}
+	}
+	return settings, nil
+}
+
+// SavePresenceSettings stores userID's chosen status and custom status.
+func SavePresenceSettings(ctx context.Context, db *sql.DB, userID int64, settings PresenceSettings) error {
+	if !IsSelectablePresence(settings.Status) {
+		return ErrInvalidPresence
+	}
+
+	var (
+		text      string
+		expiresAt *time.Time
+	)
+	if settings.CustomStatus != nil {
+		text = settings.CustomStatus.Text
+		expiresAt = settings.CustomStatus.ExpiresAt
+	}
+
+	if _, err := db.ExecContext(ctx, `
+INSERT INTO user_presence (user_id, status, custom_status, custom_status_expires_at) VALUES (?, ?, ?, ?)
+ON CONFLICT (user_id) DO UPDATE SET
+	status = excluded.status,
+	custom_status = excluded.custom_status,
+	custom_status_expires_at = excluded.custom_status_expires_at,
+	updated_at = CURRENT_TIMESTAMP`, userID, settings.Status, text, expiresAt); err != nil {
+		return fmt.Errorf("save presence: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+const (
+	// MaxReactionEmojis caps how many distinct emoji one message can carry.
+	MaxReactionEmojis = 20
+	maxEmojiLength    = 64
+)
+
+var (
+	ErrInvalidEmoji     = errors.New("emoji must be a unicode emoji or a custom emoji id")
+	ErrTooManyReactions = errors.New("this message has reached the reaction limit")
+)
+
+// ReactionCount aggregates the reactions on a message for one emoji.
+type ReactionCount struct {
+	Emoji string `json:"emoji"`
+	Count int    `json:"count"`
+}
+
+// NormalizeEmoji validates a reaction key. Custom emoji are referenced by
+// their numeric ID; anything else must be a short run of non-ASCII
+// characters so plain words such as "+1" are not accepted as reactions.
+func NormalizeEmoji(emoji string) (string, error) {
+	emoji = strings.TrimSpace(emoji)
+	if emoji == "" || len(emoji) > maxEmojiLength {
+		return "", ErrInvalidEmoji
+	}
+
+	digits, unicodeRunes := true, false
+	for _, r := range emoji {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return "", ErrInvalidEmoji
+		}
+		if r < '0' || r > '9' {
+			digits = false
+		}
+		if r > unicode.MaxASCII {
+			unicodeRunes = true
+		}
+	}
+	if !digits && !unicodeRunes {
+		return "", ErrInvalidEmoji
+	}
+	return emoji, nil
+}
+
+// AddReaction records userID reacting to messageID with emoji. It reports
+// whether a new reaction was stored; reacting twice is not an error.
+func AddReaction(ctx context.Context, db *sql.DB, messageID, userID int64, emoji string) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("begin add reaction: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if err := requireLiveMessage(ctx, tx, messageID); err != nil {
+		return false, err
+	}
+
+	var exists bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM message_reactions WHERE message_id = ? AND emoji = ?)`, messageID, emoji).Scan(&exists); err != nil {
+		return false, fmt.Errorf("check reaction: %w", err)
+	}
+	if !exists {
+		var distinct int
+		if err := tx.QueryRowContext(ctx, `SELECT COUNT(DISTINCT emoji) FROM message_reactions WHERE message_id = ?`, messageID).Scan(&distinct); err != nil {
+			return false, fmt.Errorf("count reactions: %w", err)
+		}
+		if distinct >= MaxReactionEmojis {
+			return false, ErrTooManyReactions
+		}
+	}
+
+	result, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO message_reactions (message_id, user_id, emoji) VALUES (?, ?, ?)`, messageID, userID, emoji)
+	if err != nil {
+		return false, fmt.Errorf("insert reaction: %w", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("insert reaction: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("commit reaction: %w", err)
+	}
+	return affected > 0, nil
+}
+
+// RemoveReaction drops userID's emoji reaction from messageID and reports
+// whether there was one to remove.
+func RemoveReaction(ctx context.Context, db *sql.DB, messageID, userID int64, emoji string) (bool, error) {
+	result, err := db.ExecContext(ctx, `DELETE FROM message_reactions WHERE message_id = ? AND user_id = ? AND emoji = ?`, messageID, userID, emoji)
+	if err != nil {
+		return false, fmt.Errorf("delete reaction: %w", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("delete reaction: %w", err)
+	}
+	return affected > 0, nil
+}
+
+// ReactionCountFor returns how many users reacted to messageID with emoji.
+func ReactionCountFor(ctx context.Context, db *sql.DB, messageID int64, emoji string) (int, error) {
+	var count int
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM message_reactions WHERE message_id = ? AND emoji = ?`, messageID, emoji).Scan(&count); err != nil {
+		return 0, fmt.Errorf("count reactions: %w", err)
+	}
+	return count, nil
+}
+
+// ListReactionUsers lists who reacted to messageID with emoji, earliest
+// first.
+func ListReactionUsers(ctx context.Context, db *sql.DB, messageID int64, emoji string) ([]ChannelMember, error) {
+	rows, err := db.QueryContext(ctx, `
+SELECT u.id, u.username, COALESCE(u.avatar_url, '')
+FROM message_reactions mr
+JOIN users u ON u.id = mr.user_id
+WHERE mr.message_id = ? AND mr.emoji = ?
+ORDER BY mr.created_at ASC, u.id ASC`, messageID, emoji)
+	if err != nil {
+		return nil, fmt.Errorf("query reaction users: %w", err)
+	}
+	defer rows.Close()
+
+	users := make([]ChannelMember, 0)
+	for rows.Next() {
+		var user ChannelMember
+		if err := rows.Scan(&user.ID, &user.Username, &user.AvatarURL); err != nil {
+			return nil, fmt.Errorf("scan reaction user: %w", err)
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate reaction users: %w", err)
+	}
+	return users, nil
+}
+
+// attachReactions fills in the aggregated reactions of each message with a
+// single query, keeping emoji in the order they were first used.
+func attachReactions(ctx context.Context, db *sql.DB, messages []Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	index := make(map[int64]int, len(messages))
+	args := make([]any, 0, len(messages))
+	for i, msg := range messages {
+		index[msg.ID] = i
+		args = append(args, msg.ID)
+	}
+
+	rows, err := db.QueryContext(ctx, `
+SELECT message_id, emoji, COUNT(*)
+FROM message_reactions
+WHERE message_id IN (`+placeholders(len(args))+`)
+GROUP BY message_id, emoji
+ORDER BY message_id, MIN(created_at), emoji`, args...)
+	if err != nil {
+		return fmt.Errorf("query reactions: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			messageID int64
+			reaction  ReactionCount
+		)
+		if err := rows.Scan(&messageID, &reaction.Emoji, &reaction.Count); err != nil {
+			return fmt.Errorf("scan reaction: %w", err)
+		}
+		if i, ok := index[messageID]; ok {
+			messages[i].Reactions = append(messages[i].Reactions, reaction)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("iterate reactions: %w", err)
+	}
+	return nil
+}
+
+func requireLiveMessage(ctx context.Context, tx *sql.Tx, messageID int64) error {
+	var id int64
+	err := tx.QueryRowContext(ctx, `SELECT id FROM messages WHERE id = ? AND deleted_at IS NULL`, messageID).Scan(&id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrMessageNotFound
+		}
+		return fmt.Errorf("fetch message: %w", err)
+	}
+	return nil
+}
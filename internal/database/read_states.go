@@ -0,0 +1,220 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// ReadState is how far a user has read in one channel. UnreadCount covers
+// live top-level messages from other users after LastReadMessageID;
+// MentionCount is the user's unread mentions in the channel, threads
+// included.
+type ReadState struct {
+	ChannelID         int64 `json:"channel_id"`
+	LastReadMessageID int64 `json:"last_read_message_id"`
+	UnreadCount       int   `json:"unread_count"`
+	MentionCount      int   `json:"mention_count"`
+}
+
+// AckChannel records that userID has read channelID up to messageID, or up
+// to the newest message when messageID is zero. The marker never moves
+// backwards, and mentions up to it are marked read.
+func AckChannel(ctx context.Context, db *sql.DB, userID, channelID, messageID int64) (ReadState, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return ReadState{}, fmt.Errorf("begin ack channel: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if messageID <= 0 {
+		if err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(id), 0) FROM messages WHERE channel_id = ?`, channelID).Scan(&messageID); err != nil {
+			return ReadState{}, fmt.Errorf("fetch latest message: %w", err)
+		}
+	} else {
+		var found int64
+		err := tx.QueryRowContext(ctx, `SELECT id FROM messages WHERE id = ? AND channel_id = ?`, messageID, channelID).Scan(&found)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ReadState{}, ErrMessageNotFound
+			}
+			return ReadState{}, fmt.Errorf("fetch acked message: %w", err)
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+INSERT INTO channel_read_states (user_id, channel_id, last_read_message_id) VALUES (?, ?, ?)
+ON CONFLICT (user_id, channel_id) DO UPDATE SET
+	last_read_message_id = MAX(last_read_message_id, excluded.last_read_message_id),
+	updated_at = CURRENT_TIMESTAMP`, userID, channelID, messageID); err != nil {
+		return ReadState{}, fmt.Errorf("save read state: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE mention_notifications SET read_at = CURRENT_TIMESTAMP WHERE user_id = ? AND channel_id = ? AND message_id <= ? AND read_at IS NULL`, userID, channelID, messageID); err != nil {
+		return ReadState{}, fmt.Errorf("mark mentions read: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return ReadState{}, fmt.Errorf("commit ack channel: %w", err)
+	}
+	return GetReadState(ctx, db, userID, channelID)
+}
+
+// GetReadState returns userID's read state in one channel.
+func GetReadState(ctx context.Context, db *sql.DB, userID, channelID int64) (ReadState, error) {
+	states, err := ReadStates(ctx, db, userID, []int64{channelID})
+	if err != nil {
+		return ReadState{}, err
+	}
+	return states[channelID], nil
+}
+
+// ReadStates returns userID's read state in each of channelIDs. Channels
+// the user has never opened count every message as unread.
+func ReadStates(ctx context.Context, db *sql.DB, userID int64, channelIDs []int64) (map[int64]ReadState, error) {
+	states := make(map[int64]ReadState, len(channelIDs))
+	if len(channelIDs) == 0 {
+		return states, nil
+	}
+
+	ids := make([]any, len(channelIDs))
+	for i, id := range channelIDs {
+		ids[i] = id
+		states[id] = ReadState{ChannelID: id}
+	}
+	in := placeholders(len(ids))
+
+	rows, err := db.QueryContext(ctx, `SELECT channel_id, last_read_message_id FROM channel_read_states WHERE user_id = ? AND channel_id IN (`+in+`)`, append([]any{userID}, ids...)...)
+	if err != nil {
+		return nil, fmt.Errorf("query read states: %w", err)
+	}
+	err = scanCounts(rows, func(channelID, value int64) {
+		state := states[channelID]
+		state.LastReadMessageID = value
+		states[channelID] = state
+	})
+	if err != nil {
+		return nil, fmt.Errorf("scan read states: %w", err)
+	}
+
+	rows, err = db.QueryContext(ctx, `
+SELECT m.channel_id, COUNT(*)
+FROM messages m
+LEFT JOIN channel_read_states rs ON rs.user_id = ? AND rs.channel_id = m.channel_id
+WHERE m.channel_id IN (`+in+`)
+  AND m.thread_id IS NULL AND m.deleted_at IS NULL AND m.user_id != ?
+  AND m.id > COALESCE(rs.last_read_message_id, 0)
+GROUP BY m.channel_id`, append(append([]any{userID}, ids...), userID)...)
+	if err != nil {
+		return nil, fmt.Errorf("count unread messages: %w", err)
+	}
+	err = scanCounts(rows, func(channelID, value int64) {
+		state := states[channelID]
+		state.UnreadCount = int(value)
+		states[channelID] = state
+	})
+	if err != nil {
+		return nil, fmt.Errorf("scan unread counts: %w", err)
+	}
+
+	rows, err = db.QueryContext(ctx, `
+SELECT channel_id, COUNT(*)
+FROM mention_notifications
+WHERE user_id = ? AND read_at IS NULL AND channel_id IN (`+in+`)
+GROUP BY channel_id`, append([]any{userID}, ids...)...)
+	if err != nil {
+		return nil, fmt.Errorf("count unread mentions: %w", err)
+	}
+	err = scanCounts(rows, func(channelID, value int64) {
+		state := states[channelID]
+		state.MentionCount = int(value)
+		states[channelID] = state
+	})
+	if err != nil {
+		return nil, fmt.Errorf("scan mention counts: %w", err)
+	}
+
+	return states, nil
+}
+
+// ChannelReadStates returns the read state in channelID of each of
+// userIDs, with the same three queries however many users there are.
+func ChannelReadStates(ctx context.Context, db *sql.DB, channelID int64, userIDs []int64) (map[int64]ReadState, error) {
+	states := make(map[int64]ReadState, len(userIDs))
+	for start := 0; start < len(userIDs); start += maxIDsPerQuery {
+		batch := userIDs[start:min(start+maxIDsPerQuery, len(userIDs))]
+		ids := make([]any, len(batch))
+		for i, id := range batch {
+			ids[i] = id
+			states[id] = ReadState{ChannelID: channelID}
+		}
+		in := placeholders(len(ids))
+
+		rows, err := db.QueryContext(ctx, `SELECT user_id, last_read_message_id FROM channel_read_states WHERE channel_id = ? AND user_id IN (`+in+`)`, append([]any{channelID}, ids...)...)
+		if err != nil {
+			return nil, fmt.Errorf("query read states: %w", err)
+		}
+		err = scanCounts(rows, func(userID, value int64) {
+			state := states[userID]
+			state.LastReadMessageID = value
+			states[userID] = state
+		})
+		if err != nil {
+			return nil, fmt.Errorf("scan read states: %w", err)
+		}
+
+		rows, err = db.QueryContext(ctx, `
+SELECT u.id, COUNT(*)
+FROM users u
+LEFT JOIN channel_read_states rs ON rs.user_id = u.id AND rs.channel_id = ?
+JOIN messages m ON m.channel_id = ?
+  AND m.thread_id IS NULL AND m.deleted_at IS NULL AND m.user_id != u.id
+  AND m.id > COALESCE(rs.last_read_message_id, 0)
+WHERE u.id IN (`+in+`)
+GROUP BY u.id`, append([]any{channelID, channelID}, ids...)...)
+		if err != nil {
+			return nil, fmt.Errorf("count unread messages: %w", err)
+		}
+		err = scanCounts(rows, func(userID, value int64) {
+			state := states[userID]
+			state.UnreadCount = int(value)
+			states[userID] = state
+		})
+		if err != nil {
+			return nil, fmt.Errorf("scan unread counts: %w", err)
+		}
+
+		rows, err = db.QueryContext(ctx, `
+SELECT user_id, COUNT(*)
+FROM mention_notifications
+WHERE channel_id = ? AND read_at IS NULL AND user_id IN (`+in+`)
+GROUP BY user_id`, append([]any{channelID}, ids...)...)
+		if err != nil {
+			return nil, fmt.Errorf("count unread mentions: %w", err)
+		}
+		err = scanCounts(rows, func(userID, value int64) {
+			state := states[userID]
+			state.MentionCount = int(value)
+			states[userID] = state
+		})
+		if err != nil {
+			return nil, fmt.Errorf("scan mention counts: %w", err)
+		}
+	}
+	return states, nil
+}
+
+// scanCounts feeds (ID, value) rows to apply and closes rows.
+func scanCounts(rows *sql.Rows, apply func(id, value int64)) error {
+	defer rows.Close()
+	for rows.Next() {
+		var id, value int64
+		if err := rows.Scan(&id, &value); err != nil {
+			return err
+		}
+		apply(id, value)
+	}
+	return rows.Err()
+}
@@ -0,0 +1,171 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrRecordingNotFound = errors.New("recording not found")
+
+// Recording is one session of recording a voice channel. EndedAt is nil
+// while it runs.
+type Recording struct {
+	ID        int64            `json:"id"`
+	ChannelID int64            `json:"channel_id"`
+	StartedBy int64            `json:"started_by"`
+	Video     bool             `json:"video"`
+	StartedAt time.Time        `json:"started_at"`
+	EndedAt   *time.Time       `json:"ended_at,omitempty"`
+	Tracks    []RecordingTrack `json:"tracks"`
+}
+
+// RecordingTrack is the file holding one participant's audio or video
+// during a recording.
+type RecordingTrack struct {
+	ID        int64     `json:"id"`
+	UserID    int64     `json:"user_id"`
+	Kind      string    `json:"kind"`
+	FileName  string    `json:"file_name"`
+	Size      int64     `json:"size"`
+	StartedAt time.Time `json:"started_at"`
+	EndedAt   time.Time `json:"ended_at"`
+}
+
+const recordingSelect = `SELECT id, channel_id, COALESCE(started_by, 0), video, started_at, ended_at FROM recordings`
+
+// CreateRecording records that userID started recording channelID.
+func CreateRecording(ctx context.Context, db *sql.DB, channelID, userID int64, video bool) (Recording, error) {
+	result, err := db.ExecContext(ctx, `INSERT INTO recordings (channel_id, started_by, video) VALUES (?, ?, ?)`, channelID, userID, video)
+	if err != nil {
+		return Recording{}, fmt.Errorf("create recording: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return Recording{}, fmt.Errorf("create recording: %w", err)
+	}
+	return GetRecording(ctx, db, id)
+}
+
+// FinishRecording marks a recording as ended and stores the files it
+// produced.
+func FinishRecording(ctx context.Context, db *sql.DB, recordingID int64, tracks []RecordingTrack) (Recording, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return Recording{}, fmt.Errorf("begin finish recording: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	result, err := tx.ExecContext(ctx, `UPDATE recordings SET ended_at = CURRENT_TIMESTAMP WHERE id = ? AND ended_at IS NULL`, recordingID)
+	if err != nil {
+		return Recording{}, fmt.Errorf("finish recording: %w", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return Recording{}, fmt.Errorf("finish recording: %w", err)
+	}
+	if affected == 0 {
+		return Recording{}, ErrRecordingNotFound
+	}
+
+	for _, track := range tracks {
+		_, err := tx.ExecContext(ctx, `
+INSERT INTO recording_tracks (recording_id, user_id, kind, file_name, size, started_at, ended_at)
+VALUES (?, ?, ?, ?, ?, ?, ?)`, recordingID, track.UserID, track.Kind, track.FileName, track.Size, track.StartedAt, track.EndedAt)
+		if err != nil {
+			return Recording{}, fmt.Errorf("store recording track: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Recording{}, fmt.Errorf("commit finish recording: %w", err)
+	}
+	return GetRecording(ctx, db, recordingID)
+}
+
+// EndInterruptedRecordings closes recordings that were still running when
+// the server last stopped. Their files were never finalised, so they are
+// left without tracks.
+func EndInterruptedRecordings(ctx context.Context, db *sql.DB) error {
+	if _, err := db.ExecContext(ctx, `UPDATE recordings SET ended_at = CURRENT_TIMESTAMP WHERE ended_at IS NULL`); err != nil {
+		return fmt.Errorf("end interrupted recordings: %w", err)
+	}
+	return nil
+}
+
+func GetRecording(ctx context.Context, db *sql.DB, recordingID int64) (Recording, error) {
+	var recording Recording
+	err := db.QueryRowContext(ctx, recordingSelect+` WHERE id = ?`, recordingID).Scan(
+		&recording.ID, &recording.ChannelID, &recording.StartedBy, &recording.Video, &recording.StartedAt, &recording.EndedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Recording{}, ErrRecordingNotFound
+		}
+		return Recording{}, fmt.Errorf("fetch recording: %w", err)
+	}
+
+	recordings := []Recording{recording}
+	if err := attachRecordingTracks(ctx, db, recordings); err != nil {
+		return Recording{}, err
+	}
+	return recordings[0], nil
+}
+
+// ListRecordings returns the recordings of a channel, newest first.
+func ListRecordings(ctx context.Context, db *sql.DB, channelID int64) ([]Recording, error) {
+	rows, err := db.QueryContext(ctx, recordingSelect+` WHERE channel_id = ? ORDER BY id DESC`, channelID)
+	if err != nil {
+		return nil, fmt.Errorf("query recordings: %w", err)
+	}
+	defer rows.Close()
+
+	recordings := make([]Recording, 0)
+	for rows.Next() {
+		var recording Recording
+		if err := rows.Scan(&recording.ID, &recording.ChannelID, &recording.StartedBy, &recording.Video, &recording.StartedAt, &recording.EndedAt); err != nil {
+			return nil, fmt.Errorf("scan recording: %w", err)
+		}
+		recordings = append(recordings, recording)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate recordings: %w", err)
+	}
+	rows.Close()
+
+	if err := attachRecordingTracks(ctx, db, recordings); err != nil {
+		return nil, err
+	}
+	return recordings, nil
+}
+
+func attachRecordingTracks(ctx context.Context, db *sql.DB, recordings []Recording) error {
+	for i := range recordings {
+		rows, err := db.QueryContext(ctx, `
+SELECT id, user_id, kind, file_name, size, started_at, ended_at
+FROM recording_tracks WHERE recording_id = ? ORDER BY id`, recordings[i].ID)
+		if err != nil {
+			return fmt.Errorf("query recording tracks: %w", err)
+		}
+
+		tracks := make([]RecordingTrack, 0)
+		for rows.Next() {
+			var track RecordingTrack
+			if err := rows.Scan(&track.ID, &track.UserID, &track.Kind, &track.FileName, &track.Size, &track.StartedAt, &track.EndedAt); err != nil {
+				rows.Close()
+				return fmt.Errorf("scan recording track: %w", err)
+			}
+			tracks = append(tracks, track)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return fmt.Errorf("iterate recording tracks: %w", err)
+		}
+		recordings[i].Tracks = tracks
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultSearchLimit = 25
+	MaxSearchLimit     = 100
+
+	// Matched terms in search snippets are wrapped in these control
+	// characters so clients can highlight them without parsing HTML.
+	SnippetHighlightOpen  = "\x02"
+	SnippetHighlightClose = "\x03"
+
+	searchDateLayout = "2006-01-02"
+	sqliteTimeLayout = "2006-01-02 15:04:05"
+)
+
+// SearchQuery is a parsed search string. Terms are free text matched against
+// the full-text index; the remaining fields are filters.
+type SearchQuery struct {
+	Terms         []string
+	From          string
+	In            string
+	Before        time.Time
+	After         time.Time
+	HasAttachment bool
+}
+
+type SearchResult struct {
+	Message Message `json:"message"`
+	Snippet string  `json:"snippet"`
+}
+
+// SearchPage holds results newest first. NextCursor is passed back as the
+// cursor for the following page and is zero when there are no more results.
+type SearchPage struct {
+	Results    []SearchResult `json:"results"`
+	HasMore    bool           `json:"has_more"`
+	NextCursor int64          `json:"next_cursor,omitempty"`
+}
+
+// ParseSearchQuery splits raw into free-text terms and the supported
+// filters: from:<username>, in:<channel>, before:<YYYY-MM-DD>,
+// after:<YYYY-MM-DD> and has:attachment. Values containing spaces may be
+// double-quoted, e.g. in:"team standup".
+func ParseSearchQuery(raw string) (SearchQuery, error) {
+	var query SearchQuery
+	for _, token := range splitSearchTokens(raw) {
+		key, value, ok := strings.Cut(token, ":")
+		if !ok || value == "" {
+			query.Terms = append(query.Terms, token)
+			continue
+		}
+
+		switch strings.ToLower(key) {
+		case "from":
+			query.From = strings.TrimPrefix(value, "@")
+		case "in":
+			query.In = strings.TrimPrefix(value, "#")
+		case "before":
+			day, err := time.Parse(searchDateLayout, value)
+			if err != nil {
+				return SearchQuery{}, fmt.Errorf("before must be a date like 2006-01-02")
+			}
+			query.Before = day
+		case "after":
+			day, err := time.Parse(searchDateLayout, value)
+			if err != nil {
+				return SearchQuery{}, fmt.Errorf("after must be a date like 2006-01-02")
+			}
+			query.After = day
+		case "has":
+			if !strings.EqualFold(value, "attachment") {
+				return SearchQuery{}, fmt.Errorf("unsupported has: filter %q", value)
+			}
+			query.HasAttachment = true
+		default:
+			query.Terms = append(query.Terms, token)
+		}
+	}
+
+	if query.Empty() {
+		return SearchQuery{}, fmt.Errorf("search query is required")
+	}
+	return query, nil
+}
+
+func (q SearchQuery) Empty() bool {
+	return len(q.Terms) == 0 && q.From == "" && q.In == "" && q.Before.IsZero() && q.After.IsZero() && !q.HasAttachment
+}
+
+// SearchMessages runs query over the messages in channels visible admits.
+// cursor is the NextCursor of the previous page, or zero for the first.
+func SearchMessages(ctx context.Context, db *sql.DB, visible Visibility, query SearchQuery, cursor int64, limit int) (SearchPage, error) {
+	if limit <= 0 {
+		limit = DefaultSearchLimit
+	}
+	if limit > MaxSearchLimit {
+		limit = MaxSearchLimit
+	}
+
+	cond, visibleArgs := visible("m.channel_id")
+	conds := []string{"m.deleted_at IS NULL", cond}
+	args := append([]any{}, visibleArgs...)
+
+	snippetExpr := "m.content"
+	from := `
+FROM messages m
+JOIN users u ON u.id = m.user_id`
+	if len(query.Terms) > 0 {
+		snippetExpr = `snippet(messages_fts, 0, ?, ?, '…', 16)`
+		from += `
+JOIN messages_fts ON messages_fts.rowid = m.id`
+		conds = append(conds, "messages_fts MATCH ?")
+		args = append([]any{SnippetHighlightOpen, SnippetHighlightClose}, args...)
+		args = append(args, ftsMatchExpr(query.Terms))
+	}
+	if query.From != "" {
+		conds = append(conds, "u.username = ? COLLATE NOCASE")
+		args = append(args, query.From)
+	}
+	if query.In != "" {
+		conds = append(conds, "m.channel_id IN (SELECT id FROM channels WHERE name = ? COLLATE NOCASE)")
+		args = append(args, query.In)
+	}
+	if !query.Before.IsZero() {
+		conds = append(conds, "m.created_at < ?")
+		args = append(args, query.Before.UTC().Format(sqliteTimeLayout))
+	}
+	if !query.After.IsZero() {
+		conds = append(conds, "m.created_at >= ?")
+		args = append(args, query.After.UTC().AddDate(0, 0, 1).Format(sqliteTimeLayout))
+	}
+	if query.HasAttachment {
+		conds = append(conds, "m.content LIKE '%](/uploads/%'")
+	}
+	if cursor > 0 {
+		conds = append(conds, "m.id < ?")
+		args = append(args, cursor)
+	}
+	args = append(args, limit+1)
+
+	rows, err := db.QueryContext(ctx, `
+SELECT m.id, m.channel_id, m.user_id, u.username, COALESCE(u.avatar_url, ''), m.content, m.created_at, m.edited_at, m.deleted_at, m.thread_id, `+snippetExpr+from+`
+WHERE `+strings.Join(conds, " AND ")+`
+ORDER BY m.id DESC
+LIMIT ?`, args...)
+	if err != nil {
+		return SearchPage{}, fmt.Errorf("search messages: %w", err)
+	}
+	defer rows.Close()
+
+	results := make([]SearchResult, 0, limit+1)
+	for rows.Next() {
+		var (
+			result    SearchResult
+			editedAt  sql.NullTime
+			deletedAt sql.NullTime
+			threadID  sql.NullInt64
+		)
+		msg := &result.Message
+		if err := rows.Scan(&msg.ID, &msg.ChannelID, &msg.UserID, &msg.Username, &msg.AvatarURL, &msg.Content, &msg.CreatedAt, &editedAt, &deletedAt, &threadID, &result.Snippet); err != nil {
+			return SearchPage{}, fmt.Errorf("scan search result: %w", err)
+		}
+		if editedAt.Valid {
+			msg.EditedAt = &editedAt.Time
+		}
+		if threadID.Valid {
+			msg.ThreadID = &threadID.Int64
+		}
+		results = append(results, result)
+	}
+	if err := rows.Err(); err != nil {
+		return SearchPage{}, fmt.Errorf("iterate search results: %w", err)
+	}
+
+	page := SearchPage{Results: results}
+	if len(results) > limit {
+		page.Results = results[:limit]
+		page.HasMore = true
+		page.NextCursor = page.Results[limit-1].Message.ID
+	}
+	return page, nil
+}
+
+// ftsMatchExpr quotes every term so user input is always treated as plain
+// text rather than FTS5 query syntax. Terms are ANDed together.
+func ftsMatchExpr(terms []string) string {
+	quoted := make([]string, 0, len(terms))
+	for _, term := range terms {
+		quoted = append(quoted, `"`+strings.ReplaceAll(term, `"`, `""`)+`"`)
+	}
+	return strings.Join(quoted, " ")
+}
+
+func splitSearchTokens(raw string) []string {
+	var (
+		tokens  []string
+		current strings.Builder
+		quoted  bool
+	)
+	flush := func() {
+		if current.Len() > 0 {
+			tokens = append(tokens, current.String())
+			current.Reset()
+		}
+	}
+	for _, r := range raw {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case !quoted && (r == ' ' || r == '\t' || r == '\n'):
+			flush()
+		default:
+			current.WriteRune(r)
+		}
+	}
+	flush()
+	return tokens
+}
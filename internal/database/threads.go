@@ -0,0 +1,216 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrThreadNotFound     = errors.New("thread not found")
+	ErrThreadExists       = errors.New("a thread already exists for this message")
+	ErrNestedThread       = errors.New("threads cannot be started from a message inside a thread")
+	ErrThreadsUnsupported = errors.New("threads are not available in this channel")
+	ErrThreadParent       = errors.New("threads in forum channels cannot start from a message")
+)
+
+// Thread is a side conversation inside a channel. ParentMessageID is nil for
+// forum posts, which stand on their own.
+type Thread struct {
+	ID              int64      `json:"id"`
+	ChannelID       int64      `json:"channel_id"`
+	ParentMessageID *int64     `json:"parent_message_id"`
+	Name            string     `json:"name"`
+	CreatedBy       int64      `json:"created_by"`
+	MessageCount    int        `json:"message_count"`
+	LastMessageAt   *time.Time `json:"last_message_at,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
+
+// ThreadSummary is attached to a thread's parent message in history.
+type ThreadSummary struct {
+	ID            int64      `json:"id"`
+	Name          string     `json:"name"`
+	MessageCount  int        `json:"message_count"`
+	LastMessageAt *time.Time `json:"last_message_at,omitempty"`
+}
+
+const threadSelect = `SELECT id, channel_id, parent_message_id, name, COALESCE(created_by, 0), message_count, last_message_at, created_at FROM threads`
+
+// SupportsThreads reports whether threads can be opened in a channel of
+// this type. Forum channels hold nothing but threads.
+func SupportsThreads(channelType string) bool {
+	switch channelType {
+	case ChannelTypeText, ChannelTypeAnnouncement, ChannelTypeForum:
+		return true
+	default:
+		return false
+	}
+}
+
+// CreateThread opens a thread in channelID, spawned from parentMessageID
+// when it is non-zero. The creator becomes its first participant.
+func CreateThread(ctx context.Context, db *sql.DB, userID, channelID, parentMessageID int64, name string) (Thread, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return Thread{}, fmt.Errorf("begin create thread: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var channelType string
+	if err := tx.QueryRowContext(ctx, `SELECT type FROM channels WHERE id = ?`, channelID).Scan(&channelType); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Thread{}, ErrChannelNotFound
+		}
+		return Thread{}, fmt.Errorf("fetch channel type: %w", err)
+	}
+	if !SupportsThreads(channelType) {
+		return Thread{}, ErrThreadsUnsupported
+	}
+
+	var parent *int64
+	if parentMessageID > 0 {
+		if channelType == ChannelTypeForum {
+			return Thread{}, ErrThreadParent
+		}
+		var (
+			parentChannel int64
+			parentThread  sql.NullInt64
+		)
+		err := tx.QueryRowContext(ctx, `SELECT channel_id, thread_id FROM messages WHERE id = ? AND deleted_at IS NULL`, parentMessageID).Scan(&parentChannel, &parentThread)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return Thread{}, ErrMessageNotFound
+			}
+			return Thread{}, fmt.Errorf("fetch thread parent: %w", err)
+		}
+		if parentChannel != channelID {
+			return Thread{}, ErrMessageNotFound
+		}
+		if parentThread.Valid {
+			return Thread{}, ErrNestedThread
+		}
+		parent = &parentMessageID
+	}
+
+	result, err := tx.ExecContext(ctx, `INSERT INTO threads (channel_id, parent_message_id, name, created_by) VALUES (?, ?, ?, ?)`, channelID, parent, name, userID)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return Thread{}, ErrThreadExists
+		}
+		return Thread{}, fmt.Errorf("insert thread: %w", err)
+	}
+	threadID, err := result.LastInsertId()
+	if err != nil {
+		return Thread{}, fmt.Errorf("get thread id: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO thread_members (thread_id, user_id) VALUES (?, ?)`, threadID, userID); err != nil {
+		return Thread{}, fmt.Errorf("add thread participant: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Thread{}, fmt.Errorf("commit thread: %w", err)
+	}
+	return GetThread(ctx, db, threadID)
+}
+
+func GetThread(ctx context.Context, db *sql.DB, threadID int64) (Thread, error) {
+	thread, err := scanThread(db.QueryRowContext(ctx, threadSelect+` WHERE id = ?`, threadID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Thread{}, ErrThreadNotFound
+		}
+		return Thread{}, err
+	}
+	return thread, nil
+}
+
+// ListThreads returns the threads of channelID, most recently active first.
+func ListThreads(ctx context.Context, db *sql.DB, channelID int64) ([]Thread, error) {
+	rows, err := db.QueryContext(ctx, threadSelect+`
+WHERE channel_id = ?
+ORDER BY COALESCE(last_message_at, created_at) DESC, id DESC`, channelID)
+	if err != nil {
+		return nil, fmt.Errorf("query threads: %w", err)
+	}
+	defer rows.Close()
+
+	threads := make([]Thread, 0)
+	for rows.Next() {
+		thread, err := scanThread(rows)
+		if err != nil {
+			return nil, err
+		}
+		threads = append(threads, thread)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate threads: %w", err)
+	}
+	return threads, nil
+}
+
+// ThreadParticipants lists everyone who joined or posted in threadID.
+func ThreadParticipants(ctx context.Context, db *sql.DB, threadID int64) ([]ChannelMember, error) {
+	rows, err := db.QueryContext(ctx, `
+SELECT u.id, u.username, COALESCE(u.avatar_url, '')
+FROM thread_members tm
+JOIN users u ON u.id = tm.user_id
+WHERE tm.thread_id = ?
+ORDER BY tm.created_at ASC, u.id ASC`, threadID)
+	if err != nil {
+		return nil, fmt.Errorf("query thread participants: %w", err)
+	}
+	defer rows.Close()
+
+	participants := make([]ChannelMember, 0)
+	for rows.Next() {
+		var member ChannelMember
+		if err := rows.Scan(&member.ID, &member.Username, &member.AvatarURL); err != nil {
+			return nil, fmt.Errorf("scan thread participant: %w", err)
+		}
+		participants = append(participants, member)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate thread participants: %w", err)
+	}
+	return participants, nil
+}
+
+func requireThreadInChannel(ctx context.Context, tx *sql.Tx, threadID, channelID int64) error {
+	var threadChannel int64
+	if err := tx.QueryRowContext(ctx, `SELECT channel_id FROM threads WHERE id = ?`, threadID).Scan(&threadChannel); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrThreadNotFound
+		}
+		return fmt.Errorf("fetch thread: %w", err)
+	}
+	if threadChannel != channelID {
+		return ErrThreadNotFound
+	}
+	return nil
+}
+
+func scanThread(row rowScanner) (Thread, error) {
+	var (
+		thread   Thread
+		parentID sql.NullInt64
+		lastAt   sql.NullTime
+	)
+	if err := row.Scan(&thread.ID, &thread.ChannelID, &parentID, &thread.Name, &thread.CreatedBy, &thread.MessageCount, &lastAt, &thread.CreatedAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Thread{}, err
+		}
+		return Thread{}, fmt.Errorf("scan thread: %w", err)
+	}
+	if parentID.Valid {
+		thread.ParentMessageID = &parentID.Int64
+	}
+	if lastAt.Valid {
+		thread.LastMessageAt = &lastAt.Time
+	}
+	return thread, nil
+}
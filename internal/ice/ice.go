@@ -0,0 +1,196 @@
+// Package ice runs the server's own STUN and TURN listener and issues the
+// short-lived credentials clients use with it, so voice works behind
+// restrictive networks without relying on third-party ICE servers.
+//
+// Credentials follow the TURN REST API scheme: the username is
+// "<expiry>:<user id>:<session tag>" and the password is the base64
+// HMAC-SHA1 of the username under a secret only this process knows. The
+// session tag ties a credential to the login it was issued for, so logging
+// out stops it from opening new relays.
+package ice
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/turn/v4"
+)
+
+// credentialTTL is the longest a credential is valid for. It is cut short
+// when the session ends sooner.
+const credentialTTL = 6 * time.Hour
+
+var ErrPublicIPRequired = errors.New("a public IP is required to relay media")
+
+// Config controls the STUN/TURN listener.
+type Config struct {
+	// Listen is the address served over both UDP and TCP, such as ":3478".
+	Listen string
+	// PublicIP is the address relays are advertised on.
+	PublicIP net.IP
+	// Host is the name clients reach the listener by. It defaults to
+	// PublicIP.
+	Host string
+	// Realm is sent to clients during authentication.
+	Realm string
+	// RelayPortMin and RelayPortMax limit the UDP ports of relays; zero
+	// means any ephemeral port.
+	RelayPortMin, RelayPortMax uint16
+	// SessionActive reports whether the session with the given tag still
+	// belongs to userID. Credentials of ended sessions are refused.
+	SessionActive func(userID int64, tag string) bool
+}
+
+// ICEServer is one entry of an RTCConfiguration's iceServers.
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// Server is a running STUN/TURN listener.
+type Server struct {
+	config Config
+	secret []byte
+	urls   []string
+	turn   *turn.Server
+}
+
+// Start listens on cfg.Listen and serves STUN and TURN until Close.
+func Start(cfg Config) (*Server, error) {
+	if cfg.PublicIP == nil {
+		return nil, ErrPublicIPRequired
+	}
+	_, port, err := net.SplitHostPort(cfg.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("parse listen address: %w", err)
+	}
+	host := cfg.Host
+	if host == "" {
+		host = cfg.PublicIP.String()
+	}
+	if cfg.Realm == "" {
+		cfg.Realm = "openvoice"
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("generate credential secret: %w", err)
+	}
+	s := &Server{config: cfg, secret: secret}
+	address := net.JoinHostPort(host, port)
+	s.urls = []string{
+		"stun:" + address,
+		"turn:" + address + "?transport=udp",
+		"turn:" + address + "?transport=tcp",
+	}
+
+	udp, err := net.ListenPacket("udp", cfg.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("listen udp: %w", err)
+	}
+	tcp, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		_ = udp.Close()
+		return nil, fmt.Errorf("listen tcp: %w", err)
+	}
+
+	s.turn, err = turn.NewServer(turn.ServerConfig{
+		Realm:       cfg.Realm,
+		AuthHandler: s.authenticate,
+		PacketConnConfigs: []turn.PacketConnConfig{{
+			PacketConn:            udp,
+			RelayAddressGenerator: s.relayAddresses(),
+			PermissionHandler:     relayPermitted,
+		}},
+		ListenerConfigs: []turn.ListenerConfig{{
+			Listener:              tcp,
+			RelayAddressGenerator: s.relayAddresses(),
+			PermissionHandler:     relayPermitted,
+		}},
+	})
+	if err != nil {
+		_ = udp.Close()
+		_ = tcp.Close()
+		return nil, fmt.Errorf("start turn server: %w", err)
+	}
+	return s, nil
+}
+
+func (s *Server) Close() error {
+	return s.turn.Close()
+}
+
+func (s *Server) relayAddresses() turn.RelayAddressGenerator {
+	if s.config.RelayPortMin > 0 {
+		return &turn.RelayAddressGeneratorPortRange{
+			RelayAddress: s.config.PublicIP,
+			Address:      "0.0.0.0",
+			MinPort:      s.config.RelayPortMin,
+			MaxPort:      s.config.RelayPortMax,
+		}
+	}
+	return &turn.RelayAddressGeneratorStatic{RelayAddress: s.config.PublicIP, Address: "0.0.0.0"}
+}
+
+// Credentials issues the ICE servers for userID's session, identified by
+// its token. They expire after credentialTTL or with the session,
+// whichever comes first; the expiry is returned alongside.
+func (s *Server) Credentials(userID int64, sessionToken string, sessionExpires time.Time) ([]ICEServer, time.Time) {
+	expires := time.Now().Add(credentialTTL)
+	if sessionExpires.Before(expires) {
+		expires = sessionExpires
+	}
+	username := strconv.FormatInt(expires.Unix(), 10) + ":" + strconv.FormatInt(userID, 10) + ":" + SessionTag(sessionToken)
+	return []ICEServer{{URLs: s.urls, Username: username, Credential: s.password(username)}}, expires
+}
+
+// SessionTag identifies a session inside credentials without revealing its
+// token.
+func SessionTag(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (s *Server) password(username string) string {
+	mac := hmac.New(sha1.New, s.secret)
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Server) authenticate(username, realm string, _ net.Addr) ([]byte, bool) {
+	parts := strings.Split(username, ":")
+	if len(parts) != 3 {
+		return nil, false
+	}
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return nil, false
+	}
+	userID, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	if s.config.SessionActive != nil && !s.config.SessionActive(userID, parts[2]) {
+		return nil, false
+	}
+	return turn.GenerateAuthKey(username, realm, s.password(username)), true
+}
+
+// relayPermitted keeps relays from reaching the server itself or link-local
+// addresses such as cloud metadata services. Private addresses stay
+// allowed, since that is where peers on the same network are.
+func relayPermitted(_ net.Addr, peerIP net.IP) bool {
+	return !peerIP.IsLoopback() && !peerIP.IsUnspecified() && !peerIP.IsMulticast() &&
+		!peerIP.IsLinkLocalUnicast() && !peerIP.IsLinkLocalMulticast()
+}
@@ -0,0 +1,728 @@
+package permissions
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"openvoice/internal/database"
+)
+
+// Permission is a bitset of actions. The bit values are persisted in the
+// roles and channel_permission_overrides tables, so never renumber them.
+type Permission uint64
+
+const (
+	ViewChannel Permission = 1 << iota
+	SendMessages
+	ConnectVoice
+	CreateChannel
+	DeleteChannel
+	ManageChannels
+	ManageMessages
+	KickMembers
+	BanMembers
+	MuteMembers
+	ManageRoles
+	Administrator
+	MentionEveryone
+	RecordVoice
+
+	All = ViewChannel | SendMessages | ConnectVoice | CreateChannel | DeleteChannel | ManageChannels |
+		ManageMessages | KickMembers | BanMembers | MuteMembers | ManageRoles | Administrator | MentionEveryone |
+		RecordVoice
+)
+
+const (
+	RoleOwner     = "owner"
+	RoleAdmin     = "admin"
+	RoleModerator = "moderator"
+	RoleMember    = "member"
+)
+
+var (
+	ErrForbidden     = errors.New("you do not have permission to do that")
+	ErrRoleNotFound  = errors.New("role not found")
+	ErrBuiltinRole   = errors.New("built-in roles cannot be renamed, deleted or assigned this way")
+	ErrRoleHierarchy = errors.New("you can only manage roles below your highest role")
+	ErrInvalidRole   = errors.New("invalid role")
+	ErrLastOwner     = errors.New("the server must keep at least one owner")
+)
+
+var permissionNames = []struct {
+	perm Permission
+	name string
+}{
+	{ViewChannel, "view_channel"},
+	{SendMessages, "send_messages"},
+	{ConnectVoice, "connect_voice"},
+	{CreateChannel, "create_channel"},
+	{DeleteChannel, "delete_channel"},
+	{ManageChannels, "manage_channels"},
+	{ManageMessages, "manage_messages"},
+	{KickMembers, "kick_members"},
+	{BanMembers, "ban_members"},
+	{MuteMembers, "mute_members"},
+	{ManageRoles, "manage_roles"},
+	{Administrator, "administrator"},
+	{MentionEveryone, "mention_everyone"},
+	{RecordVoice, "record_voice"},
+}
+
+type Role struct {
+	ID          int64      `json:"id"`
+	Name        string     `json:"name"`
+	Permissions Permission `json:"permissions"`
+	Position    int        `json:"position"`
+	Builtin     bool       `json:"builtin"`
+}
+
+type Override struct {
+	ChannelID int64      `json:"channel_id"`
+	RoleID    int64      `json:"role_id"`
+	Allow     Permission `json:"allow"`
+	Deny      Permission `json:"deny"`
+}
+
+func (p Permission) Has(perm Permission) bool {
+	return p&perm == perm
+}
+
+// Names lists the permission names set in p, for API responses.
+func (p Permission) Names() []string {
+	names := make([]string, 0)
+	for _, entry := range permissionNames {
+		if p&entry.perm != 0 {
+			names = append(names, entry.name)
+		}
+	}
+	return names
+}
+
+func (p Permission) String() string {
+	return strings.Join(p.Names(), "|")
+}
+
+// Check is the single authorization entry point: it returns nil when userID
+// holds every bit of perm in channelID, or server-wide when channelID is 0.
+// Channel lookups fail with database.ErrChannelNotFound and
+// database.ErrNotChannelMember before any role is consulted.
+func Check(ctx context.Context, db *sql.DB, userID, channelID int64, perm Permission) error {
+	effective, err := Resolve(ctx, db, userID, channelID)
+	if err != nil {
+		return err
+	}
+	if !effective.Has(perm) {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// Resolve computes userID's effective permissions. Role permissions are
+// ORed together (every user implicitly holds the member role), then channel
+// overrides are applied: first the member role's, then the union of the
+// user's other roles', each clearing its deny bits before adding its allow
+// bits. Administrator grants everything and ignores overrides.
+func Resolve(ctx context.Context, db *sql.DB, userID, channelID int64) (Permission, error) {
+	if channelID > 0 {
+		if err := database.CheckChannelAccess(ctx, db, channelID, userID); err != nil {
+			return 0, err
+		}
+	}
+
+	roles, err := userRoles(ctx, db, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	var base Permission
+	for _, role := range roles {
+		base |= role.Permissions
+	}
+	if base.Has(Administrator) {
+		return All, nil
+	}
+	if channelID <= 0 {
+		return base, nil
+	}
+
+	overrides, err := channelOverrides(ctx, db, channelID)
+	if err != nil {
+		return 0, err
+	}
+
+	var allow, deny Permission
+	for _, role := range roles {
+		override, ok := overrides[role.ID]
+		if !ok {
+			continue
+		}
+		if role.Name == RoleMember {
+			base = (base &^ override.Deny) | override.Allow
+			continue
+		}
+		allow |= override.Allow
+		deny |= override.Deny
+	}
+	return (base &^ deny) | allow, nil
+}
+
+// VisibleChannels admits the channels userID holds ViewChannel in, for
+// filtering channel queries in SQL.
+func VisibleChannels(userID int64) database.Visibility {
+	return func(column string) (string, []any) {
+		canView, args := canViewPredicate()
+		return column + ` IN (
+	SELECT vc.id FROM channels vc, users vu
+	WHERE vu.id = ? AND ` + canView + `)`, append([]any{userID}, args...)
+	}
+}
+
+// ChannelViewers admits the users holding ViewChannel in channelID, for
+// filtering user queries in SQL.
+func ChannelViewers(channelID int64) database.Visibility {
+	return func(column string) (string, []any) {
+		canView, args := canViewPredicate()
+		return column + ` IN (
+	SELECT vu.id FROM users vu, channels vc
+	WHERE vc.id = ? AND ` + canView + `)`, append([]any{channelID}, args...)
+	}
+}
+
+// canViewPredicate holds when user vu may read channel vc. It is Resolve
+// for the ViewChannel bit written in SQL, and must change with it.
+func canViewPredicate() (string, []any) {
+	const (
+		held = `EXISTS (SELECT 1 FROM roles r
+		WHERE (r.name = ? OR r.id IN (SELECT role_id FROM user_roles WHERE user_id = vu.id)) AND r.permissions & ? != 0)`
+		memberOverride = `EXISTS (SELECT 1 FROM channel_permission_overrides o JOIN roles r ON r.id = o.role_id
+		WHERE o.channel_id = vc.id AND r.name = ? AND o.%s & ? != 0)`
+		roleOverride = `EXISTS (SELECT 1 FROM channel_permission_overrides o JOIN roles r ON r.id = o.role_id
+		JOIN user_roles ur ON ur.role_id = o.role_id AND ur.user_id = vu.id
+		WHERE o.channel_id = vc.id AND r.name != ? AND o.%s & ? != 0)`
+	)
+
+	predicate := `((vc.type NOT IN (?, ?) AND vc.private = 0)
+		OR EXISTS (SELECT 1 FROM channel_members cm WHERE cm.channel_id = vc.id AND cm.user_id = vu.id))
+	AND (` + held + `
+		OR (((` + held + ` AND NOT ` + fmt.Sprintf(memberOverride, "deny") + `) OR ` + fmt.Sprintf(memberOverride, "allow") + `)
+			AND NOT ` + fmt.Sprintf(roleOverride, "deny") + `)
+		OR ` + fmt.Sprintf(roleOverride, "allow") + `)`
+	args := []any{
+		database.ChannelTypeDM, database.ChannelTypeGroupDM,
+		RoleMember, Administrator,
+		RoleMember, ViewChannel,
+		RoleMember, ViewChannel,
+		RoleMember, ViewChannel,
+		RoleMember, ViewChannel,
+		RoleMember, ViewChannel,
+	}
+	return predicate, args
+}
+
+// HighestPosition returns the position of userID's top role. A user can
+// only manage roles, and members holding roles, strictly below it.
+func HighestPosition(ctx context.Context, db *sql.DB, userID int64) (int, error) {
+	roles, err := userRoles(ctx, db, userID)
+	if err != nil {
+		return 0, err
+	}
+	highest := 0
+	for _, role := range roles {
+		if role.Position > highest {
+			highest = role.Position
+		}
+	}
+	return highest, nil
+}
+
+// CanManageUser reports whether actorID outranks targetID, as required to
+// kick, ban or change the roles of another user.
+func CanManageUser(ctx context.Context, db *sql.DB, actorID, targetID int64) error {
+	if actorID == targetID {
+		return ErrRoleHierarchy
+	}
+	actorTop, err := HighestPosition(ctx, db, actorID)
+	if err != nil {
+		return err
+	}
+	targetTop, err := HighestPosition(ctx, db, targetID)
+	if err != nil {
+		return err
+	}
+	if actorTop <= targetTop {
+		return ErrRoleHierarchy
+	}
+	return nil
+}
+
+// AssignInitialOwner gives userID the owner role when nobody holds it yet,
+// so the first account registered on a fresh server can administer it.
+func AssignInitialOwner(ctx context.Context, db *sql.DB, userID int64) error {
+	_, err := db.ExecContext(ctx, `
+INSERT INTO user_roles (user_id, role_id)
+SELECT ?, r.id FROM roles r
+WHERE r.name = ? AND NOT EXISTS (SELECT 1 FROM user_roles ur WHERE ur.role_id = r.id)`, userID, RoleOwner)
+	if err != nil {
+		return fmt.Errorf("assign initial owner: %w", err)
+	}
+	return nil
+}
+
+// Ban records targetID as banned and ends every session it holds. The
+// caller is expected to drop any live connections.
+func Ban(ctx context.Context, db *sql.DB, actorID, targetID int64, reason string) error {
+	if err := CanManageUser(ctx, db, actorID, targetID); err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin ban: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var exists int
+	if err := tx.QueryRowContext(ctx, `SELECT 1 FROM users WHERE id = ?`, targetID).Scan(&exists); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return database.ErrUserNotFound
+		}
+		return fmt.Errorf("lookup user: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+INSERT INTO bans (user_id, banned_by, reason) VALUES (?, ?, ?)
+ON CONFLICT (user_id) DO UPDATE SET banned_by = excluded.banned_by, reason = excluded.reason`, targetID, actorID, reason); err != nil {
+		return fmt.Errorf("insert ban: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM sessions WHERE user_id = ?`, targetID); err != nil {
+		return fmt.Errorf("delete banned sessions: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit ban: %w", err)
+	}
+	return nil
+}
+
+// Unban lifts the ban on targetID. Like banning, it needs actorID to
+// outrank targetID, and a ban placed by someone ranked above actorID stays.
+func Unban(ctx context.Context, db *sql.DB, actorID, targetID int64) error {
+	if err := CanManageUser(ctx, db, actorID, targetID); err != nil {
+		return err
+	}
+
+	var bannedBy sql.NullInt64
+	err := db.QueryRowContext(ctx, `SELECT banned_by FROM bans WHERE user_id = ?`, targetID).Scan(&bannedBy)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return fmt.Errorf("lookup ban: %w", err)
+	}
+	if bannedBy.Valid && bannedBy.Int64 != actorID {
+		actorTop, err := HighestPosition(ctx, db, actorID)
+		if err != nil {
+			return err
+		}
+		bannerTop, err := HighestPosition(ctx, db, bannedBy.Int64)
+		if err != nil {
+			return err
+		}
+		if actorTop < bannerTop {
+			return ErrRoleHierarchy
+		}
+	}
+
+	if _, err := db.ExecContext(ctx, `DELETE FROM bans WHERE user_id = ?`, targetID); err != nil {
+		return fmt.Errorf("delete ban: %w", err)
+	}
+	return nil
+}
+
+func IsBanned(ctx context.Context, db *sql.DB, userID int64) (bool, error) {
+	var exists int
+	err := db.QueryRowContext(ctx, `SELECT 1 FROM bans WHERE user_id = ?`, userID).Scan(&exists)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, fmt.Errorf("lookup ban: %w", err)
+	}
+	return true, nil
+}
+
+func ListRoles(ctx context.Context, db *sql.DB) ([]Role, error) {
+	rows, err := db.QueryContext(ctx, `SELECT id, name, permissions, position, builtin FROM roles ORDER BY position DESC, id ASC`)
+	if err != nil {
+		return nil, fmt.Errorf("query roles: %w", err)
+	}
+	defer rows.Close()
+
+	return scanRoles(rows)
+}
+
+func GetRole(ctx context.Context, db *sql.DB, roleID int64) (Role, error) {
+	var role Role
+	err := db.QueryRowContext(ctx, `SELECT id, name, permissions, position, builtin FROM roles WHERE id = ?`, roleID).
+		Scan(&role.ID, &role.Name, &role.Permissions, &role.Position, &role.Builtin)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Role{}, ErrRoleNotFound
+		}
+		return Role{}, fmt.Errorf("fetch role: %w", err)
+	}
+	return role, nil
+}
+
+// UserRoles lists the roles explicitly assigned to userID, excluding the
+// implicit member role.
+func UserRoles(ctx context.Context, db *sql.DB, userID int64) ([]Role, error) {
+	roles, err := userRoles(ctx, db, userID)
+	if err != nil {
+		return nil, err
+	}
+	explicit := make([]Role, 0, len(roles))
+	for _, role := range roles {
+		if role.Name != RoleMember {
+			explicit = append(explicit, role)
+		}
+	}
+	return explicit, nil
+}
+
+// CreateRole adds a custom role. actorID may only grant permissions it holds
+// and the role is placed directly below actorID's highest role.
+func CreateRole(ctx context.Context, db *sql.DB, actorID int64, name string, perms Permission) (Role, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > 32 || perms&^All != 0 {
+		return Role{}, ErrInvalidRole
+	}
+	if err := checkGrantable(ctx, db, actorID, perms); err != nil {
+		return Role{}, err
+	}
+
+	top, err := HighestPosition(ctx, db, actorID)
+	if err != nil {
+		return Role{}, err
+	}
+	position := top - 1
+	if position < 1 {
+		return Role{}, ErrRoleHierarchy
+	}
+
+	result, err := db.ExecContext(ctx, `INSERT INTO roles (name, permissions, position) VALUES (?, ?, ?)`, name, perms, position)
+	if err != nil {
+		if strings.Contains(strings.ToLower(err.Error()), "unique") {
+			return Role{}, fmt.Errorf("%w: a role with that name already exists", ErrInvalidRole)
+		}
+		return Role{}, fmt.Errorf("insert role: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return Role{}, fmt.Errorf("get role id: %w", err)
+	}
+	return GetRole(ctx, db, id)
+}
+
+// UpdateRole changes a role's name and permissions. Built-in roles keep
+// their names and the owner role cannot be edited at all.
+func UpdateRole(ctx context.Context, db *sql.DB, actorID, roleID int64, name *string, perms *Permission) (Role, error) {
+	role, err := manageableRole(ctx, db, actorID, roleID)
+	if err != nil {
+		return Role{}, err
+	}
+	if role.Name == RoleOwner {
+		return Role{}, ErrBuiltinRole
+	}
+
+	if name != nil {
+		trimmed := strings.TrimSpace(*name)
+		if role.Builtin && trimmed != role.Name {
+			return Role{}, ErrBuiltinRole
+		}
+		if trimmed == "" || len(trimmed) > 32 {
+			return Role{}, ErrInvalidRole
+		}
+		role.Name = trimmed
+	}
+	if perms != nil {
+		if *perms&^All != 0 {
+			return Role{}, ErrInvalidRole
+		}
+		if err := checkGrantable(ctx, db, actorID, *perms&^role.Permissions); err != nil {
+			return Role{}, err
+		}
+		role.Permissions = *perms
+	}
+
+	if _, err := db.ExecContext(ctx, `UPDATE roles SET name = ?, permissions = ? WHERE id = ?`, role.Name, role.Permissions, role.ID); err != nil {
+		if strings.Contains(strings.ToLower(err.Error()), "unique") {
+			return Role{}, fmt.Errorf("%w: a role with that name already exists", ErrInvalidRole)
+		}
+		return Role{}, fmt.Errorf("update role: %w", err)
+	}
+	return role, nil
+}
+
+func DeleteRole(ctx context.Context, db *sql.DB, actorID, roleID int64) error {
+	role, err := manageableRole(ctx, db, actorID, roleID)
+	if err != nil {
+		return err
+	}
+	if role.Builtin {
+		return ErrBuiltinRole
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin delete role: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	for _, stmt := range []string{
+		`DELETE FROM user_roles WHERE role_id = ?`,
+		`DELETE FROM channel_permission_overrides WHERE role_id = ?`,
+		`DELETE FROM roles WHERE id = ?`,
+	} {
+		if _, err := tx.ExecContext(ctx, stmt, roleID); err != nil {
+			return fmt.Errorf("delete role: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit delete role: %w", err)
+	}
+	return nil
+}
+
+// AssignRole gives targetID the role. The owner role can only be handed on
+// by an owner; the member role is implicit and cannot be assigned.
+func AssignRole(ctx context.Context, db *sql.DB, actorID, targetID, roleID int64) error {
+	role, err := assignableRole(ctx, db, actorID, targetID, roleID)
+	if err != nil {
+		return err
+	}
+	if _, err := db.ExecContext(ctx, `INSERT OR IGNORE INTO user_roles (user_id, role_id) VALUES (?, ?)`, targetID, role.ID); err != nil {
+		return fmt.Errorf("assign role: %w", err)
+	}
+	return nil
+}
+
+// UnassignRole takes roleID away from targetID. The last holder of the owner
+// role keeps it, so the server is never left without one.
+func UnassignRole(ctx context.Context, db *sql.DB, actorID, targetID, roleID int64) error {
+	role, err := assignableRole(ctx, db, actorID, targetID, roleID)
+	if err != nil {
+		return err
+	}
+	if role.Name != RoleOwner {
+		if _, err := db.ExecContext(ctx, `DELETE FROM user_roles WHERE user_id = ? AND role_id = ?`, targetID, role.ID); err != nil {
+			return fmt.Errorf("unassign role: %w", err)
+		}
+		return nil
+	}
+
+	// Counting and deleting in one statement keeps two owners from removing
+	// each other at the same time.
+	result, err := db.ExecContext(ctx, `DELETE FROM user_roles WHERE user_id = ? AND role_id = ?
+	AND (SELECT COUNT(*) FROM user_roles WHERE role_id = ?) > 1`, targetID, role.ID, role.ID)
+	if err != nil {
+		return fmt.Errorf("unassign role: %w", err)
+	}
+	removed, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("unassign role: %w", err)
+	}
+	if removed > 0 {
+		return nil
+	}
+
+	// Nothing was removed: either targetID is the last owner, or was never
+	// one.
+	var held int
+	err = db.QueryRowContext(ctx, `SELECT 1 FROM user_roles WHERE user_id = ? AND role_id = ?`, targetID, role.ID).Scan(&held)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil
+	case err != nil:
+		return fmt.Errorf("lookup owner: %w", err)
+	default:
+		return ErrLastOwner
+	}
+}
+
+// SetChannelOverride stores the allow/deny bits for a role in one channel.
+// A zero override removes the row.
+func SetChannelOverride(ctx context.Context, db *sql.DB, actorID int64, override Override) error {
+	if override.Allow&^All != 0 || override.Deny&^All != 0 || override.Allow&override.Deny != 0 {
+		return ErrInvalidRole
+	}
+	if override.Allow.Has(Administrator) || override.Deny.Has(Administrator) {
+		return fmt.Errorf("%w: administrator cannot be overridden per channel", ErrInvalidRole)
+	}
+
+	role, err := GetRole(ctx, db, override.RoleID)
+	if err != nil {
+		return err
+	}
+	if role.Name != RoleMember {
+		if _, err := manageableRole(ctx, db, actorID, role.ID); err != nil {
+			return err
+		}
+	}
+	if err := checkGrantable(ctx, db, actorID, override.Allow); err != nil {
+		return err
+	}
+
+	if override.Allow == 0 && override.Deny == 0 {
+		if _, err := db.ExecContext(ctx, `DELETE FROM channel_permission_overrides WHERE channel_id = ? AND role_id = ?`, override.ChannelID, override.RoleID); err != nil {
+			return fmt.Errorf("delete channel override: %w", err)
+		}
+		return nil
+	}
+
+	_, err = db.ExecContext(ctx, `
+INSERT INTO channel_permission_overrides (channel_id, role_id, allow, deny) VALUES (?, ?, ?, ?)
+ON CONFLICT (channel_id, role_id) DO UPDATE SET allow = excluded.allow, deny = excluded.deny`,
+		override.ChannelID, override.RoleID, override.Allow, override.Deny)
+	if err != nil {
+		return fmt.Errorf("upsert channel override: %w", err)
+	}
+	return nil
+}
+
+func ListChannelOverrides(ctx context.Context, db *sql.DB, channelID int64) ([]Override, error) {
+	overrides, err := channelOverrides(ctx, db, channelID)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]Override, 0, len(overrides))
+	for _, override := range overrides {
+		list = append(list, override)
+	}
+	return list, nil
+}
+
+func manageableRole(ctx context.Context, db *sql.DB, actorID, roleID int64) (Role, error) {
+	role, err := GetRole(ctx, db, roleID)
+	if err != nil {
+		return Role{}, err
+	}
+	top, err := HighestPosition(ctx, db, actorID)
+	if err != nil {
+		return Role{}, err
+	}
+	if role.Position >= top {
+		return Role{}, ErrRoleHierarchy
+	}
+	return role, nil
+}
+
+func assignableRole(ctx context.Context, db *sql.DB, actorID, targetID, roleID int64) (Role, error) {
+	role, err := GetRole(ctx, db, roleID)
+	if err != nil {
+		return Role{}, err
+	}
+	if role.Name == RoleMember {
+		return Role{}, ErrBuiltinRole
+	}
+
+	var exists int
+	if err := db.QueryRowContext(ctx, `SELECT 1 FROM users WHERE id = ?`, targetID).Scan(&exists); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Role{}, database.ErrUserNotFound
+		}
+		return Role{}, fmt.Errorf("lookup user: %w", err)
+	}
+
+	if role.Name == RoleOwner {
+		top, err := HighestPosition(ctx, db, actorID)
+		if err != nil {
+			return Role{}, err
+		}
+		if top < role.Position {
+			return Role{}, ErrRoleHierarchy
+		}
+		return role, nil
+	}
+
+	if _, err := manageableRole(ctx, db, actorID, roleID); err != nil {
+		return Role{}, err
+	}
+	if actorID != targetID {
+		if err := CanManageUser(ctx, db, actorID, targetID); err != nil {
+			return Role{}, err
+		}
+	}
+	return role, nil
+}
+
+// checkGrantable stops actors from handing out permissions they do not hold
+// themselves.
+func checkGrantable(ctx context.Context, db *sql.DB, actorID int64, perms Permission) error {
+	held, err := Resolve(ctx, db, actorID, 0)
+	if err != nil {
+		return err
+	}
+	if !held.Has(perms) {
+		return ErrForbidden
+	}
+	return nil
+}
+
+func userRoles(ctx context.Context, db *sql.DB, userID int64) ([]Role, error) {
+	rows, err := db.QueryContext(ctx, `
+SELECT r.id, r.name, r.permissions, r.position, r.builtin
+FROM roles r
+WHERE r.name = ? OR r.id IN (SELECT role_id FROM user_roles WHERE user_id = ?)
+ORDER BY r.position DESC`, RoleMember, userID)
+	if err != nil {
+		return nil, fmt.Errorf("query user roles: %w", err)
+	}
+	defer rows.Close()
+
+	return scanRoles(rows)
+}
+
+func channelOverrides(ctx context.Context, db *sql.DB, channelID int64) (map[int64]Override, error) {
+	rows, err := db.QueryContext(ctx, `SELECT channel_id, role_id, allow, deny FROM channel_permission_overrides WHERE channel_id = ?`, channelID)
+	if err != nil {
+		return nil, fmt.Errorf("query channel overrides: %w", err)
+	}
+	defer rows.Close()
+
+	overrides := make(map[int64]Override)
+	for rows.Next() {
+		var override Override
+		if err := rows.Scan(&override.ChannelID, &override.RoleID, &override.Allow, &override.Deny); err != nil {
+			return nil, fmt.Errorf("scan channel override: %w", err)
+		}
+		overrides[override.RoleID] = override
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate channel overrides: %w", err)
+	}
+	return overrides, nil
+}
+
+func scanRoles(rows *sql.Rows) ([]Role, error) {
+	roles := make([]Role, 0)
+	for rows.Next() {
+		var role Role
+		if err := rows.Scan(&role.ID, &role.Name, &role.Permissions, &role.Position, &role.Builtin); err != nil {
+			return nil, fmt.Errorf("scan role: %w", err)
+		}
+		roles = append(roles, role)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate roles: %w", err)
+	}
+	return roles, nil
+}
@@ -0,0 +1,51 @@
+package permissions
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"openvoice/internal/database"
+)
+
+func TestUnassignRoleKeepsLastOwner(t *testing.T) {
+	ctx := context.Background()
+	db, err := database.InitDB(filepath.Join(t.TempDir(), "openvoice.db"))
+	if err != nil {
+		t.Fatalf("init db: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	if _, err := db.ExecContext(ctx, `INSERT INTO users (id, username, password_hash) VALUES (1, 'alice', ''), (2, 'bob', '')`); err != nil {
+		t.Fatalf("insert users: %v", err)
+	}
+	if err := AssignInitialOwner(ctx, db, 1); err != nil {
+		t.Fatalf("assign initial owner: %v", err)
+	}
+	var owner int64
+	if err := db.QueryRowContext(ctx, `SELECT id FROM roles WHERE name = ?`, RoleOwner).Scan(&owner); err != nil {
+		t.Fatalf("lookup owner role: %v", err)
+	}
+
+	if err := UnassignRole(ctx, db, 1, 1, owner); !errors.Is(err, ErrLastOwner) {
+		t.Fatalf("sole owner stepping down: got %v, want %v", err, ErrLastOwner)
+	}
+
+	// With a second owner either one may go, but not both.
+	if err := AssignRole(ctx, db, 1, 2, owner); err != nil {
+		t.Fatalf("assign second owner: %v", err)
+	}
+	if err := UnassignRole(ctx, db, 2, 1, owner); err != nil {
+		t.Fatalf("remove first owner: %v", err)
+	}
+	if err := UnassignRole(ctx, db, 2, 2, owner); !errors.Is(err, ErrLastOwner) {
+		t.Fatalf("remaining owner stepping down: got %v, want %v", err, ErrLastOwner)
+	}
+	roles, err := UserRoles(ctx, db, 2)
+	if err != nil {
+		t.Fatalf("list roles: %v", err)
+	}
+	if len(roles) != 1 || roles[0].Name != RoleOwner {
+		t.Errorf("bob's roles are %v, want only %s", roles, RoleOwner)
+	}
+}
@@ -2,8 +2,11 @@ package realtime
 
 import (
 	"encoding/json"
+	"sync"
 	"time"
 
+	"openvoice/internal/database"
+
 	"github.com/gorilla/websocket"
 )
 
@@ -14,123 +17,261 @@ const (
 	maxPayloadSize = 8 * 1024
 )
 
+// Client is one session: a socket plus the subscriptions and sequence
+// numbers that outlive it for a while so the session can be resumed.
 type Client struct {
-	hub            *Hub
-	conn           *websocket.Conn
-	send           chan []byte
-	user           User
-	channelID      int64
+	hub  *Hub
+	user User
+	// mu guards the socket and the replay state below. It is never held
+	// while taking hub.mu.
+	mu        sync.Mutex
+	conn      *websocket.Conn
+	send      chan []byte
+	sessionID string
+	seq       uint64
+	replay    []replayEntry
+	detached  bool
+	expiry    *time.Timer
+	// channelID is the channel being viewed; subscriptions holds channels
+	// added with subscribe. Both are guarded by hub.mu.
+	channelID     int64
+	subscriptions map[int64]struct{}
+	// voiceChannelID and voiceState are guarded by hub.mu.
 	voiceChannelID int64
+	voiceState     VoiceState
+	// lastActive and idle drive auto-idle; both are guarded by hub.mu.
+	lastActive time.Time
+	idle       bool
 }
 
-func newClient(hub *Hub, conn *websocket.Conn, user User) *Client {
+func newClient(hub *Hub, conn *websocket.Conn, user User, sessionID string) *Client {
 	return &Client{
-		hub:  hub,
-		conn: conn,
-		send: make(chan []byte, 256),
-		user: user,
+		hub:           hub,
+		conn:          conn,
+		send:          make(chan []byte, 256),
+		sessionID:     sessionID,
+		user:          user,
+		subscriptions: make(map[int64]struct{}),
+		lastActive:    time.Now(),
 	}
 }
 
+// readPump reads events off one socket. A resume hands the socket to
+// another session, so c can change while it runs.
 func (c *Client) readPump() {
+	conn := c.conn
+	var readErr error
 	defer func() {
-		if err := c.hub.markVoiceLeave(c, c.voiceChannelID); err != nil {
-			c.hub.sendError(c, "failed to leave voice")
+		// A socket that was closed cleanly ends its session; anything else
+		// leaves the session open for a resume.
+		if c.owns(conn) {
+			if err := c.hub.markVoiceLeave(c, 0); err != nil {
+				c.hub.sendErrorCode(c, CodeInternal, "failed to leave voice")
+			}
+			if websocket.IsCloseError(readErr, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				c.hub.removeClient(c)
+			} else {
+				c.hub.detachClient(c, conn)
+			}
 		}
-		c.hub.removeClient(c)
-		_ = c.conn.Close()
+		_ = conn.Close()
 	}()
 
-	c.conn.SetReadLimit(maxPayloadSize)
-	_ = c.conn.SetReadDeadline(time.Now().Add(pongWait))
-	c.conn.SetPongHandler(func(string) error {
-		_ = c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetReadLimit(maxPayloadSize)
+	_ = conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		_ = conn.SetReadDeadline(time.Now().Add(pongWait))
 		return nil
 	})
 
 	for {
-		_, message, err := c.conn.ReadMessage()
+		_, message, err := conn.ReadMessage()
 		if err != nil {
+			readErr = err
 			break
 		}
 
 		var evt inboundEvent
 		if err := json.Unmarshal(message, &evt); err != nil {
-			c.hub.sendError(c, "invalid event payload")
+			c.hub.sendErrorCode(c, CodeBadRequest, "invalid event payload")
 			continue
 		}
+		c.hub.markActive(c)
 
 		switch evt.Type {
+		case "resume":
+			c = c.hub.resume(c, evt)
 		case "join_channel":
 			if err := c.hub.joinChannel(c, evt.ChannelID); err != nil {
-				c.hub.sendError(c, err.Error())
+				c.hub.sendError(c, err)
 				continue
 			}
 
-			history, err := c.hub.loadHistory(evt.ChannelID)
+			history, err := c.hub.loadHistory(c.user.ID, evt.ChannelID, database.HistoryQuery{})
 			if err != nil {
-				c.hub.sendError(c, "failed to load channel history")
+				c.hub.sendErrorCode(c, CodeInternal, "failed to load channel history")
 				continue
 			}
 
-			payload, err := json.Marshal(outboundEvent{Type: "channel_history", Data: channelHistoryData{ChannelID: evt.ChannelID, Messages: history}})
+			payload, err := json.Marshal(outboundEvent{Type: "channel_history", Data: channelHistoryData{ChannelID: evt.ChannelID, Messages: history.Messages, HasMore: history.HasMore}})
 			if err != nil {
-				c.hub.sendError(c, "failed to encode history")
+				c.hub.sendErrorCode(c, CodeInternal, "failed to encode history")
 				continue
 			}
-			c.send <- payload
+			c.enqueue(payload)
+		case "subscribe":
+			if err := c.hub.subscribe(c, evt); err != nil {
+				c.hub.sendError(c, err)
+			}
+		case "unsubscribe":
+			if err := c.hub.unsubscribe(c, evt); err != nil {
+				c.hub.sendError(c, err)
+			}
+		case "load_history":
+			if err := c.hub.sendHistoryPage(c, evt); err != nil {
+				c.hub.sendError(c, err)
+			}
 		case "send_message":
+			// Thread messages take their channel from the thread.
 			channelID := evt.ChannelID
-			if channelID == 0 {
+			if channelID == 0 && evt.ThreadID == 0 {
 				channelID = c.channelID
 			}
 
-			if err := c.hub.createAndBroadcastMessage(c, channelID, evt.Content); err != nil {
-				c.hub.sendError(c, err.Error())
+			opts := database.MessageOptions{ThreadID: evt.ThreadID, ReplyToID: evt.ReplyToID}
+			if err := c.hub.createAndBroadcastMessage(c, channelID, evt.Content, opts); err != nil {
+				c.hub.sendError(c, err)
 				continue
 			}
+		case "edit_message":
+			if _, err := c.hub.EditMessage(c.user.ID, evt.MessageID, evt.Content); err != nil {
+				c.hub.sendError(c, err)
+			}
+		case "delete_message":
+			if _, err := c.hub.DeleteMessage(c.user.ID, evt.MessageID); err != nil {
+				c.hub.sendError(c, err)
+			}
+		case "ack":
+			if err := c.hub.ackChannel(c, evt); err != nil {
+				c.hub.sendError(c, err)
+			}
+		case "set_presence":
+			if err := c.hub.setPresence(c, evt); err != nil {
+				c.hub.sendError(c, err)
+			}
+		case "typing_start":
+			if err := c.hub.startTyping(c, evt); err != nil {
+				c.hub.sendError(c, err)
+			}
+		case "create_thread":
+			if err := c.hub.createThread(c, evt); err != nil {
+				c.hub.sendError(c, err)
+			}
+		case "join_thread":
+			if err := c.hub.joinThread(c, evt.ThreadID); err != nil {
+				c.hub.sendError(c, err)
+			}
+		case "leave_thread":
+			c.hub.leaveThread(c, evt.ThreadID)
+		case "add_reaction":
+			if err := c.hub.addReaction(c, evt); err != nil {
+				c.hub.sendError(c, err)
+			}
+		case "remove_reaction":
+			if err := c.hub.removeReaction(c, evt); err != nil {
+				c.hub.sendError(c, err)
+			}
+		case "pin_message", "unpin_message":
+			if _, err := c.hub.SetPinned(c.user.ID, evt.MessageID, evt.Type == "pin_message"); err != nil {
+				c.hub.sendError(c, err)
+			}
 		case "join_voice":
-			if err := c.hub.markVoiceJoin(c, evt.ChannelID); err != nil {
-				c.hub.sendError(c, err.Error())
+			if err := c.hub.markVoiceJoin(c, evt); err != nil {
+				c.hub.sendError(c, err)
 			}
 		case "leave_voice":
 			if err := c.hub.markVoiceLeave(c, evt.ChannelID); err != nil {
-				c.hub.sendError(c, err.Error())
+				c.hub.sendError(c, err)
+			}
+		case "voice_state_update":
+			if err := c.hub.updateVoiceState(c, evt); err != nil {
+				c.hub.sendError(c, err)
+			}
+		case "server_mute":
+			if err := c.hub.setServerMute(c, evt); err != nil {
+				c.hub.sendError(c, err)
 			}
 		case "signal":
 			if err := c.hub.relaySignal(c, evt); err != nil {
-				c.hub.sendError(c, err.Error())
+				c.hub.sendError(c, err)
+			}
+		case "set_video_quality":
+			if err := c.hub.setVideoQuality(c, evt); err != nil {
+				c.hub.sendError(c, err)
+			}
+		case "start_screen_share":
+			if err := c.hub.startScreenShare(c, evt); err != nil {
+				c.hub.sendError(c, err)
+			}
+		case "stop_screen_share":
+			if err := c.hub.stopScreenShare(c); err != nil {
+				c.hub.sendError(c, err)
+			}
+		case "watch_screen_share", "unwatch_screen_share":
+			if err := c.hub.watchScreenShare(c, evt, evt.Type == "watch_screen_share"); err != nil {
+				c.hub.sendError(c, err)
+			}
+		case "start_recording":
+			if err := c.hub.startRecording(c, evt); err != nil {
+				c.hub.sendError(c, err)
+			}
+		case "stop_recording":
+			if err := c.hub.stopRecording(c, evt); err != nil {
+				c.hub.sendError(c, err)
 			}
 		default:
-			c.hub.sendError(c, "unsupported event type")
+			c.hub.sendErrorCode(c, CodeUnsupportedEvent, "unsupported event type")
 		}
 	}
 }
 
+// writePump writes to one socket. Its queue moves along with the socket
+// when a session is resumed, so both are captured up front.
 func (c *Client) writePump() {
+	c.mu.Lock()
+	conn, send := c.conn, c.send
+	c.mu.Unlock()
+
 	ticker := time.NewTicker(pingPeriod)
 	defer func() {
 		ticker.Stop()
-		_ = c.conn.Close()
+		_ = conn.Close()
 	}()
 
 	for {
 		select {
-		case message, ok := <-c.send:
-			_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+		case message, ok := <-send:
+			_ = conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
-				_ = c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				_ = conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
 
-			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+			if err := conn.WriteMessage(websocket.TextMessage, message); err != nil {
 				return
 			}
 		case <-ticker.C:
-			_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+			_ = conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
 		}
 	}
 }
+
+// owns reports whether conn is still the live socket of this session.
+func (c *Client) owns(conn *websocket.Conn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn == conn && !c.detached
+}
@@ -4,28 +4,54 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"openvoice/internal/database"
+	"openvoice/internal/permissions"
+	"openvoice/internal/sfu"
 
 	"github.com/gorilla/websocket"
 )
 
 const (
-	maxMessageSize   = 16 * 1024
-	messageHistLimit = 50
+	maxMessageSize = 16 * 1024
 )
 
 type Hub struct {
-	db       *sql.DB
-	mu       sync.Mutex
-	clients  map[*Client]struct{}
+	db      *sql.DB
+	mu      sync.Mutex
+	clients map[*Client]struct{}
+	// sessions indexes clients by session ID for resume, and userClients
+	// by the user they belong to.
+	sessions    map[string]*Client
+	userClients map[int64]map[*Client]struct{}
+	// channels holds the connections subscribed to each channel: the one
+	// they are viewing plus any added with subscribe.
 	channels map[int64]map[*Client]struct{}
+	// voice holds the connections in each voice channel, independent of
+	// what they are viewing. voiceModes holds the mode each occupied voice
+	// channel runs in; media carries the ones in sfu mode.
+	voice      map[int64]map[*Client]struct{}
+	voiceModes map[int64]string
+	media      *sfu.SFU
+	// recordings holds the recording running in each voice channel. A nil
+	// entry reserves the channel while its recording is being created.
+	recordings map[int64]*database.Recording
+	// threads holds thread subscriptions, which are independent of the
+	// channel a client is viewing; threadChannels maps each to its channel.
+	threads        map[int64]map[*Client]struct{}
+	threadChannels map[int64]int64
+	// typing holds live typing indicators; it is never persisted.
+	typing map[typingKey]*typingState
+	// presence holds the status of each connected user.
+	presence map[int64]*userPresence
 	upgrader websocket.Upgrader
 }
 
@@ -35,29 +61,124 @@ type User struct {
 }
 
 type inboundEvent struct {
-	Type      string          `json:"type"`
-	ChannelID int64           `json:"channel_id"`
-	Content   string          `json:"content"`
-	TargetID  string          `json:"target_id"`
-	Payload   json.RawMessage `json:"payload"`
+	Type      string `json:"type"`
+	ChannelID int64  `json:"channel_id"`
+	// ChannelIDs is used by subscribe and unsubscribe.
+	ChannelIDs []int64         `json:"channel_ids"`
+	Content    string          `json:"content"`
+	TargetID   string          `json:"target_id"`
+	MessageID  int64           `json:"message_id"`
+	ThreadID   int64           `json:"thread_id"`
+	ReplyToID  int64           `json:"reply_to_id"`
+	Name       string          `json:"name"`
+	Emoji      string          `json:"emoji"`
+	UserID     int64           `json:"user_id"`
+	Muted      bool            `json:"muted"`
+	Before     int64           `json:"before"`
+	After      int64           `json:"after"`
+	Around     int64           `json:"around"`
+	Limit      int             `json:"limit"`
+	Payload    json.RawMessage `json:"payload"`
+	// SessionID and Seq are only used by resume.
+	SessionID string `json:"session_id"`
+	Seq       uint64 `json:"seq"`
+	// SelfMute, SelfDeaf and Video are only used by join_voice and
+	// voice_state_update; nil leaves a flag unchanged. Video also chooses
+	// whether start_recording records video. ScreenShare is only read to
+	// point clients at start_screen_share.
+	SelfMute    *bool `json:"self_mute"`
+	SelfDeaf    *bool `json:"self_deaf"`
+	Video       *bool `json:"video"`
+	ScreenShare *bool `json:"screen_share"`
+	// StreamID is only used by start_screen_share.
+	StreamID string `json:"stream_id"`
+	// Status and CustomStatus are only used by set_presence.
+	Status       string             `json:"status"`
+	CustomStatus *customStatusInput `json:"custom_status"`
+	// Quality, Height and BandwidthKbps are only used by set_video_quality.
+	Quality       string `json:"quality"`
+	Height        int    `json:"height"`
+	BandwidthKbps int    `json:"bandwidth_kbps"`
+}
+
+// ErrorCode classifies an error event so clients can react to a failure
+// without matching on its message text.
+type ErrorCode string
+
+const (
+	CodeBadRequest        ErrorCode = "bad_request"
+	CodeInternal          ErrorCode = "internal_error"
+	CodeUnsupportedEvent  ErrorCode = "unsupported_event"
+	CodeChannelNotFound   ErrorCode = "channel_not_found"
+	CodeNotChannelMember  ErrorCode = "not_channel_member"
+	CodeForbidden         ErrorCode = "forbidden"
+	CodeNotVoiceChannel   ErrorCode = "not_voice_channel"
+	CodeNotTextChannel    ErrorCode = "not_text_channel"
+	CodePostingRestricted ErrorCode = "posting_restricted"
+	CodeMessageNotFound   ErrorCode = "message_not_found"
+	CodeNotMessageAuthor  ErrorCode = "not_message_author"
+	CodeThreadNotFound    ErrorCode = "thread_not_found"
+	CodeInvalidThread     ErrorCode = "invalid_thread"
+	CodeInvalidReply      ErrorCode = "invalid_reply"
+	CodeInvalidReaction   ErrorCode = "invalid_reaction"
+	CodePinLimitReached   ErrorCode = "pin_limit_reached"
+	CodeInvalidPresence   ErrorCode = "invalid_presence"
+	CodeTargetNotFound    ErrorCode = "target_not_found"
+	CodeVoiceModeMismatch ErrorCode = "voice_mode_mismatch"
+	CodeScreenShareLimit  ErrorCode = "screen_share_limit"
+)
+
+type errorData struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
 }
 
 type outboundEvent struct {
+	// Seq numbers the events of a session from 1. It is stamped per
+	// connection as events are queued; see sequenced.
+	Seq  uint64 `json:"seq,omitempty"`
 	Type string `json:"type"`
 	Data any    `json:"data"`
 }
 
 type channelHistoryData struct {
 	ChannelID int64              `json:"channel_id"`
+	ThreadID  int64              `json:"thread_id,omitempty"`
+	Before    int64              `json:"before,omitempty"`
+	After     int64              `json:"after,omitempty"`
+	Around    int64              `json:"around,omitempty"`
 	Messages  []database.Message `json:"messages"`
+	HasMore   bool               `json:"has_more"`
+	// HasMoreBefore and HasMoreAfter are only set for around queries.
+	HasMoreBefore *bool `json:"has_more_before,omitempty"`
+	HasMoreAfter  *bool `json:"has_more_after,omitempty"`
 }
 
+type messageDeletedData struct {
+	ID        int64  `json:"id"`
+	ChannelID int64  `json:"channel_id"`
+	ThreadID  *int64 `json:"thread_id,omitempty"`
+}
+
+var errSignalTarget = errors.New("signal target is not in this voice channel")
+
+// signalData is a relayed WebRTC signal. Signals from the SFU have a
+// FromUserID of 0 and a FromName of "sfu". ScreenShareStreamID is set while
+// the sender shares their screen, naming the stream that carries it.
 type signalData struct {
-	FromUserID int64           `json:"from_user_id"`
-	FromName   string          `json:"from_name"`
-	TargetID   string          `json:"target_id"`
-	ChannelID  int64           `json:"channel_id"`
-	Payload    json.RawMessage `json:"payload"`
+	FromUserID          int64           `json:"from_user_id"`
+	FromName            string          `json:"from_name"`
+	TargetID            string          `json:"target_id"`
+	ChannelID           int64           `json:"channel_id"`
+	ScreenShareStreamID string          `json:"screen_share_stream_id,omitempty"`
+	Payload             json.RawMessage `json:"payload"`
+}
+
+type serverMuteData struct {
+	UserID    int64 `json:"user_id"`
+	ChannelID int64 `json:"channel_id"`
+	Muted     bool  `json:"muted"`
+	ByUserID  int64 `json:"by_user_id"`
 }
 
 type voicePresenceData struct {
@@ -66,11 +187,21 @@ type voicePresenceData struct {
 	ChannelID int64  `json:"channel_id"`
 }
 
-func NewHub(db *sql.DB) *Hub {
-	return &Hub{
-		db:       db,
-		clients:  make(map[*Client]struct{}),
-		channels: make(map[int64]map[*Client]struct{}),
+func NewHub(db *sql.DB, media *sfu.SFU) *Hub {
+	h := &Hub{
+		db:             db,
+		media:          media,
+		clients:        make(map[*Client]struct{}),
+		sessions:       make(map[string]*Client),
+		userClients:    make(map[int64]map[*Client]struct{}),
+		channels:       make(map[int64]map[*Client]struct{}),
+		voice:          make(map[int64]map[*Client]struct{}),
+		voiceModes:     make(map[int64]string),
+		recordings:     make(map[int64]*database.Recording),
+		threads:        make(map[int64]map[*Client]struct{}),
+		threadChannels: make(map[int64]int64),
+		typing:         make(map[typingKey]*typingState),
+		presence:       make(map[int64]*userPresence),
 		upgrader: websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool {
 				origin := r.Header.Get("Origin")
@@ -82,6 +213,8 @@ func NewHub(db *sql.DB) *Hub {
 			},
 		},
 	}
+	go h.sweepPresence()
+	return h
 }
 
 func (h *Hub) ServeWS(w http.ResponseWriter, r *http.Request, user User) error {
@@ -90,8 +223,16 @@ func (h *Hub) ServeWS(w http.ResponseWriter, r *http.Request, user User) error {
 		return fmt.Errorf("upgrade websocket: %w", err)
 	}
 
-	client := newClient(h, conn, user)
-	h.addClient(client)
+	sessionID, err := newSessionID()
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+
+	client := newClient(h, conn, user, sessionID)
+	h.addClient(client, h.presenceSettings(user.ID))
+	client.sendDirect("hello", helloData{SessionID: sessionID})
+	h.refreshPresence(user.ID)
 
 	go client.writePump()
 	go client.readPump()
@@ -99,23 +240,49 @@ func (h *Hub) ServeWS(w http.ResponseWriter, r *http.Request, user User) error {
 	return nil
 }
 
-func (h *Hub) addClient(client *Client) {
+func (h *Hub) addClient(client *Client, settings database.PresenceSettings) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 	h.clients[client] = struct{}{}
+	h.sessions[client.sessionID] = client
+	if _, ok := h.userClients[client.user.ID]; !ok {
+		h.userClients[client.user.ID] = make(map[*Client]struct{})
+	}
+	h.userClients[client.user.ID][client] = struct{}{}
+	h.trackPresenceLocked(client.user.ID, settings)
 }
 
 func (h *Hub) removeClient(client *Client) {
+	defer h.refreshPresence(client.user.ID)
+
 	h.mu.Lock()
-	defer h.mu.Unlock()
+	voiceChannelID := client.voiceChannelID
+	viaMedia := h.voiceModes[voiceChannelID] == database.VoiceModeSFU
+	defer func() {
+		h.mu.Unlock()
+		if viaMedia {
+			h.media.Leave(voiceChannelID, client.user.ID)
+		}
+	}()
 
 	delete(h.clients, client)
+	delete(h.sessions, client.sessionID)
+	if clients, ok := h.userClients[client.user.ID]; ok {
+		delete(clients, client)
+		if len(clients) == 0 {
+			delete(h.userClients, client.user.ID)
+		}
+	}
 	for channelID, members := range h.channels {
 		delete(members, client)
 		if len(members) == 0 {
 			delete(h.channels, channelID)
 		}
 	}
+	h.removeFromVoiceLocked(client)
+	for threadID := range h.threads {
+		h.unsubscribeThreadLocked(client, threadID)
+	}
 }
 
 func (h *Hub) joinChannel(client *Client, channelID int64) error {
@@ -123,78 +290,178 @@ func (h *Hub) joinChannel(client *Client, channelID int64) error {
 		return fmt.Errorf("invalid channel id")
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	var exists int
-	if err := h.db.QueryRowContext(ctx, `SELECT 1 FROM channels WHERE id = ?`, channelID).Scan(&exists); err != nil {
-		return fmt.Errorf("channel not found")
+	if err := h.authorize(client.user.ID, channelID, permissions.ViewChannel); err != nil {
+		return err
 	}
 
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	for cid, members := range h.channels {
-		if _, ok := members[client]; ok {
-			delete(members, client)
-			if len(members) == 0 {
-				delete(h.channels, cid)
-			}
+	// Switching away from a channel only drops it if the connection did not
+	// also subscribe to it explicitly.
+	previous := client.channelID
+	_, kept := client.subscriptions[previous]
+	drop := previous != channelID && !kept
+	if _, ok := h.channels[channelID][client]; !ok {
+		count := len(h.subscriptionsLocked(client)) + 1
+		if _, ok := h.channels[previous][client]; ok && drop {
+			count--
+		}
+		if count > maxSubscriptions {
+			return errTooManySubscriptions
 		}
 	}
-
-	if _, ok := h.channels[channelID]; !ok {
-		h.channels[channelID] = make(map[*Client]struct{})
+	if drop {
+		h.removeFromChannelLocked(client, previous)
 	}
-	h.channels[channelID][client] = struct{}{}
+	h.addToChannelLocked(client, channelID)
 	client.channelID = channelID
 
 	return nil
 }
 
-func (h *Hub) markVoiceJoin(client *Client, channelID int64) error {
-	if err := h.joinChannel(client, channelID); err != nil {
+func (h *Hub) markVoiceJoin(client *Client, evt inboundEvent) error {
+	channelID := evt.ChannelID
+	if evt.ScreenShare != nil {
+		return errScreenShareFlag
+	}
+	if err := h.authorize(client.user.ID, channelID, permissions.ViewChannel|permissions.ConnectVoice); err != nil {
+		return err
+	}
+	if err := h.requireVoiceChannel(channelID); err != nil {
+		return err
+	}
+	mode, err := h.voiceMode(channelID)
+	if err != nil {
 		return err
 	}
 
+	// A user is in at most one voice channel, from one connection; joining
+	// leaves wherever they were before. The channel being viewed is
+	// unaffected.
+	h.mu.Lock()
+	if client.voiceChannelID == channelID {
+		h.mu.Unlock()
+		return nil
+	}
+	previous := make([]*Client, 0, 1)
+	for other := range h.userClients[client.user.ID] {
+		if other.voiceChannelID > 0 {
+			previous = append(previous, other)
+		}
+	}
+	h.mu.Unlock()
+	for _, other := range previous {
+		if err := h.markVoiceLeave(other, 0); err != nil {
+			return err
+		}
+	}
+
+	// A room keeps the mode it started with until ChangeVoiceMode moves it.
+	h.mu.Lock()
+	if _, ok := h.voice[channelID]; !ok {
+		h.voice[channelID] = make(map[*Client]struct{})
+		h.voiceModes[channelID] = mode
+	}
+	mode = h.voiceModes[channelID]
+	h.voice[channelID][client] = struct{}{}
 	client.voiceChannelID = channelID
+	joinedAt := time.Now().UTC()
+	client.voiceState = VoiceState{
+		UserID:    client.user.ID,
+		Username:  client.user.Username,
+		ChannelID: channelID,
+		JoinedAt:  &joinedAt,
+	}
+	applyVoiceFlags(&client.voiceState, evt)
+	state := client.voiceState
+	snapshot := h.voiceStatesLocked(channelID)
+	recording := h.activeRecordingLocked(channelID)
+	h.mu.Unlock()
+
+	encoded, err := json.Marshal(outboundEvent{Type: "voice_states", Data: voiceStatesData{ChannelID: channelID, VoiceMode: mode, Participants: snapshot, Recording: recording}})
+	if err != nil {
+		return fmt.Errorf("marshal voice_states: %w", err)
+	}
+	client.enqueue(encoded)
+	if mode == database.VoiceModeSFU {
+		if err := h.joinMedia(client, channelID); err != nil {
+			if leaveErr := h.markVoiceLeave(client, channelID); leaveErr != nil {
+				log.Printf("undo voice join of user %d: %v", client.user.ID, leaveErr)
+			}
+			return err
+		}
+	}
+
 	presence := voicePresenceData{UserID: client.user.ID, Username: client.user.Username, ChannelID: channelID}
-	encoded, err := json.Marshal(outboundEvent{Type: "user_joined_voice", Data: presence})
+	encoded, err = json.Marshal(outboundEvent{Type: "user_joined_voice", Data: presence})
 	if err != nil {
 		return fmt.Errorf("marshal user_joined_voice: %w", err)
 	}
 	h.broadcastToChannel(channelID, encoded)
+	if err := h.broadcastVoiceState(channelID, state); err != nil {
+		return err
+	}
 	log.Printf("user %d joined voice channel %d", client.user.ID, channelID)
 	return nil
 }
 
 func (h *Hub) markVoiceLeave(client *Client, channelID int64) error {
+	h.mu.Lock()
 	if channelID <= 0 {
 		channelID = client.voiceChannelID
 	}
-	if channelID <= 0 {
+	if channelID <= 0 || client.voiceChannelID != channelID {
+		h.mu.Unlock()
 		return nil
 	}
+	viaMedia := h.voiceModes[channelID] == database.VoiceModeSFU
+	h.removeFromVoiceLocked(client)
+	_, subscribed := h.channels[channelID][client]
+	h.mu.Unlock()
+
+	if viaMedia {
+		h.media.Leave(channelID, client.user.ID)
+	}
 
-	client.voiceChannelID = 0
 	presence := voicePresenceData{UserID: client.user.ID, Username: client.user.Username, ChannelID: channelID}
-	encoded, err := json.Marshal(outboundEvent{Type: "leave_voice", Data: presence})
-	if err != nil {
-		return fmt.Errorf("marshal leave_voice: %w", err)
+	left := VoiceState{UserID: client.user.ID, Username: client.user.Username}
+	for _, evt := range []outboundEvent{{Type: "leave_voice", Data: presence}, {Type: "voice_state_update", Data: left}} {
+		encoded, err := json.Marshal(evt)
+		if err != nil {
+			return fmt.Errorf("marshal %s: %w", evt.Type, err)
+		}
+		h.broadcastToChannel(channelID, encoded)
+		if !subscribed {
+			client.enqueue(encoded)
+		}
 	}
-	h.broadcastToChannel(channelID, encoded)
 	log.Printf("user %d left voice channel %d", client.user.ID, channelID)
 	return nil
 }
 
+// removeFromVoiceLocked takes client out of its voice channel, if any.
+// h.mu must be held.
+func (h *Hub) removeFromVoiceLocked(client *Client) {
+	channelID := client.voiceChannelID
+	client.voiceChannelID = 0
+	client.voiceState = VoiceState{}
+	members, ok := h.voice[channelID]
+	if !ok {
+		return
+	}
+	delete(members, client)
+	if len(members) == 0 {
+		delete(h.voice, channelID)
+		delete(h.voiceModes, channelID)
+	}
+}
+
 func (h *Hub) relaySignal(client *Client, evt inboundEvent) error {
 	channelID := evt.ChannelID
 	if channelID <= 0 {
 		channelID = client.voiceChannelID
 	}
-	if channelID <= 0 {
-		channelID = client.channelID
-	}
 	if channelID <= 0 {
 		return fmt.Errorf("channel is required for signal")
 	}
@@ -202,53 +469,266 @@ func (h *Hub) relaySignal(client *Client, evt inboundEvent) error {
 	if len(evt.Payload) == 0 {
 		return fmt.Errorf("signal payload is required")
 	}
+	toMedia := evt.TargetID == mediaServerID
+	targetID, err := strconv.ParseInt(evt.TargetID, 10, 64)
+	if !toMedia && (err != nil || targetID <= 0) {
+		return fmt.Errorf("target_id must be a user id or %q", mediaServerID)
+	}
+
+	if err := h.authorize(client.user.ID, channelID, permissions.ConnectVoice); err != nil {
+		return err
+	}
+	if err := h.requireVoiceChannel(channelID); err != nil {
+		return err
+	}
+
+	// Offers, answers and candidates go only to the target's connections in
+	// this voice channel; nobody else in the room sees them. In SFU mode
+	// the only peer is the server.
+	h.mu.Lock()
+	if _, ok := h.voice[channelID][client]; !ok {
+		h.mu.Unlock()
+		return fmt.Errorf("join the voice channel before signaling")
+	}
+	viaMedia := h.voiceModes[channelID] == database.VoiceModeSFU
+	if toMedia != viaMedia {
+		h.mu.Unlock()
+		if viaMedia {
+			return fmt.Errorf("%w: this channel sends media through the server, signal target_id %q", errVoiceModeMismatch, mediaServerID)
+		}
+		return fmt.Errorf("%w: this channel connects participants directly, signal their user ids", errVoiceModeMismatch)
+	}
+	if toMedia {
+		h.mu.Unlock()
+		return h.relayMediaSignal(client, channelID, evt.Payload)
+	}
+	targets := make([]*Client, 0, 1)
+	for target := range h.userClients[targetID] {
+		if _, ok := h.voice[channelID][target]; ok && target != client {
+			targets = append(targets, target)
+		}
+	}
+	screenStreamID := client.voiceState.ScreenShareStreamID
+	h.mu.Unlock()
+	if len(targets) == 0 {
+		return errSignalTarget
+	}
 
 	msg := outboundEvent{Type: "signal", Data: signalData{
-		FromUserID: client.user.ID,
-		FromName:   client.user.Username,
-		TargetID:   evt.TargetID,
-		ChannelID:  channelID,
-		Payload:    evt.Payload,
+		FromUserID:          client.user.ID,
+		FromName:            client.user.Username,
+		TargetID:            evt.TargetID,
+		ChannelID:           channelID,
+		ScreenShareStreamID: screenStreamID,
+		Payload:             evt.Payload,
 	}}
 	encoded, err := json.Marshal(msg)
 	if err != nil {
 		return fmt.Errorf("marshal signal: %w", err)
 	}
 
-	h.broadcastToChannel(channelID, encoded)
-	log.Printf("signal relay from user %d to target %s on channel %d", client.user.ID, evt.TargetID, channelID)
+	h.deliver(targets, encoded)
+	return nil
+}
+
+// authorize checks perm for userID in channelID through the shared
+// permission API. The returned error is safe to show to the client.
+func (h *Hub) authorize(userID, channelID int64, perm permissions.Permission) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := permissions.Check(ctx, h.db, userID, channelID, perm)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, database.ErrChannelNotFound), errors.Is(err, database.ErrNotChannelMember), errors.Is(err, permissions.ErrForbidden):
+		return err
+	default:
+		log.Printf("permission check %s for user %d on channel %d failed: %v", perm, userID, channelID, err)
+		return database.ErrChannelNotFound
+	}
+}
+
+// canManageUser requires actorID to outrank targetID, as moderating
+// another user does.
+func (h *Hub) canManageUser(actorID, targetID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := permissions.CanManageUser(ctx, h.db, actorID, targetID)
+	if err != nil && !errors.Is(err, permissions.ErrRoleHierarchy) {
+		log.Printf("role hierarchy check of user %d over user %d failed: %v", actorID, targetID, err)
+		return permissions.ErrForbidden
+	}
+	return err
+}
+
+func (h *Hub) requireVoiceChannel(channelID int64) error {
+	channelType, err := h.channelType(channelID)
+	if err != nil {
+		return err
+	}
+	if !database.SupportsVoice(channelType) {
+		return database.ErrNotVoiceChannel
+	}
+	return nil
+}
+
+// requirePostable enforces the channel type's posting rules once the
+// regular send permission has been granted.
+func (h *Hub) requirePostable(userID, channelID int64) error {
+	channelType, err := h.channelType(channelID)
+	if err != nil {
+		return err
+	}
+	if !database.SupportsMessages(channelType) {
+		return database.ErrNotTextChannel
+	}
+	if channelType == database.ChannelTypeAnnouncement {
+		if err := h.authorize(userID, channelID, permissions.ManageMessages); err != nil {
+			if errors.Is(err, permissions.ErrForbidden) {
+				return database.ErrPostingRestricted
+			}
+			return err
+		}
+	}
 	return nil
 }
 
-func (h *Hub) loadHistory(channelID int64) ([]database.Message, error) {
+func (h *Hub) channelType(channelID int64) (string, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	messages, err := database.GetMessages(ctx, h.db, channelID, messageHistLimit)
+	channelType, err := database.ChannelType(ctx, h.db, channelID)
+	if err != nil && !errors.Is(err, database.ErrChannelNotFound) {
+		log.Printf("fetch type of channel %d: %v", channelID, err)
+		return "", database.ErrChannelNotFound
+	}
+	return channelType, err
+}
+
+func (h *Hub) loadHistory(userID, channelID int64, query database.HistoryQuery) (database.HistoryPage, error) {
+	if err := h.authorize(userID, channelID, permissions.ViewChannel); err != nil {
+		return database.HistoryPage{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	page, err := database.GetMessages(ctx, h.db, channelID, query)
 	if err != nil {
-		return nil, fmt.Errorf("load history: %w", err)
+		return database.HistoryPage{}, fmt.Errorf("load history: %w", err)
 	}
-	return messages, nil
+	return page, nil
 }
 
-func (h *Hub) createAndBroadcastMessage(client *Client, channelID int64, content string) error {
+func (h *Hub) loadThreadHistory(userID, threadID int64, query database.HistoryQuery) (database.HistoryPage, int64, error) {
+	thread, err := h.authorizeThread(userID, threadID)
+	if err != nil {
+		return database.HistoryPage{}, 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	page, err := database.GetThreadMessages(ctx, h.db, threadID, query)
+	if err != nil {
+		return database.HistoryPage{}, 0, fmt.Errorf("load thread history: %w", err)
+	}
+	return page, thread.ChannelID, nil
+}
+
+// sendHistoryPage answers a load_history request with one page of messages
+// around the requested cursor.
+func (h *Hub) sendHistoryPage(client *Client, evt inboundEvent) error {
+	query := database.HistoryQuery{Before: evt.Before, After: evt.After, Around: evt.Around, Limit: evt.Limit}
+
+	var (
+		channelID = evt.ChannelID
+		page      database.HistoryPage
+		err       error
+	)
+	if evt.ThreadID > 0 {
+		page, channelID, err = h.loadThreadHistory(client.user.ID, evt.ThreadID, query)
+	} else {
+		if channelID == 0 {
+			channelID = client.channelID
+		}
+		if channelID <= 0 {
+			return fmt.Errorf("invalid channel id")
+		}
+		page, err = h.loadHistory(client.user.ID, channelID, query)
+	}
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(outboundEvent{Type: "history_page", Data: channelHistoryData{
+		ChannelID:     channelID,
+		ThreadID:      evt.ThreadID,
+		Before:        evt.Before,
+		After:         evt.After,
+		Around:        evt.Around,
+		Messages:      page.Messages,
+		HasMore:       page.HasMore,
+		HasMoreBefore: page.HasMoreBefore,
+		HasMoreAfter:  page.HasMoreAfter,
+	}})
+	if err != nil {
+		return fmt.Errorf("marshal history page: %w", err)
+	}
+
+	client.enqueue(payload)
+	return nil
+}
+
+// createAndBroadcastMessage posts a message to a channel or, when
+// opts.ThreadID is set, to one of its threads. A zero channelID is taken
+// from the thread.
+func (h *Hub) createAndBroadcastMessage(client *Client, channelID int64, content string, opts database.MessageOptions) error {
+	if opts.ThreadID > 0 {
+		thread, err := h.authorizeThread(client.user.ID, opts.ThreadID)
+		if err != nil {
+			return err
+		}
+		if channelID > 0 && channelID != thread.ChannelID {
+			return database.ErrThreadNotFound
+		}
+		channelID = thread.ChannelID
+	}
 	if channelID <= 0 {
 		return fmt.Errorf("invalid channel id")
 	}
 
-	trimmed := strings.TrimSpace(content)
-	if trimmed == "" {
-		return fmt.Errorf("message content is required")
+	trimmed, err := ValidateMessageContent(content)
+	if err != nil {
+		return err
 	}
-	if len(trimmed) > maxMessageSize {
-		return fmt.Errorf("message content too long")
+
+	if err := h.authorize(client.user.ID, channelID, permissions.ViewChannel|permissions.SendMessages); err != nil {
+		return err
+	}
+	if opts.ThreadID == 0 {
+		if err := h.requirePostable(client.user.ID, channelID); err != nil {
+			return err
+		}
+	}
+
+	if opts.Mentions, err = h.resolveMentions(client.user.ID, channelID, trimmed); err != nil {
+		return err
+	}
+	if opts.MentionRecipients, err = h.mentionRecipients(client.user.ID, channelID, opts.Mentions); err != nil {
+		return err
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	message, err := database.CreateMessage(ctx, h.db, client.user.ID, channelID, trimmed)
+	message, err := database.CreateMessage(ctx, h.db, client.user.ID, channelID, trimmed, opts)
 	if err != nil {
+		if errors.Is(err, database.ErrThreadNotFound) || errors.Is(err, database.ErrInvalidReply) {
+			return err
+		}
 		return fmt.Errorf("create message: %w", err)
 	}
 
@@ -258,47 +738,417 @@ func (h *Hub) createAndBroadcastMessage(client *Client, channelID int64, content
 		return fmt.Errorf("marshal outbound message: %w", err)
 	}
 
-	h.broadcastToChannel(channelID, encoded)
+	h.stopTyping(typingKey{channelID: channelID, threadID: opts.ThreadID, userID: client.user.ID})
+	h.broadcastMessageEvent(message, encoded)
+	h.notifyMentions(message, opts.MentionRecipients)
+	go h.pushUnreadUpdates(message, opts.MentionRecipients)
+	if message.ThreadID != nil {
+		return h.broadcastThreadCount(*message.ThreadID)
+	}
 	return nil
 }
 
+// ValidateMessageContent trims content and enforces the limits applied to
+// every message body, whether it arrives over the socket or over REST.
+func ValidateMessageContent(content string) (string, error) {
+	trimmed := strings.TrimSpace(content)
+	if trimmed == "" {
+		return "", fmt.Errorf("message content is required")
+	}
+	if len(trimmed) > maxMessageSize {
+		return "", fmt.Errorf("message content too long")
+	}
+	return trimmed, nil
+}
+
+// EditMessage updates a message authored by userID and pushes the new
+// version to everyone in its channel.
+func (h *Hub) EditMessage(userID, messageID int64, content string) (database.Message, error) {
+	trimmed, err := ValidateMessageContent(content)
+	if err != nil {
+		return database.Message{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	existing, err := database.GetMessage(ctx, h.db, messageID)
+	if err != nil {
+		return database.Message{}, fmt.Errorf("edit message: %w", err)
+	}
+	if err := h.authorize(userID, existing.ChannelID, permissions.ViewChannel|permissions.SendMessages); err != nil {
+		return database.Message{}, err
+	}
+	// Edits refresh what the message refers to without notifying anyone.
+	mentions, err := h.resolveMentions(userID, existing.ChannelID, trimmed)
+	if err != nil {
+		return database.Message{}, err
+	}
+
+	message, err := database.EditMessage(ctx, h.db, messageID, userID, trimmed, mentions)
+	if err != nil {
+		return database.Message{}, fmt.Errorf("edit message: %w", err)
+	}
+
+	encoded, err := json.Marshal(outboundEvent{Type: "message_updated", Data: message})
+	if err != nil {
+		return database.Message{}, fmt.Errorf("marshal message_updated: %w", err)
+	}
+	h.broadcastMessageEvent(message, encoded)
+	return message, nil
+}
+
+// DeleteMessage tombstones a message and tells everyone in its channel to
+// drop it, unpinning it if need be. Users may delete their own messages
+// while they can still post in the channel; deleting anyone else's requires
+// ManageMessages there.
+func (h *Hub) DeleteMessage(userID, messageID int64) (database.Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	existing, err := database.GetMessage(ctx, h.db, messageID)
+	if err != nil {
+		return database.Message{}, fmt.Errorf("delete message: %w", err)
+	}
+	moderator := false
+	if existing.UserID == userID {
+		if err := h.authorize(userID, existing.ChannelID, permissions.ViewChannel|permissions.SendMessages); err != nil {
+			return database.Message{}, err
+		}
+	} else {
+		if err := h.authorize(userID, existing.ChannelID, permissions.ManageMessages); err != nil {
+			if errors.Is(err, permissions.ErrForbidden) {
+				return database.Message{}, fmt.Errorf("delete message: %w", database.ErrNotMessageAuthor)
+			}
+			return database.Message{}, err
+		}
+		moderator = true
+	}
+
+	message, err := database.DeleteMessage(ctx, h.db, messageID, userID, moderator)
+	if err != nil {
+		return database.Message{}, fmt.Errorf("delete message: %w", err)
+	}
+
+	encoded, err := json.Marshal(outboundEvent{Type: "message_deleted", Data: messageDeletedData{ID: message.ID, ChannelID: message.ChannelID, ThreadID: message.ThreadID}})
+	if err != nil {
+		return database.Message{}, fmt.Errorf("marshal message_deleted: %w", err)
+	}
+	h.broadcastMessageEvent(message, encoded)
+	if existing.Pinned {
+		h.broadcastPin(userID, message)
+	}
+	if message.ThreadID != nil {
+		if err := h.broadcastThreadCount(*message.ThreadID); err != nil {
+			log.Printf("broadcast thread count after delete: %v", err)
+		}
+	}
+	return message, nil
+}
+
 func (h *Hub) broadcastToChannel(channelID int64, data []byte) {
 	h.mu.Lock()
-	members := make([]*Client, 0)
+	members := make([]*Client, 0, len(h.channels[channelID])+len(h.voice[channelID]))
 	for client := range h.channels[channelID] {
 		members = append(members, client)
 	}
+	// Voice participants hear about their channel even while viewing
+	// another one.
+	for client := range h.voice[channelID] {
+		if _, subscribed := h.channels[channelID][client]; !subscribed {
+			members = append(members, client)
+		}
+	}
 	h.mu.Unlock()
 
+	h.deliver(members, data)
+}
+
+// deliver queues data on each connection. A connection that cannot keep
+// up loses its socket; its session can still resume and replay the event.
+func (h *Hub) deliver(members []*Client, data []byte) {
 	for _, client := range members {
-		select {
-		case client.send <- data:
-		default:
-			h.removeClient(client)
-			_ = client.conn.Close()
+		if !client.enqueue(data) {
+			client.closeConn()
+		}
+	}
+}
+
+// RemoveUserFromChannel unsubscribes every connection of userID from
+// channelID and drops them from its voice room, for when their access to the
+// channel has been revoked.
+func (h *Hub) RemoveUserFromChannel(userID, channelID int64) {
+	h.mu.Lock()
+	for client := range h.channels[channelID] {
+		if client.user.ID != userID {
+			continue
+		}
+		h.removeFromChannelLocked(client, channelID)
+		delete(client.subscriptions, channelID)
+		if client.channelID == channelID {
+			client.channelID = 0
+		}
+	}
+	inVoice := make([]*Client, 0)
+	for client := range h.voice[channelID] {
+		if client.user.ID == userID {
+			inVoice = append(inVoice, client)
+		}
+	}
+	h.dropThreadSubscriptionsLocked(channelID, func(client *Client) bool { return client.user.ID == userID })
+	h.mu.Unlock()
+
+	for _, client := range inVoice {
+		if err := h.markVoiceLeave(client, channelID); err != nil {
+			log.Printf("remove user %d from voice channel %d: %v", userID, channelID, err)
 		}
 	}
 }
 
+// CloseChannel unsubscribes every connection from a deleted channel and
+// ends any voice session in it. No events are sent to the channel itself;
+// callers notify viewers through SendToUsers.
+func (h *Hub) CloseChannel(channelID int64) {
+	h.mu.Lock()
+	evicted := make([]*Client, 0, len(h.channels[channelID]))
+	for client := range h.channels[channelID] {
+		delete(client.subscriptions, channelID)
+		if client.channelID == channelID {
+			client.channelID = 0
+		}
+		evicted = append(evicted, client)
+	}
+	delete(h.channels, channelID)
+	h.dropThreadSubscriptionsLocked(channelID, nil)
+	for client := range h.voice[channelID] {
+		client.voiceChannelID = 0
+		client.voiceState = VoiceState{}
+	}
+	delete(h.voice, channelID)
+	delete(h.voiceModes, channelID)
+	h.mu.Unlock()
+
+	h.media.CloseRoom(channelID)
+
+	log.Printf("closed channel %d, evicted %d connections", channelID, len(evicted))
+}
+
+// ChannelViewers returns the connected users allowed to see channelID, so
+// channel lifecycle events only reach people who could list the channel.
+func (h *Hub) ChannelViewers(channelID int64) []int64 {
+	h.mu.Lock()
+	candidates := make([]int64, 0, len(h.userClients))
+	for userID := range h.userClients {
+		candidates = append(candidates, userID)
+	}
+	h.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	viewers, err := database.FilterChannelViewers(ctx, h.db, permissions.ChannelViewers(channelID), candidates)
+	if err != nil {
+		log.Printf("viewers of channel %d: %v", channelID, err)
+		return nil
+	}
+	return viewers
+}
+
+// BroadcastToChannel sends an event to every connection subscribed to
+// channelID.
+func (h *Hub) BroadcastToChannel(channelID int64, eventType string, data any) error {
+	encoded, err := json.Marshal(outboundEvent{Type: eventType, Data: data})
+	if err != nil {
+		return fmt.Errorf("marshal %s: %w", eventType, err)
+	}
+	h.broadcastToChannel(channelID, encoded)
+	return nil
+}
+
+// DisconnectUser ends every session owned by userID, used when a moderator
+// kicks or bans them, and closes their sockets. The sessions cannot be
+// resumed.
+func (h *Hub) DisconnectUser(userID int64) {
+	h.mu.Lock()
+	targets := make([]*Client, 0, len(h.userClients[userID]))
+	for client := range h.userClients[userID] {
+		targets = append(targets, client)
+	}
+	h.mu.Unlock()
+
+	// Removing the sessions before closing keeps them from being resumed.
+	for _, client := range targets {
+		if err := h.markVoiceLeave(client, 0); err != nil {
+			log.Printf("disconnect user %d from voice: %v", userID, err)
+		}
+		h.removeClient(client)
+		client.closeConn()
+	}
+}
+
+// setServerMute lets a moderator mute or unmute another participant of a
+// voice channel for everyone in it.
+func (h *Hub) setServerMute(client *Client, evt inboundEvent) error {
+	channelID := evt.ChannelID
+	if channelID <= 0 {
+		channelID = client.voiceChannelID
+	}
+	if channelID <= 0 || evt.UserID <= 0 {
+		return fmt.Errorf("channel and user are required")
+	}
+	if err := h.authorize(client.user.ID, channelID, permissions.MuteMembers); err != nil {
+		return err
+	}
+	if err := h.canManageUser(client.user.ID, evt.UserID); err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	var (
+		state VoiceState
+		found bool
+	)
+	for member := range h.voice[channelID] {
+		if member.user.ID == evt.UserID {
+			member.voiceState.ServerMute = evt.Muted
+			state, found = member.voiceState, true
+		}
+	}
+	viaMedia := h.voiceModes[channelID] == database.VoiceModeSFU
+	h.mu.Unlock()
+	if !found {
+		return fmt.Errorf("user is not in this voice channel")
+	}
+
+	// Through the SFU the mute is enforced by no longer forwarding the
+	// user's audio; in mesh mode only their client can honour it.
+	if viaMedia {
+		if err := h.media.SetMuted(channelID, evt.UserID, evt.Muted); err != nil && !errors.Is(err, sfu.ErrNotInRoom) {
+			log.Printf("server mute of user %d in channel %d: %v", evt.UserID, channelID, err)
+		}
+	}
+
+	encoded, err := json.Marshal(outboundEvent{Type: "voice_server_mute", Data: serverMuteData{
+		UserID:    evt.UserID,
+		ChannelID: channelID,
+		Muted:     evt.Muted,
+		ByUserID:  client.user.ID,
+	}})
+	if err != nil {
+		return fmt.Errorf("marshal voice_server_mute: %w", err)
+	}
+	h.broadcastToChannel(channelID, encoded)
+	return h.broadcastVoiceState(channelID, state)
+}
+
+// SendToUsers delivers an event to every connection owned by one of
+// userIDs, regardless of which channel those connections are viewing.
+func (h *Hub) SendToUsers(userIDs []int64, eventType string, data any) error {
+	encoded, err := json.Marshal(outboundEvent{Type: eventType, Data: data})
+	if err != nil {
+		return fmt.Errorf("marshal %s: %w", eventType, err)
+	}
+
+	h.mu.Lock()
+	targets := make([]*Client, 0, len(userIDs))
+	seen := make(map[int64]struct{}, len(userIDs))
+	for _, userID := range userIDs {
+		if _, ok := seen[userID]; ok {
+			continue
+		}
+		seen[userID] = struct{}{}
+		for client := range h.userClients[userID] {
+			targets = append(targets, client)
+		}
+	}
+	h.mu.Unlock()
+
+	for _, client := range targets {
+		client.enqueue(encoded)
+	}
+	return nil
+}
+
+// ActiveUserIDs returns the users who appear online to others, leaving
+// out anyone who is invisible.
 func (h *Hub) ActiveUserIDs() map[int64]bool {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	active := make(map[int64]bool)
-	for client := range h.clients {
-		active[client.user.ID] = true
+	active := make(map[int64]bool, len(h.userClients))
+	for userID := range h.userClients {
+		if state, ok := h.presence[userID]; ok && state.settings.Status == database.PresenceInvisible {
+			continue
+		}
+		active[userID] = true
 	}
 	return active
 }
 
-func (h *Hub) sendError(client *Client, message string) {
-	payload, err := json.Marshal(outboundEvent{Type: "error", Data: map[string]string{"message": message}})
+// ConnectedUserIDs returns every user with at least one connection,
+// invisible or not, for delivering events rather than showing presence.
+func (h *Hub) ConnectedUserIDs() map[int64]bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	connected := make(map[int64]bool, len(h.userClients))
+	for userID := range h.userClients {
+		connected[userID] = true
+	}
+	return connected
+}
+
+func (h *Hub) sendError(client *Client, err error) {
+	h.sendErrorCode(client, errorCode(err), err.Error())
+}
+
+func (h *Hub) sendErrorCode(client *Client, code ErrorCode, message string) {
+	payload, err := json.Marshal(outboundEvent{Type: "error", Data: errorData{Code: code, Message: message}})
 	if err != nil {
 		return
 	}
 
-	select {
-	case client.send <- payload:
+	client.enqueue(payload)
+}
+
+func errorCode(err error) ErrorCode {
+	switch {
+	case errors.Is(err, database.ErrChannelNotFound):
+		return CodeChannelNotFound
+	case errors.Is(err, database.ErrNotChannelMember):
+		return CodeNotChannelMember
+	case errors.Is(err, permissions.ErrForbidden), errors.Is(err, permissions.ErrRoleHierarchy):
+		return CodeForbidden
+	case errors.Is(err, database.ErrNotVoiceChannel):
+		return CodeNotVoiceChannel
+	case errors.Is(err, database.ErrNotTextChannel):
+		return CodeNotTextChannel
+	case errors.Is(err, database.ErrPostingRestricted):
+		return CodePostingRestricted
+	case errors.Is(err, database.ErrMessageNotFound):
+		return CodeMessageNotFound
+	case errors.Is(err, database.ErrNotMessageAuthor):
+		return CodeNotMessageAuthor
+	case errors.Is(err, database.ErrThreadNotFound):
+		return CodeThreadNotFound
+	case errors.Is(err, database.ErrThreadExists), errors.Is(err, database.ErrNestedThread),
+		errors.Is(err, database.ErrThreadsUnsupported), errors.Is(err, database.ErrThreadParent):
+		return CodeInvalidThread
+	case errors.Is(err, database.ErrInvalidReply):
+		return CodeInvalidReply
+	case errors.Is(err, database.ErrInvalidEmoji), errors.Is(err, database.ErrTooManyReactions):
+		return CodeInvalidReaction
+	case errors.Is(err, database.ErrTooManyPins):
+		return CodePinLimitReached
+	case errors.Is(err, errSignalTarget), errors.Is(err, errNotSharing):
+		return CodeTargetNotFound
+	case errors.Is(err, errVoiceModeMismatch):
+		return CodeVoiceModeMismatch
+	case errors.Is(err, errScreenShareLimit):
+		return CodeScreenShareLimit
+	case errors.Is(err, database.ErrInvalidPresence), errors.Is(err, database.ErrInvalidCustomStatus):
+		return CodeInvalidPresence
 	default:
+		return CodeBadRequest
 	}
 }
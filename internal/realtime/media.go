@@ -0,0 +1,160 @@
+package realtime
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"openvoice/internal/database"
+	"openvoice/internal/sfu"
+)
+
+// mediaServerID is the target_id of signals meant for the server's SFU, and
+// the from_name of signals it sends back. Those carry a from_user_id of 0.
+const mediaServerID = "sfu"
+
+var errVoiceModeMismatch = errors.New("wrong voice mode for this channel")
+
+type voiceModeChangedData struct {
+	ChannelID int64  `json:"channel_id"`
+	VoiceMode string `json:"voice_mode"`
+}
+
+func (h *Hub) voiceMode(channelID int64) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	mode, err := database.ChannelVoiceMode(ctx, h.db, channelID)
+	if err != nil {
+		if errors.Is(err, database.ErrChannelNotFound) {
+			return "", err
+		}
+		return "", fmt.Errorf("load voice mode: %w", err)
+	}
+	return mode, nil
+}
+
+// joinMedia connects a participant who just joined an SFU channel to the
+// media server, which sends them its first offer.
+func (h *Hub) joinMedia(client *Client, channelID int64) error {
+	if err := h.media.Join(channelID, client.user.ID, h.mediaSignalSender(client, channelID)); err != nil {
+		return fmt.Errorf("connect to media server: %w", err)
+	}
+	return nil
+}
+
+// mediaSignalSender returns the function the SFU uses to signal client.
+func (h *Hub) mediaSignalSender(client *Client, channelID int64) sfu.SendFunc {
+	targetID := strconv.FormatInt(client.user.ID, 10)
+	return func(sig sfu.Signal) {
+		payload, err := json.Marshal(sig)
+		if err != nil {
+			log.Printf("marshal media signal: %v", err)
+			return
+		}
+		encoded, err := json.Marshal(outboundEvent{Type: "signal", Data: signalData{
+			FromName:  mediaServerID,
+			TargetID:  targetID,
+			ChannelID: channelID,
+			Payload:   payload,
+		}})
+		if err != nil {
+			log.Printf("marshal signal: %v", err)
+			return
+		}
+		h.deliver([]*Client{client}, encoded)
+	}
+}
+
+// relayMediaSignal hands a signal addressed to the SFU over to it.
+func (h *Hub) relayMediaSignal(client *Client, channelID int64, payload json.RawMessage) error {
+	var sig sfu.Signal
+	if err := json.Unmarshal(payload, &sig); err != nil {
+		return fmt.Errorf("invalid signal payload")
+	}
+	if err := h.media.HandleSignal(channelID, client.user.ID, sig); err != nil {
+		if errors.Is(err, sfu.ErrInvalidSignal) || errors.Is(err, sfu.ErrNotInRoom) {
+			return err
+		}
+		log.Printf("media signal from user %d in channel %d: %v", client.user.ID, channelID, err)
+		return fmt.Errorf("media server rejected the signal")
+	}
+	return nil
+}
+
+// ChangeVoiceMode applies a new voice mode to a channel whose voice room is
+// in use. Everyone in it is taken out of voice and sent voice_mode_changed,
+// and rejoining sets their media up the new way.
+func (h *Hub) ChangeVoiceMode(channelID int64, mode string) {
+	h.mu.Lock()
+	current, active := h.voiceModes[channelID]
+	if !active || current == mode {
+		h.mu.Unlock()
+		return
+	}
+	members := make([]*Client, 0, len(h.voice[channelID]))
+	for client := range h.voice[channelID] {
+		members = append(members, client)
+	}
+	h.mu.Unlock()
+
+	for _, client := range members {
+		if err := h.markVoiceLeave(client, channelID); err != nil {
+			log.Printf("move user %d out of voice channel %d: %v", client.user.ID, channelID, err)
+		}
+	}
+
+	encoded, err := json.Marshal(outboundEvent{Type: "voice_mode_changed", Data: voiceModeChangedData{ChannelID: channelID, VoiceMode: mode}})
+	if err != nil {
+		log.Printf("marshal voice_mode_changed: %v", err)
+		return
+	}
+	h.deliver(members, encoded)
+	log.Printf("voice channel %d switched to %s mode, %d participants asked to rejoin", channelID, mode, len(members))
+}
+
+// setVideoQuality tells the SFU which simulcast layers client wants. A
+// user_id with a quality, or the height of the tile showing that user,
+// caps what they receive of that publisher; bandwidth_kbps caps what they
+// receive in total.
+func (h *Hub) setVideoQuality(client *Client, evt inboundEvent) error {
+	h.mu.Lock()
+	channelID := client.voiceChannelID
+	mode := h.voiceModes[channelID]
+	h.mu.Unlock()
+	if channelID <= 0 {
+		return fmt.Errorf("join a voice channel before setting video quality")
+	}
+	if mode != database.VoiceModeSFU {
+		return fmt.Errorf("%w: video quality can only be chosen when media goes through the server", errVoiceModeMismatch)
+	}
+
+	quality := evt.Quality
+	if quality == "" && evt.Height > 0 {
+		quality = sfu.QualityForHeight(evt.Height)
+	}
+	if evt.BandwidthKbps < 0 {
+		return fmt.Errorf("bandwidth_kbps must not be negative")
+	}
+	if quality == "" && evt.BandwidthKbps == 0 {
+		return fmt.Errorf("quality, height or bandwidth_kbps is required")
+	}
+	if quality != "" {
+		if evt.UserID <= 0 {
+			return fmt.Errorf("user_id is required to set video quality")
+		}
+		if err := h.media.SetVideoQuality(channelID, client.user.ID, evt.UserID, quality); err != nil {
+			return err
+		}
+	}
+	if evt.BandwidthKbps > 0 {
+		if err := h.media.SetBandwidth(channelID, client.user.ID, uint64(evt.BandwidthKbps)*1000); err != nil {
+			return err
+		}
+	}
+	return nil
+}
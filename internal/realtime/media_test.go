@@ -0,0 +1,326 @@
+package realtime
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"openvoice/internal/database"
+	"openvoice/internal/sfu"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+const mediaTestTimeout = 10 * time.Second
+
+var testOpus = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}
+
+// mediaTestClient is a participant that reaches the SFU only through the
+// hub: it connects a websocket, joins voice and exchanges every offer,
+// answer and candidate as a signal event.
+type mediaTestClient struct {
+	t      *testing.T
+	userID int64
+	conn   *websocket.Conn
+	pc     *webrtc.PeerConnection
+	// publish is added to the connection when the server's first offer is
+	// answered.
+	publish []webrtc.TrackLocal
+
+	writeMu sync.Mutex
+	done    chan struct{}
+
+	mu       sync.Mutex
+	received map[string]*mediaTestTrack
+}
+
+// mediaTestTrack is a track the server forwarded to a test client.
+type mediaTestTrack struct {
+	mu      sync.Mutex
+	packets int
+	ended   bool
+}
+
+// newMediaTestServer starts a hub with an SFU behind a websocket endpoint
+// that trusts the user named in its query string. It returns the endpoint
+// and a voice channel in sfu mode that alice (1) and bob (2) can join.
+func newMediaTestServer(t *testing.T) (string, int64) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), mediaTestTimeout)
+	defer cancel()
+
+	db, err := database.InitDB(filepath.Join(t.TempDir(), "openvoice.db"))
+	if err != nil {
+		t.Fatalf("init db: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	users := map[int64]string{1: "alice", 2: "bob"}
+	for id, name := range users {
+		if _, err := db.ExecContext(ctx, `INSERT INTO users (id, username, password_hash) VALUES (?, ?, '')`, id, name); err != nil {
+			t.Fatalf("insert user %s: %v", name, err)
+		}
+	}
+	channel, err := database.CreateChannel(ctx, db, 1, database.Channel{Name: "voice", Type: database.ChannelTypeVoice, VoiceMode: database.VoiceModeSFU})
+	if err != nil {
+		t.Fatalf("create channel: %v", err)
+	}
+
+	media, err := sfu.New(sfu.Config{})
+	if err != nil {
+		t.Fatalf("new sfu: %v", err)
+	}
+	t.Cleanup(func() { media.CloseRoom(channel.ID) })
+	hub := NewHub(db, media)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, _ := strconv.ParseInt(r.URL.Query().Get("user"), 10, 64)
+		if err := hub.ServeWS(w, r, User{ID: id, Username: users[id]}); err != nil {
+			t.Errorf("serve websocket: %v", err)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http"), channel.ID
+}
+
+func dialMediaTestClient(t *testing.T, endpoint string, userID int64, publish ...webrtc.TrackLocal) *mediaTestClient {
+	t.Helper()
+	// The server offers a video section too, which a client without a
+	// video codec would reject.
+	media := &webrtc.MediaEngine{}
+	codecs := []struct {
+		params webrtc.RTPCodecParameters
+		kind   webrtc.RTPCodecType
+	}{
+		{webrtc.RTPCodecParameters{RTPCodecCapability: testOpus, PayloadType: 111}, webrtc.RTPCodecTypeAudio},
+		{webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, PayloadType: 96}, webrtc.RTPCodecTypeVideo},
+	}
+	for _, codec := range codecs {
+		if err := media.RegisterCodec(codec.params, codec.kind); err != nil {
+			t.Fatalf("register %s: %v", codec.params.MimeType, err)
+		}
+	}
+	pc, err := webrtc.NewAPI(webrtc.WithMediaEngine(media)).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("new peer connection: %v", err)
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(endpoint+"?user="+strconv.FormatInt(userID, 10), nil)
+	if err != nil {
+		_ = pc.Close()
+		t.Fatalf("dial websocket: %v", err)
+	}
+
+	c := &mediaTestClient{
+		t:        t,
+		userID:   userID,
+		conn:     conn,
+		pc:       pc,
+		publish:  publish,
+		done:     make(chan struct{}),
+		received: make(map[string]*mediaTestTrack),
+	}
+	pc.OnTrack(func(remote *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		track := &mediaTestTrack{}
+		c.mu.Lock()
+		c.received[remote.StreamID()] = track
+		c.mu.Unlock()
+		go track.read(remote)
+	})
+	go c.readEvents()
+	t.Cleanup(func() {
+		c.writeMu.Lock()
+		_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		c.writeMu.Unlock()
+		_ = conn.Close()
+		<-c.done
+		_ = pc.Close()
+	})
+	return c
+}
+
+func (c *mediaTestClient) send(event map[string]any) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.conn.WriteJSON(event); err != nil {
+		c.t.Errorf("user %d: send %v: %v", c.userID, event["type"], err)
+	}
+}
+
+// readEvents answers the SFU's signals and fails the test on any error
+// event, until the socket closes.
+func (c *mediaTestClient) readEvents() {
+	defer close(c.done)
+	for {
+		_, message, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var evt struct {
+			Type string          `json:"type"`
+			Data json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal(message, &evt); err != nil {
+			c.t.Errorf("user %d: decode event: %v", c.userID, err)
+			continue
+		}
+		switch evt.Type {
+		case "error":
+			c.t.Errorf("user %d: error event: %s", c.userID, evt.Data)
+		case "signal":
+			var data signalData
+			var sig sfu.Signal
+			if err := json.Unmarshal(evt.Data, &data); err != nil || data.FromName != mediaServerID {
+				c.t.Errorf("user %d: unexpected signal %s", c.userID, evt.Data)
+				continue
+			}
+			if err := json.Unmarshal(data.Payload, &sig); err != nil {
+				c.t.Errorf("user %d: decode signal payload: %v", c.userID, err)
+				continue
+			}
+			c.handle(data.ChannelID, sig)
+		}
+	}
+}
+
+func (c *mediaTestClient) handle(channelID int64, sig sfu.Signal) {
+	switch sig.Type {
+	case sfu.SignalOffer:
+		if err := c.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: sig.SDP}); err != nil {
+			c.t.Errorf("user %d: set remote offer: %v", c.userID, err)
+			return
+		}
+		for _, track := range c.publish {
+			if _, err := c.pc.AddTrack(track); err != nil {
+				c.t.Errorf("user %d: add track: %v", c.userID, err)
+				return
+			}
+		}
+		c.publish = nil
+		answer, err := c.pc.CreateAnswer(nil)
+		if err != nil {
+			c.t.Errorf("user %d: create answer: %v", c.userID, err)
+			return
+		}
+		// The answer goes out with every candidate in it, so the client
+		// needs no trickle of its own.
+		gathered := webrtc.GatheringCompletePromise(c.pc)
+		if err := c.pc.SetLocalDescription(answer); err != nil {
+			c.t.Errorf("user %d: set local answer: %v", c.userID, err)
+			return
+		}
+		<-gathered
+		c.send(map[string]any{
+			"type":       "signal",
+			"channel_id": channelID,
+			"target_id":  mediaServerID,
+			"payload":    sfu.Signal{Type: sfu.SignalAnswer, SDP: c.pc.LocalDescription().SDP},
+		})
+	case sfu.SignalCandidate:
+		if err := c.pc.AddICECandidate(*sig.Candidate); err != nil {
+			c.t.Errorf("user %d: add candidate: %v", c.userID, err)
+		}
+	}
+}
+
+// track returns what arrived in stream, or nil.
+func (c *mediaTestClient) track(stream string) *mediaTestTrack {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.received[stream]
+}
+
+func (track *mediaTestTrack) read(remote *webrtc.TrackRemote) {
+	for {
+		_, _, err := remote.ReadRTP()
+		track.mu.Lock()
+		if err != nil {
+			track.ended = true
+			track.mu.Unlock()
+			return
+		}
+		track.packets++
+		track.mu.Unlock()
+	}
+}
+
+func (track *mediaTestTrack) state() (packets int, ended bool) {
+	track.mu.Lock()
+	defer track.mu.Unlock()
+	return track.packets, track.ended
+}
+
+// sendOpus writes a packet to track every 20ms until the test ends.
+func sendOpus(t *testing.T, track *webrtc.TrackLocalStaticRTP) {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		close(stop)
+		<-done
+	})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		for seq := uint16(0); ; seq++ {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			_ = track.WriteRTP(&rtp.Packet{
+				Header:  rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: uint32(seq) * 960},
+				Payload: []byte{0xf8},
+			})
+		}
+	}()
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(mediaTestTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMediaSignalsThroughHub(t *testing.T) {
+	endpoint, channelID := newMediaTestServer(t)
+	audio, err := webrtc.NewTrackLocalStaticRTP(testOpus, "audio", "alice-mic")
+	if err != nil {
+		t.Fatalf("new track: %v", err)
+	}
+	sendOpus(t, audio)
+
+	alice := dialMediaTestClient(t, endpoint, 1, audio)
+	alice.send(map[string]any{"type": "join_voice", "channel_id": channelID})
+	bob := dialMediaTestClient(t, endpoint, 2)
+	bob.send(map[string]any{"type": "join_voice", "channel_id": channelID})
+
+	// The SFU labels forwarded tracks with their publisher's user id.
+	var heard *mediaTestTrack
+	waitFor(t, "bob to hear alice", func() bool {
+		heard = bob.track("1")
+		if heard == nil {
+			return false
+		}
+		packets, _ := heard.state()
+		return packets > 0
+	})
+
+	alice.send(map[string]any{"type": "leave_voice", "channel_id": channelID})
+	waitFor(t, "alice's audio to be withdrawn from bob", func() bool {
+		_, ended := heard.state()
+		return ended
+	})
+}
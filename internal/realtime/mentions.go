@@ -0,0 +1,93 @@
+package realtime
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"openvoice/internal/database"
+	"openvoice/internal/permissions"
+)
+
+// mentionData is delivered to every mentioned user wherever they are
+// connected, so it carries the whole message rather than just its ID.
+type mentionData struct {
+	ChannelID int64            `json:"channel_id"`
+	Message   database.Message `json:"message"`
+}
+
+// resolveMentions turns the references in content into the mention data
+// stored with the message. @everyone and @here are ignored unless the
+// author has MentionEveryone in the channel.
+func (h *Hub) resolveMentions(authorID, channelID int64, content string) (database.Mentions, error) {
+	parsed := database.ParseMentions(content)
+	if parsed.Everyone || parsed.Here {
+		if err := h.authorize(authorID, channelID, permissions.MentionEveryone); err != nil {
+			if !errors.Is(err, permissions.ErrForbidden) {
+				return database.Mentions{}, err
+			}
+			parsed.Everyone, parsed.Here = false, false
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	mentions, err := database.ResolveMentions(ctx, h.db, parsed, permissions.VisibleChannels(authorID))
+	if err != nil {
+		return database.Mentions{}, fmt.Errorf("resolve mentions: %w", err)
+	}
+	return mentions, nil
+}
+
+// mentionRecipients lists the users whose inbox a message with mentions
+// lands in: @everyone reaches every user, @here those connected right now.
+// Nobody is notified about a channel they cannot see or about their own
+// message.
+func (h *Hub) mentionRecipients(authorID, channelID int64, mentions database.Mentions) ([]int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var (
+		viewers []int64
+		err     error
+	)
+	switch {
+	case mentions.Everyone:
+		viewers, err = database.ChannelViewers(ctx, h.db, permissions.ChannelViewers(channelID))
+	case mentions.Here:
+		active := h.ConnectedUserIDs()
+		for _, id := range mentions.Users {
+			active[id] = true
+		}
+		candidates := make([]int64, 0, len(active))
+		for id := range active {
+			candidates = append(candidates, id)
+		}
+		viewers, err = database.FilterChannelViewers(ctx, h.db, permissions.ChannelViewers(channelID), candidates)
+	default:
+		viewers, err = database.FilterChannelViewers(ctx, h.db, permissions.ChannelViewers(channelID), mentions.Users)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("resolve mention recipients: %w", err)
+	}
+
+	recipients := viewers[:0]
+	for _, userID := range viewers {
+		if userID != authorID {
+			recipients = append(recipients, userID)
+		}
+	}
+	return recipients, nil
+}
+
+func (h *Hub) notifyMentions(message database.Message, recipients []int64) {
+	if len(recipients) == 0 {
+		return
+	}
+	if err := h.SendToUsers(recipients, "mention", mentionData{ChannelID: message.ChannelID, Message: message}); err != nil {
+		log.Printf("notify mentions for message %d: %v", message.ID, err)
+	}
+}
@@ -0,0 +1,67 @@
+package realtime
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"openvoice/internal/database"
+	"openvoice/internal/permissions"
+)
+
+// pinData announces a pin change. Pins are listed per channel, so the event
+// goes to the channel even when the message lives in one of its threads.
+type pinData struct {
+	ChannelID int64            `json:"channel_id"`
+	UserID    int64            `json:"user_id"`
+	Message   database.Message `json:"message"`
+}
+
+// SetPinned pins or unpins a message on behalf of userID, who needs
+// ManageMessages in the message's channel, and tells the channel about it.
+func (h *Hub) SetPinned(userID, messageID int64, pinned bool) (database.Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	existing, err := database.GetMessage(ctx, h.db, messageID)
+	if err != nil {
+		return database.Message{}, err
+	}
+	if err := h.authorize(userID, existing.ChannelID, permissions.ViewChannel|permissions.ManageMessages); err != nil {
+		return database.Message{}, err
+	}
+
+	var (
+		message database.Message
+		changed bool
+	)
+	if pinned {
+		message, changed, err = database.PinMessage(ctx, h.db, messageID, userID)
+	} else {
+		message, changed, err = database.UnpinMessage(ctx, h.db, messageID)
+	}
+	if err != nil {
+		if errors.Is(err, database.ErrMessageNotFound) || errors.Is(err, database.ErrTooManyPins) {
+			return database.Message{}, err
+		}
+		return database.Message{}, fmt.Errorf("update pin: %w", err)
+	}
+	if changed {
+		h.broadcastPin(userID, message)
+	}
+	return message, nil
+}
+
+func (h *Hub) broadcastPin(userID int64, message database.Message) {
+	eventType := "message_unpinned"
+	if message.Pinned {
+		eventType = "message_pinned"
+	}
+	encoded, err := json.Marshal(outboundEvent{Type: eventType, Data: pinData{ChannelID: message.ChannelID, UserID: userID, Message: message}})
+	if err != nil {
+		return
+	}
+	h.broadcastToChannel(message.ChannelID, encoded)
+}
@@ -0,0 +1,284 @@
+package realtime
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"openvoice/internal/database"
+)
+
+const (
+	// idleAfter is how long a connection may go without sending anything
+	// before it counts as idle.
+	idleAfter = 5 * time.Minute
+	// presenceSweepInterval bounds how late auto-idle and custom status
+	// expiry are noticed.
+	presenceSweepInterval = 30 * time.Second
+)
+
+// Presence is what a user currently shows to others.
+type Presence struct {
+	UserID       int64                  `json:"user_id"`
+	Status       string                 `json:"status"`
+	CustomStatus *database.CustomStatus `json:"custom_status,omitempty"`
+}
+
+// userPresence tracks the chosen settings of a connected user next to the
+// presence last published to others and to themselves, so updates only go
+// out on change.
+type userPresence struct {
+	settings  database.PresenceSettings
+	published Presence
+	own       Presence
+}
+
+// customStatusInput is the custom_status field of set_presence. An empty
+// text clears the status.
+type customStatusInput struct {
+	Text      string     `json:"text"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// presenceSettings returns the chosen settings of a user who is
+// connecting, from another of their connections if there is one and from
+// the database otherwise.
+func (h *Hub) presenceSettings(userID int64) database.PresenceSettings {
+	h.mu.Lock()
+	state, cached := h.presence[userID]
+	var settings database.PresenceSettings
+	if cached {
+		settings = state.settings
+	}
+	h.mu.Unlock()
+	if cached {
+		return settings
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	settings, err := database.GetPresenceSettings(ctx, h.db, userID)
+	if err != nil {
+		log.Printf("load presence for user %d: %v", userID, err)
+		return database.PresenceSettings{Status: database.PresenceOnline}
+	}
+	return settings
+}
+
+// trackPresenceLocked starts tracking a connecting user. h.mu must be held.
+func (h *Hub) trackPresenceLocked(userID int64, settings database.PresenceSettings) {
+	if _, ok := h.presence[userID]; ok {
+		return
+	}
+	offline := Presence{UserID: userID, Status: database.PresenceOffline}
+	h.presence[userID] = &userPresence{settings: settings, published: offline, own: offline}
+}
+
+// setPresence handles set_presence. Status and custom status are each
+// optional; whatever is given replaces the saved value for every one of the
+// user's connections.
+func (h *Hub) setPresence(client *Client, evt inboundEvent) error {
+	if evt.Status == "" && evt.CustomStatus == nil {
+		return fmt.Errorf("status or custom_status is required")
+	}
+	if evt.Status != "" && !database.IsSelectablePresence(evt.Status) {
+		return database.ErrInvalidPresence
+	}
+
+	var custom *database.CustomStatus
+	if evt.CustomStatus != nil {
+		text := strings.TrimSpace(evt.CustomStatus.Text)
+		if utf8.RuneCountInString(text) > database.MaxCustomStatusLength {
+			return database.ErrInvalidCustomStatus
+		}
+		if evt.CustomStatus.ExpiresAt != nil && !evt.CustomStatus.ExpiresAt.After(time.Now()) {
+			return database.ErrInvalidCustomStatus
+		}
+		if text != "" {
+			custom = &database.CustomStatus{Text: text, ExpiresAt: evt.CustomStatus.ExpiresAt}
+		}
+	}
+
+	userID := client.user.ID
+	h.mu.Lock()
+	state, ok := h.presence[userID]
+	if !ok {
+		h.mu.Unlock()
+		return fmt.Errorf("presence is not loaded")
+	}
+	settings := state.settings
+	h.mu.Unlock()
+
+	if evt.Status != "" {
+		settings.Status = evt.Status
+	}
+	if evt.CustomStatus != nil {
+		settings.CustomStatus = custom
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := database.SavePresenceSettings(ctx, h.db, userID, settings); err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	if state, ok := h.presence[userID]; ok {
+		state.settings = settings
+	}
+	client.lastActive = time.Now()
+	client.idle = false
+	h.mu.Unlock()
+
+	h.refreshPresence(userID)
+	return nil
+}
+
+// markActive records inbound traffic on a connection, bringing the user
+// back from auto-idle if this was their only active connection.
+func (h *Hub) markActive(client *Client) {
+	h.mu.Lock()
+	client.lastActive = time.Now()
+	wasIdle := client.idle
+	client.idle = false
+	h.mu.Unlock()
+
+	if wasIdle {
+		h.refreshPresence(client.user.ID)
+	}
+}
+
+// sweepPresence runs for the life of the hub, marking quiet connections
+// idle and dropping custom statuses that have expired.
+func (h *Hub) sweepPresence() {
+	ticker := time.NewTicker(presenceSweepInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		changed := make(map[int64]struct{})
+
+		h.mu.Lock()
+		for client := range h.clients {
+			if !client.idle && now.Sub(client.lastActive) >= idleAfter {
+				client.idle = true
+				changed[client.user.ID] = struct{}{}
+			}
+		}
+		for userID, state := range h.presence {
+			if state.settings.CustomStatus.Expired(now) {
+				state.settings.CustomStatus = nil
+				changed[userID] = struct{}{}
+			}
+		}
+		h.mu.Unlock()
+
+		for userID := range changed {
+			h.refreshPresence(userID)
+		}
+	}
+}
+
+// refreshPresence recomputes userID's presence across their connections
+// and broadcasts presence_update to everyone if it changed. The user's own
+// connections see their real status; everyone else sees invisible users as
+// offline.
+func (h *Hub) refreshPresence(userID int64) {
+	h.mu.Lock()
+	state, ok := h.presence[userID]
+	if !ok {
+		h.mu.Unlock()
+		return
+	}
+
+	connections, active := len(h.userClients[userID]), 0
+	for client := range h.userClients[userID] {
+		if !client.idle {
+			active++
+		}
+	}
+
+	own := Presence{UserID: userID, Status: state.settings.Status, CustomStatus: state.settings.CustomStatus}
+	if own.Status == database.PresenceOnline && active == 0 {
+		own.Status = database.PresenceIdle
+	}
+	public := own
+	if connections == 0 || own.Status == database.PresenceInvisible {
+		public = Presence{UserID: userID, Status: database.PresenceOffline}
+	}
+	if connections == 0 {
+		own = public
+		delete(h.presence, userID)
+	}
+
+	publicChanged := !samePresence(state.published, public)
+	ownChanged := !samePresence(state.own, own)
+	state.published, state.own = public, own
+
+	targets := make([]*Client, 0, len(h.clients))
+	for client := range h.clients {
+		if publicChanged || (ownChanged && client.user.ID == userID) {
+			targets = append(targets, client)
+		}
+	}
+	h.mu.Unlock()
+	if len(targets) == 0 {
+		return
+	}
+
+	ownPayload, err := json.Marshal(outboundEvent{Type: "presence_update", Data: own})
+	if err != nil {
+		log.Printf("marshal presence_update: %v", err)
+		return
+	}
+	publicPayload, err := json.Marshal(outboundEvent{Type: "presence_update", Data: public})
+	if err != nil {
+		log.Printf("marshal presence_update: %v", err)
+		return
+	}
+
+	for _, client := range targets {
+		payload := publicPayload
+		if client.user.ID == userID {
+			payload = ownPayload
+		}
+		client.enqueue(payload)
+	}
+}
+
+// PresenceOf returns the presence of every connected user as viewerID
+// sees it. Users missing from the result are offline.
+func (h *Hub) PresenceOf(viewerID int64) map[int64]Presence {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	presences := make(map[int64]Presence, len(h.presence))
+	for userID, state := range h.presence {
+		if userID == viewerID {
+			presences[userID] = state.own
+		} else {
+			presences[userID] = state.published
+		}
+	}
+	return presences
+}
+
+func samePresence(a, b Presence) bool {
+	if a.Status != b.Status {
+		return false
+	}
+	if a.CustomStatus == nil || b.CustomStatus == nil {
+		return a.CustomStatus == nil && b.CustomStatus == nil
+	}
+	if a.CustomStatus.Text != b.CustomStatus.Text {
+		return false
+	}
+	if a.CustomStatus.ExpiresAt == nil || b.CustomStatus.ExpiresAt == nil {
+		return a.CustomStatus.ExpiresAt == nil && b.CustomStatus.ExpiresAt == nil
+	}
+	return a.CustomStatus.ExpiresAt.Equal(*b.CustomStatus.ExpiresAt)
+}
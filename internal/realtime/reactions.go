@@ -0,0 +1,88 @@
+package realtime
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"openvoice/internal/database"
+	"openvoice/internal/permissions"
+)
+
+// reactionData describes one user's reaction changing, along with the new
+// total for that emoji so clients need not count themselves.
+type reactionData struct {
+	MessageID int64  `json:"message_id"`
+	ChannelID int64  `json:"channel_id"`
+	ThreadID  *int64 `json:"thread_id,omitempty"`
+	UserID    int64  `json:"user_id"`
+	Emoji     string `json:"emoji"`
+	Count     int    `json:"count"`
+}
+
+// addReaction reacts to a message on behalf of the client. Reacting is
+// allowed wherever the user may post, including announcement channels.
+func (h *Hub) addReaction(client *Client, evt inboundEvent) error {
+	return h.changeReaction(client, evt, true)
+}
+
+func (h *Hub) removeReaction(client *Client, evt inboundEvent) error {
+	return h.changeReaction(client, evt, false)
+}
+
+func (h *Hub) changeReaction(client *Client, evt inboundEvent, add bool) error {
+	emoji, err := database.NormalizeEmoji(evt.Emoji)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	message, err := database.GetMessage(ctx, h.db, evt.MessageID)
+	if err != nil {
+		return err
+	}
+	if err := h.authorize(client.user.ID, message.ChannelID, permissions.ViewChannel|permissions.SendMessages); err != nil {
+		return err
+	}
+
+	eventType := "reaction_added"
+	var changed bool
+	if add {
+		changed, err = database.AddReaction(ctx, h.db, message.ID, client.user.ID, emoji)
+	} else {
+		eventType = "reaction_removed"
+		changed, err = database.RemoveReaction(ctx, h.db, message.ID, client.user.ID, emoji)
+	}
+	if err != nil {
+		if errors.Is(err, database.ErrMessageNotFound) || errors.Is(err, database.ErrTooManyReactions) {
+			return err
+		}
+		return fmt.Errorf("update reaction: %w", err)
+	}
+	if !changed {
+		return nil
+	}
+
+	count, err := database.ReactionCountFor(ctx, h.db, message.ID, emoji)
+	if err != nil {
+		return err
+	}
+
+	encoded, err := json.Marshal(outboundEvent{Type: eventType, Data: reactionData{
+		MessageID: message.ID,
+		ChannelID: message.ChannelID,
+		ThreadID:  message.ThreadID,
+		UserID:    client.user.ID,
+		Emoji:     emoji,
+		Count:     count,
+	}})
+	if err != nil {
+		return fmt.Errorf("marshal %s: %w", eventType, err)
+	}
+	h.broadcastMessageEvent(message, encoded)
+	return nil
+}
@@ -0,0 +1,84 @@
+package realtime
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"openvoice/internal/database"
+	"openvoice/internal/permissions"
+)
+
+// ackChannel moves the client's read marker in a channel and tells all of
+// the user's connections, so other devices clear their badges too.
+func (h *Hub) ackChannel(client *Client, evt inboundEvent) error {
+	if evt.ChannelID <= 0 {
+		return fmt.Errorf("invalid channel id")
+	}
+	if err := h.authorize(client.user.ID, evt.ChannelID, permissions.ViewChannel); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	state, err := database.AckChannel(ctx, h.db, client.user.ID, evt.ChannelID, evt.MessageID)
+	if err != nil {
+		if errors.Is(err, database.ErrMessageNotFound) {
+			return err
+		}
+		return fmt.Errorf("ack channel: %w", err)
+	}
+	return h.SendToUsers([]int64{client.user.ID}, "unread_update", state)
+}
+
+// pushUnreadUpdates refreshes the badges of a channel after a new message.
+// Top-level messages reach every connected user who can see the channel;
+// thread messages only change the counts of the users they mention. The
+// author's marker moves past their own message first. Connections already
+// viewing the channel are skipped because they see the message arrive.
+func (h *Hub) pushUnreadUpdates(message database.Message, recipients []int64) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	targets := recipients
+	if message.ThreadID == nil {
+		if _, err := database.AckChannel(ctx, h.db, message.UserID, message.ChannelID, message.ID); err != nil {
+			log.Printf("ack own message %d: %v", message.ID, err)
+		}
+		targets = h.ChannelViewers(message.ChannelID)
+	}
+
+	states, err := database.ChannelReadStates(ctx, h.db, message.ChannelID, targets)
+	if err != nil {
+		log.Printf("read states on channel %d: %v", message.ChannelID, err)
+		return
+	}
+	for _, userID := range targets {
+		encoded, err := json.Marshal(outboundEvent{Type: "unread_update", Data: states[userID]})
+		if err != nil {
+			continue
+		}
+		h.sendToUserElsewhere(userID, message.ChannelID, encoded)
+	}
+}
+
+// sendToUserElsewhere delivers data to the connections of userID that are
+// not viewing channelID.
+func (h *Hub) sendToUserElsewhere(userID, channelID int64, data []byte) {
+	h.mu.Lock()
+	targets := make([]*Client, 0)
+	for client := range h.userClients[userID] {
+		if client.channelID != channelID {
+			targets = append(targets, client)
+		}
+	}
+	h.mu.Unlock()
+
+	for _, client := range targets {
+		client.enqueue(data)
+	}
+}
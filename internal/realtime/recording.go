@@ -0,0 +1,185 @@
+package realtime
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"openvoice/internal/database"
+	"openvoice/internal/permissions"
+	"openvoice/internal/sfu"
+)
+
+var (
+	errAlreadyRecording = errors.New("this voice channel is already being recorded")
+	errNotRecording     = errors.New("this voice channel is not being recorded")
+)
+
+// startRecording handles start_recording. Everyone following the channel,
+// and everyone who joins its voice room later, is told that it is being
+// recorded before any media is written.
+func (h *Hub) startRecording(client *Client, evt inboundEvent) error {
+	channelID := evt.ChannelID
+	if channelID <= 0 {
+		channelID = client.voiceChannelID
+	}
+	if channelID <= 0 {
+		return fmt.Errorf("channel is required")
+	}
+	if err := h.authorize(client.user.ID, channelID, permissions.RecordVoice); err != nil {
+		return err
+	}
+	if err := h.requireVoiceChannel(channelID); err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	mode, active := h.voiceModes[channelID]
+	_, recording := h.recordings[channelID]
+	if active && mode == database.VoiceModeSFU && !recording {
+		// Hold the slot while the row is created.
+		h.recordings[channelID] = nil
+	}
+	h.mu.Unlock()
+	switch {
+	case !active:
+		return fmt.Errorf("nobody is in this voice channel")
+	case mode != database.VoiceModeSFU:
+		return fmt.Errorf("%w: only channels whose media goes through the server can be recorded", errVoiceModeMismatch)
+	case recording:
+		return errAlreadyRecording
+	}
+
+	video := evt.Video != nil && *evt.Video
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rec, err := database.CreateRecording(ctx, h.db, channelID, client.user.ID, video)
+	if err != nil {
+		h.releaseRecording(channelID, nil)
+		log.Printf("create recording of channel %d: %v", channelID, err)
+		return fmt.Errorf("could not start recording")
+	}
+
+	h.mu.Lock()
+	h.recordings[channelID] = &rec
+	h.mu.Unlock()
+
+	// Consent comes first: nothing is written until the room knows.
+	if err := h.broadcastRecording(channelID, "recording_started", rec); err != nil {
+		log.Printf("announce recording %d: %v", rec.ID, err)
+	}
+
+	name := strconv.FormatInt(rec.ID, 10)
+	err = h.media.StartRecording(channelID, name, video, func(tracks []sfu.RecordedTrack) {
+		h.finishRecording(channelID, rec.ID, tracks)
+	})
+	if err != nil {
+		// The room emptied in the meantime; close the recording with no
+		// files so the announcement is followed by a stop.
+		if !errors.Is(err, sfu.ErrRoomEmpty) {
+			log.Printf("start recording %d of channel %d: %v", rec.ID, channelID, err)
+		}
+		h.finishRecording(channelID, rec.ID, nil)
+		return fmt.Errorf("could not start recording")
+	}
+	log.Printf("user %d started recording %d of voice channel %d", client.user.ID, rec.ID, channelID)
+	return nil
+}
+
+// stopRecording handles stop_recording. The recording is finished by the
+// time the media server returns.
+func (h *Hub) stopRecording(client *Client, evt inboundEvent) error {
+	channelID := evt.ChannelID
+	if channelID <= 0 {
+		channelID = client.voiceChannelID
+	}
+	if channelID <= 0 {
+		return fmt.Errorf("channel is required")
+	}
+	if err := h.authorize(client.user.ID, channelID, permissions.RecordVoice); err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	rec := h.recordings[channelID]
+	h.mu.Unlock()
+	if rec == nil {
+		return errNotRecording
+	}
+	if !h.media.StopRecording(channelID) {
+		return errNotRecording
+	}
+	log.Printf("user %d stopped recording %d of voice channel %d", client.user.ID, rec.ID, channelID)
+	return nil
+}
+
+// finishRecording stores the files of a recording that ended, whether it
+// was stopped or its room emptied, and tells the channel.
+func (h *Hub) finishRecording(channelID, recordingID int64, tracks []sfu.RecordedTrack) {
+	h.releaseRecording(channelID, &recordingID)
+
+	stored := make([]database.RecordingTrack, 0, len(tracks))
+	for _, track := range tracks {
+		stored = append(stored, database.RecordingTrack{
+			UserID:    track.UserID,
+			Kind:      track.Kind,
+			FileName:  track.FileName,
+			Size:      track.Size,
+			StartedAt: track.StartedAt,
+			EndedAt:   track.EndedAt,
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rec, err := database.FinishRecording(ctx, h.db, recordingID, stored)
+	if errors.Is(err, database.ErrRecordingNotFound) {
+		// The channel was deleted along with its recordings.
+		return
+	}
+	if err != nil {
+		log.Printf("finish recording %d: %v", recordingID, err)
+		return
+	}
+	if err := h.broadcastRecording(channelID, "recording_stopped", rec); err != nil {
+		log.Printf("announce end of recording %d: %v", recordingID, err)
+	}
+}
+
+// releaseRecording frees the channel's recording slot, provided it still
+// belongs to recordingID; nil releases a slot that was only reserved.
+func (h *Hub) releaseRecording(channelID int64, recordingID *int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	current, ok := h.recordings[channelID]
+	if !ok {
+		return
+	}
+	if (recordingID == nil && current == nil) || (recordingID != nil && current != nil && current.ID == *recordingID) {
+		delete(h.recordings, channelID)
+	}
+}
+
+func (h *Hub) broadcastRecording(channelID int64, eventType string, rec database.Recording) error {
+	encoded, err := json.Marshal(outboundEvent{Type: eventType, Data: rec})
+	if err != nil {
+		return fmt.Errorf("marshal %s: %w", eventType, err)
+	}
+	h.broadcastToChannel(channelID, encoded)
+	return nil
+}
+
+// activeRecordingLocked returns the recording running in channelID, if
+// any. h.mu must be held.
+func (h *Hub) activeRecordingLocked(channelID int64) *database.Recording {
+	rec := h.recordings[channelID]
+	if rec == nil {
+		return nil
+	}
+	copied := *rec
+	return &copied
+}
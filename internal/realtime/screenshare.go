@@ -0,0 +1,168 @@
+package realtime
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"openvoice/internal/database"
+	"openvoice/internal/sfu"
+)
+
+const (
+	// maxScreenShares caps how many participants of one voice channel can
+	// share their screen at the same time.
+	maxScreenShares = 2
+	// maxStreamIDLength bounds the stream id a sharer announces.
+	maxStreamIDLength = 64
+)
+
+var (
+	errScreenShareLimit = fmt.Errorf("at most %d people can share their screen in a voice channel at once", maxScreenShares)
+	errNotSharing       = errors.New("that user is not sharing their screen")
+	errScreenShareFlag  = errors.New("screen sharing is started with start_screen_share and ended with stop_screen_share")
+)
+
+// screenShareWatchData tells a sharer that a viewer started or stopped
+// watching their screen. In mesh mode the sharer adds or removes the
+// screen track on its connection to that viewer.
+type screenShareWatchData struct {
+	ChannelID int64  `json:"channel_id"`
+	UserID    int64  `json:"user_id"`
+	Username  string `json:"username"`
+	Watching  bool   `json:"watching"`
+}
+
+// startScreenShare handles start_screen_share. stream_id is the stream the
+// client sends its screen in; it labels the share in voice state and in
+// signals so receivers can tell it from camera video. Through the SFU the
+// share is forwarded in a stream of its own, and voice state carries that
+// one instead.
+func (h *Hub) startScreenShare(client *Client, evt inboundEvent) error {
+	streamID := strings.TrimSpace(evt.StreamID)
+	if streamID == "" {
+		return fmt.Errorf("stream_id is required to share your screen")
+	}
+	if len(streamID) > maxStreamIDLength {
+		return fmt.Errorf("stream_id must be at most %d characters", maxStreamIDLength)
+	}
+
+	h.mu.Lock()
+	channelID := client.voiceChannelID
+	if channelID <= 0 {
+		h.mu.Unlock()
+		return fmt.Errorf("join a voice channel before sharing your screen")
+	}
+	if !client.voiceState.ScreenShare {
+		sharing := 0
+		for member := range h.voice[channelID] {
+			if member.voiceState.ScreenShare {
+				sharing++
+			}
+		}
+		if sharing >= maxScreenShares {
+			h.mu.Unlock()
+			return errScreenShareLimit
+		}
+	}
+	viaMedia := h.voiceModes[channelID] == database.VoiceModeSFU
+	before := client.voiceState
+	client.voiceState.ScreenShare = true
+	client.voiceState.ScreenShareStreamID = streamID
+	if viaMedia {
+		client.voiceState.ScreenShareStreamID = sfu.ScreenStreamID(client.user.ID)
+	}
+	state := client.voiceState
+	h.mu.Unlock()
+
+	if viaMedia {
+		if err := h.media.SetScreenShare(channelID, client.user.ID, streamID); err != nil {
+			h.mu.Lock()
+			if client.voiceChannelID == channelID {
+				client.voiceState.ScreenShare = before.ScreenShare
+				client.voiceState.ScreenShareStreamID = before.ScreenShareStreamID
+			}
+			h.mu.Unlock()
+			return err
+		}
+	}
+	if state == before {
+		return nil
+	}
+	return h.broadcastVoiceState(channelID, state)
+}
+
+// stopScreenShare handles stop_screen_share. Stopping when not sharing is
+// not an error.
+func (h *Hub) stopScreenShare(client *Client) error {
+	h.mu.Lock()
+	channelID := client.voiceChannelID
+	if channelID <= 0 || !client.voiceState.ScreenShare {
+		h.mu.Unlock()
+		return nil
+	}
+	viaMedia := h.voiceModes[channelID] == database.VoiceModeSFU
+	client.voiceState.ScreenShare = false
+	client.voiceState.ScreenShareStreamID = ""
+	state := client.voiceState
+	h.mu.Unlock()
+
+	if viaMedia {
+		if err := h.media.SetScreenShare(channelID, client.user.ID, ""); err != nil && !errors.Is(err, sfu.ErrNotInRoom) {
+			log.Printf("end screen share of user %d in channel %d: %v", client.user.ID, channelID, err)
+		}
+	}
+	return h.broadcastVoiceState(channelID, state)
+}
+
+// watchScreenShare handles watch_screen_share and unwatch_screen_share.
+// Nobody receives a screen share until they ask for it.
+func (h *Hub) watchScreenShare(client *Client, evt inboundEvent, watch bool) error {
+	if evt.UserID <= 0 {
+		return fmt.Errorf("user_id is required")
+	}
+	if evt.UserID == client.user.ID {
+		return fmt.Errorf("you cannot watch your own screen share")
+	}
+
+	h.mu.Lock()
+	channelID := client.voiceChannelID
+	if channelID <= 0 {
+		h.mu.Unlock()
+		return fmt.Errorf("join a voice channel before watching a screen share")
+	}
+	viaMedia := h.voiceModes[channelID] == database.VoiceModeSFU
+	sharers := make([]*Client, 0, 1)
+	for member := range h.voice[channelID] {
+		if member.user.ID == evt.UserID && member.voiceState.ScreenShare {
+			sharers = append(sharers, member)
+		}
+	}
+	h.mu.Unlock()
+	if len(sharers) == 0 {
+		if !watch {
+			return nil
+		}
+		return errNotSharing
+	}
+
+	if viaMedia {
+		if err := h.media.WatchScreenShare(channelID, client.user.ID, evt.UserID, watch); err != nil {
+			return err
+		}
+	}
+
+	encoded, err := json.Marshal(outboundEvent{Type: "screen_share_watch", Data: screenShareWatchData{
+		ChannelID: channelID,
+		UserID:    client.user.ID,
+		Username:  client.user.Username,
+		Watching:  watch,
+	}})
+	if err != nil {
+		return fmt.Errorf("marshal screen_share_watch: %w", err)
+	}
+	h.deliver(sharers, encoded)
+	return nil
+}
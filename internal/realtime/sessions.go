@@ -0,0 +1,227 @@
+package realtime
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// replayBufferSize is how many recent events a session keeps for
+	// resume. It stays below the send buffer so a replay never blocks.
+	replayBufferSize = 200
+	// resumeWindow is how long a session outlives its socket.
+	resumeWindow = 2 * time.Minute
+)
+
+type replayEntry struct {
+	seq     uint64
+	payload []byte
+}
+
+type helloData struct {
+	SessionID string `json:"session_id"`
+	Seq       uint64 `json:"seq"`
+}
+
+type resumedData struct {
+	SessionID string `json:"session_id"`
+	Seq       uint64 `json:"seq"`
+	Replayed  int    `json:"replayed"`
+}
+
+type resumeFailedData struct {
+	SessionID string `json:"session_id"`
+	Reason    string `json:"reason"`
+}
+
+func newSessionID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("generate session id: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// enqueue stamps payload with the session's next sequence number, keeps it
+// for replay and queues it on the socket. It reports false when the socket
+// is not keeping up; the event can still be replayed after a resume.
+func (c *Client) enqueue(payload []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.seq++
+	framed := sequenced(payload, c.seq)
+	c.replay = append(c.replay, replayEntry{seq: c.seq, payload: framed})
+	if len(c.replay) > replayBufferSize {
+		c.replay = c.replay[len(c.replay)-replayBufferSize:]
+	}
+	if c.detached {
+		return true
+	}
+
+	select {
+	case c.send <- framed:
+		return true
+	default:
+		return false
+	}
+}
+
+// sendDirect queues a session control event, which carries no sequence
+// number and is never replayed.
+func (c *Client) sendDirect(eventType string, data any) {
+	payload, err := json.Marshal(outboundEvent{Type: eventType, Data: data})
+	if err != nil {
+		log.Printf("marshal %s: %v", eventType, err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.detached {
+		return
+	}
+	select {
+	case c.send <- payload:
+	default:
+	}
+}
+
+func (c *Client) closeConn() {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	_ = conn.Close()
+}
+
+// sequenced sets the seq field of an encoded outboundEvent. Broadcasts
+// encode an event once for every recipient, so the per-connection number
+// is spliced in rather than re-encoding the whole event.
+func sequenced(payload []byte, seq uint64) []byte {
+	if len(payload) < 2 || payload[0] != '{' {
+		return payload
+	}
+	framed := make([]byte, 0, len(payload)+24)
+	framed = append(framed, `{"seq":`...)
+	framed = strconv.AppendUint(framed, seq, 10)
+	framed = append(framed, ',')
+	return append(framed, payload[1:]...)
+}
+
+// detachClient is called when the socket conn of a session goes away. The
+// session keeps its subscriptions and buffers events for resumeWindow so a
+// reconnecting client can pick up where it left off; after that it is
+// removed. Nothing happens if the session has already moved to another
+// socket or been removed.
+func (h *Hub) detachClient(client *Client, conn *websocket.Conn) {
+	h.mu.Lock()
+	_, live := h.clients[client]
+	h.mu.Unlock()
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if !live || client.detached || client.conn != conn {
+		return
+	}
+	client.detached = true
+	close(client.send)
+	client.expiry = time.AfterFunc(resumeWindow, func() { h.expireSession(client) })
+}
+
+func (h *Hub) expireSession(client *Client) {
+	client.mu.Lock()
+	detached := client.detached
+	client.mu.Unlock()
+	if detached {
+		h.removeClient(client)
+	}
+}
+
+// resume moves the socket of a freshly connected client onto the session it
+// names and replays every event after evt.Seq. It returns the client that
+// now owns the socket: the resumed session, or the fresh client when resume
+// failed and it has been told to refetch.
+func (h *Hub) resume(client *Client, evt inboundEvent) *Client {
+	h.mu.Lock()
+	session, ok := h.sessions[evt.SessionID]
+	h.mu.Unlock()
+	if !ok || session == client || session.user.ID != client.user.ID {
+		client.sendDirect("resume_failed", resumeFailedData{SessionID: evt.SessionID, Reason: "session not found"})
+		return client
+	}
+
+	// The old socket may be half-open and not noticed yet.
+	session.mu.Lock()
+	oldConn, detached := session.conn, session.detached
+	session.mu.Unlock()
+	if !detached {
+		_ = oldConn.Close()
+		h.detachClient(session, oldConn)
+	}
+
+	session.mu.Lock()
+	oldest := session.seq + 1
+	if len(session.replay) > 0 {
+		oldest = session.replay[0].seq
+	}
+	if !session.detached || evt.Seq > session.seq || evt.Seq+1 < oldest {
+		session.mu.Unlock()
+		client.sendDirect("resume_failed", resumeFailedData{SessionID: evt.SessionID, Reason: "missed events are no longer available"})
+		return client
+	}
+
+	missed := make([][]byte, 0, len(session.replay)+1)
+	for _, entry := range session.replay {
+		if entry.seq > evt.Seq {
+			missed = append(missed, entry.payload)
+		}
+	}
+	replayed := len(missed)
+	resumed, err := json.Marshal(outboundEvent{Type: "resumed", Data: resumedData{SessionID: session.sessionID, Seq: session.seq, Replayed: replayed}})
+	if err != nil {
+		session.mu.Unlock()
+		log.Printf("marshal resumed: %v", err)
+		client.sendDirect("resume_failed", resumeFailedData{SessionID: evt.SessionID, Reason: "internal error"})
+		return client
+	}
+	missed = append([][]byte{resumed}, missed...)
+	if len(missed) > cap(client.send) {
+		session.mu.Unlock()
+		client.sendDirect("resume_failed", resumeFailedData{SessionID: evt.SessionID, Reason: "missed events do not fit the send buffer"})
+		return client
+	}
+
+	// From here on the fresh client only buffers, so anything still being
+	// broadcast to it cannot interleave with the replay. What it has queued
+	// carries its own sequence numbers, so it is dropped rather than
+	// delivered ahead of the replay, which leaves the whole buffer free.
+	client.mu.Lock()
+	client.detached = true
+	conn, send := client.conn, client.send
+	client.mu.Unlock()
+	for drained := false; !drained; {
+		select {
+		case <-send:
+		default:
+			drained = true
+		}
+	}
+
+	session.expiry.Stop()
+	session.conn, session.send, session.detached = conn, send, false
+	for _, payload := range missed {
+		send <- payload
+	}
+	session.mu.Unlock()
+
+	h.removeClient(client)
+	log.Printf("user %d resumed session after seq %d, replayed %d events", session.user.ID, evt.Seq, replayed)
+	return session
+}
@@ -0,0 +1,175 @@
+package realtime
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"openvoice/internal/database"
+	"openvoice/internal/permissions"
+)
+
+// maxSubscriptions caps how many channels one connection can follow at
+// once, counting the channel it is viewing.
+const maxSubscriptions = 200
+
+var errTooManySubscriptions = fmt.Errorf("a connection can subscribe to at most %d channels", maxSubscriptions)
+
+type subscriptionsData struct {
+	ChannelIDs []int64 `json:"channel_ids"`
+}
+
+// subscribe adds channels to the set a connection receives events for,
+// without changing the channel it is viewing. The reply lists every channel
+// the connection is now subscribed to.
+func (h *Hub) subscribe(client *Client, evt inboundEvent) error {
+	channelIDs := eventChannelIDs(evt)
+	if len(channelIDs) == 0 {
+		return fmt.Errorf("channel_ids is required")
+	}
+	if len(channelIDs) > maxSubscriptions {
+		return errTooManySubscriptions
+	}
+	if err := h.authorizeChannels(client.user.ID, channelIDs); err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	added := 0
+	for _, channelID := range channelIDs {
+		if _, ok := h.channels[channelID][client]; !ok {
+			added++
+		}
+	}
+	if len(h.subscriptionsLocked(client))+added > maxSubscriptions {
+		h.mu.Unlock()
+		return errTooManySubscriptions
+	}
+	for _, channelID := range channelIDs {
+		client.subscriptions[channelID] = struct{}{}
+		h.addToChannelLocked(client, channelID)
+	}
+	current := h.subscriptionsLocked(client)
+	h.mu.Unlock()
+
+	return h.sendSubscriptions(client, "subscribed", current)
+}
+
+// authorizeChannels requires userID to hold ViewChannel in every one of
+// channelIDs, checked in a single query. The first channel that fails is
+// checked again on its own to report why.
+func (h *Hub) authorizeChannels(userID int64, channelIDs []int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	visible, err := database.FilterVisibleChannels(ctx, h.db, permissions.VisibleChannels(userID), channelIDs)
+	if err != nil {
+		log.Printf("visibility check for user %d on %d channels failed: %v", userID, len(channelIDs), err)
+		return database.ErrChannelNotFound
+	}
+	if len(visible) == len(channelIDs) {
+		return nil
+	}
+
+	allowed := make(map[int64]struct{}, len(visible))
+	for _, id := range visible {
+		allowed[id] = struct{}{}
+	}
+	for _, channelID := range channelIDs {
+		if _, ok := allowed[channelID]; ok {
+			continue
+		}
+		if err := h.authorize(userID, channelID, permissions.ViewChannel); err != nil {
+			return fmt.Errorf("subscribe to channel %d: %w", channelID, err)
+		}
+		return fmt.Errorf("subscribe to channel %d: %w", channelID, permissions.ErrForbidden)
+	}
+	return nil
+}
+
+// unsubscribe stops channel events for channels added with subscribe. The
+// channel being viewed stays subscribed until the connection switches away.
+func (h *Hub) unsubscribe(client *Client, evt inboundEvent) error {
+	channelIDs := eventChannelIDs(evt)
+	if len(channelIDs) == 0 {
+		return fmt.Errorf("channel_ids is required")
+	}
+
+	h.mu.Lock()
+	for _, channelID := range channelIDs {
+		delete(client.subscriptions, channelID)
+		if client.channelID != channelID {
+			h.removeFromChannelLocked(client, channelID)
+		}
+	}
+	current := h.subscriptionsLocked(client)
+	h.mu.Unlock()
+
+	return h.sendSubscriptions(client, "unsubscribed", current)
+}
+
+func (h *Hub) sendSubscriptions(client *Client, eventType string, channelIDs []int64) error {
+	payload, err := json.Marshal(outboundEvent{Type: eventType, Data: subscriptionsData{ChannelIDs: channelIDs}})
+	if err != nil {
+		return fmt.Errorf("marshal %s: %w", eventType, err)
+	}
+	client.enqueue(payload)
+	return nil
+}
+
+// subscriptionsLocked lists the channels client receives events for, in
+// ascending order. h.mu must be held.
+func (h *Hub) subscriptionsLocked(client *Client) []int64 {
+	ids := make([]int64, 0, len(client.subscriptions)+1)
+	for channelID, members := range h.channels {
+		if _, ok := members[client]; ok {
+			ids = append(ids, channelID)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func (h *Hub) addToChannelLocked(client *Client, channelID int64) {
+	if _, ok := h.channels[channelID]; !ok {
+		h.channels[channelID] = make(map[*Client]struct{})
+	}
+	h.channels[channelID][client] = struct{}{}
+}
+
+func (h *Hub) removeFromChannelLocked(client *Client, channelID int64) {
+	members, ok := h.channels[channelID]
+	if !ok {
+		return
+	}
+	delete(members, client)
+	if len(members) == 0 {
+		delete(h.channels, channelID)
+	}
+}
+
+// eventChannelIDs returns the de-duplicated channel_ids of an event,
+// falling back to channel_id.
+func eventChannelIDs(evt inboundEvent) []int64 {
+	ids := evt.ChannelIDs
+	if len(ids) == 0 && evt.ChannelID > 0 {
+		ids = []int64{evt.ChannelID}
+	}
+
+	seen := make(map[int64]struct{}, len(ids))
+	unique := make([]int64, 0, len(ids))
+	for _, id := range ids {
+		if id <= 0 {
+			continue
+		}
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		unique = append(unique, id)
+	}
+	return unique
+}
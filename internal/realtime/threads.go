@@ -0,0 +1,225 @@
+package realtime
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"openvoice/internal/database"
+	"openvoice/internal/permissions"
+)
+
+const maxThreadNameLength = 100
+
+type threadHistoryData struct {
+	ThreadID     int64                    `json:"thread_id"`
+	Thread       database.Thread          `json:"thread"`
+	Participants []database.ChannelMember `json:"participants"`
+	Messages     []database.Message       `json:"messages"`
+	HasMore      bool                     `json:"has_more"`
+}
+
+type threadCountData struct {
+	ThreadID      int64      `json:"thread_id"`
+	ChannelID     int64      `json:"channel_id"`
+	MessageCount  int        `json:"message_count"`
+	LastMessageAt *time.Time `json:"last_message_at,omitempty"`
+}
+
+// createThread opens a thread from a message, or a standalone one in a
+// forum, announces it to the parent channel and subscribes its creator.
+// Content, when given, becomes the thread's first message.
+func (h *Hub) createThread(client *Client, evt inboundEvent) error {
+	name := strings.TrimSpace(evt.Name)
+	if name == "" || utf8.RuneCountInString(name) > maxThreadNameLength {
+		return fmt.Errorf("thread name must be 1-%d characters", maxThreadNameLength)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	channelID := evt.ChannelID
+	if channelID <= 0 && evt.MessageID > 0 {
+		parent, err := database.GetMessage(ctx, h.db, evt.MessageID)
+		if err != nil {
+			return err
+		}
+		channelID = parent.ChannelID
+	}
+	if channelID <= 0 {
+		return fmt.Errorf("invalid channel id")
+	}
+	if err := h.authorize(client.user.ID, channelID, permissions.ViewChannel|permissions.SendMessages); err != nil {
+		return err
+	}
+
+	thread, err := database.CreateThread(ctx, h.db, client.user.ID, channelID, evt.MessageID, name)
+	if err != nil {
+		return err
+	}
+
+	encoded, err := json.Marshal(outboundEvent{Type: "thread_created", Data: thread})
+	if err != nil {
+		return fmt.Errorf("marshal thread_created: %w", err)
+	}
+	h.broadcastToChannel(channelID, encoded)
+	h.subscribeThread(client, thread)
+
+	if strings.TrimSpace(evt.Content) != "" {
+		return h.createAndBroadcastMessage(client, channelID, evt.Content, database.MessageOptions{ThreadID: thread.ID})
+	}
+	return nil
+}
+
+// joinThread subscribes client to a thread's message stream and replies
+// with its latest history and participants.
+func (h *Hub) joinThread(client *Client, threadID int64) error {
+	thread, err := h.authorizeThread(client.user.ID, threadID)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	page, err := database.GetThreadMessages(ctx, h.db, threadID, database.HistoryQuery{})
+	if err != nil {
+		return fmt.Errorf("load thread history: %w", err)
+	}
+	participants, err := database.ThreadParticipants(ctx, h.db, threadID)
+	if err != nil {
+		return fmt.Errorf("load thread participants: %w", err)
+	}
+
+	h.subscribeThread(client, thread)
+
+	payload, err := json.Marshal(outboundEvent{Type: "thread_history", Data: threadHistoryData{
+		ThreadID:     threadID,
+		Thread:       thread,
+		Participants: participants,
+		Messages:     page.Messages,
+		HasMore:      page.HasMore,
+	}})
+	if err != nil {
+		return fmt.Errorf("marshal thread history: %w", err)
+	}
+	client.enqueue(payload)
+	return nil
+}
+
+func (h *Hub) leaveThread(client *Client, threadID int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.unsubscribeThreadLocked(client, threadID)
+}
+
+// authorizeThread loads a thread and checks that userID can view the
+// channel it belongs to.
+func (h *Hub) authorizeThread(userID, threadID int64) (database.Thread, error) {
+	if threadID <= 0 {
+		return database.Thread{}, database.ErrThreadNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	thread, err := database.GetThread(ctx, h.db, threadID)
+	if err != nil {
+		return database.Thread{}, err
+	}
+	if err := h.authorize(userID, thread.ChannelID, permissions.ViewChannel); err != nil {
+		return database.Thread{}, err
+	}
+	return thread, nil
+}
+
+func (h *Hub) subscribeThread(client *Client, thread database.Thread) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.threads[thread.ID]; !ok {
+		h.threads[thread.ID] = make(map[*Client]struct{})
+	}
+	h.threads[thread.ID][client] = struct{}{}
+	h.threadChannels[thread.ID] = thread.ChannelID
+}
+
+func (h *Hub) unsubscribeThreadLocked(client *Client, threadID int64) {
+	members, ok := h.threads[threadID]
+	if !ok {
+		return
+	}
+	delete(members, client)
+	if len(members) == 0 {
+		delete(h.threads, threadID)
+		delete(h.threadChannels, threadID)
+	}
+}
+
+// dropThreadSubscriptionsLocked unsubscribes the connections accepted by
+// match, or every connection when match is nil, from the threads of
+// channelID.
+func (h *Hub) dropThreadSubscriptionsLocked(channelID int64, match func(*Client) bool) {
+	for threadID, parent := range h.threadChannels {
+		if parent != channelID {
+			continue
+		}
+		for client := range h.threads[threadID] {
+			if match == nil || match(client) {
+				h.unsubscribeThreadLocked(client, threadID)
+			}
+		}
+	}
+}
+
+func (h *Hub) broadcastToThread(threadID int64, data []byte) {
+	h.mu.Lock()
+	members := make([]*Client, 0, len(h.threads[threadID]))
+	for client := range h.threads[threadID] {
+		members = append(members, client)
+	}
+	h.mu.Unlock()
+
+	h.deliver(members, data)
+}
+
+// broadcastMessageEvent delivers a message event to the stream the message
+// lives in: its thread's subscribers or its channel's.
+func (h *Hub) broadcastMessageEvent(message database.Message, data []byte) {
+	if message.ThreadID != nil {
+		h.broadcastToThread(*message.ThreadID, data)
+		return
+	}
+	h.broadcastToChannel(message.ChannelID, data)
+}
+
+// broadcastThreadCount tells the parent channel how busy a thread is, so
+// the summary under its parent message stays current.
+func (h *Hub) broadcastThreadCount(threadID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	thread, err := database.GetThread(ctx, h.db, threadID)
+	if err != nil {
+		if errors.Is(err, database.ErrThreadNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	encoded, err := json.Marshal(outboundEvent{Type: "thread_message_count", Data: threadCountData{
+		ThreadID:      thread.ID,
+		ChannelID:     thread.ChannelID,
+		MessageCount:  thread.MessageCount,
+		LastMessageAt: thread.LastMessageAt,
+	}})
+	if err != nil {
+		return fmt.Errorf("marshal thread_message_count: %w", err)
+	}
+	h.broadcastToChannel(thread.ChannelID, encoded)
+	return nil
+}
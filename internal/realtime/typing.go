@@ -0,0 +1,148 @@
+package realtime
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+const (
+	// typingTimeout is how long an indicator lasts after the last
+	// typing_start; clients keep sending while the user types.
+	typingTimeout = 8 * time.Second
+	// typingRateLimit is the minimum gap between typing fan-outs for one
+	// user in one stream. Faster typing_start events only extend the
+	// timeout.
+	typingRateLimit = 3 * time.Second
+)
+
+var errNotSubscribed = errors.New("join the channel or thread before typing in it")
+
+// typingKey identifies one user typing in a channel's top level or in one
+// of its threads.
+type typingKey struct {
+	channelID int64
+	threadID  int64
+	userID    int64
+}
+
+type typingState struct {
+	timer    *time.Timer
+	deadline time.Time
+	username string
+	// sentAt is when the indicator was last fanned out.
+	sentAt time.Time
+}
+
+type typingData struct {
+	ChannelID int64  `json:"channel_id"`
+	ThreadID  int64  `json:"thread_id,omitempty"`
+	UserID    int64  `json:"user_id"`
+	Username  string `json:"username"`
+	TimeoutMs int64  `json:"timeout_ms,omitempty"`
+}
+
+// startTyping records that the client's user is typing and tells everyone
+// else subscribed to the same stream. Typing is purely in memory: the
+// client must already be subscribed, which is where access was checked.
+func (h *Hub) startTyping(client *Client, evt inboundEvent) error {
+	key := typingKey{channelID: evt.ChannelID, threadID: evt.ThreadID, userID: client.user.ID}
+
+	h.mu.Lock()
+	if key.threadID > 0 {
+		if _, ok := h.threads[key.threadID][client]; !ok {
+			h.mu.Unlock()
+			return errNotSubscribed
+		}
+		key.channelID = h.threadChannels[key.threadID]
+	} else if _, ok := h.channels[key.channelID][client]; !ok {
+		h.mu.Unlock()
+		return errNotSubscribed
+	}
+
+	now := time.Now()
+	state, ok := h.typing[key]
+	if !ok {
+		state = &typingState{username: client.user.Username}
+		state.timer = time.AfterFunc(typingTimeout, func() { h.expireTyping(key) })
+		h.typing[key] = state
+	}
+	state.deadline = now.Add(typingTimeout)
+
+	limited := now.Sub(state.sentAt) < typingRateLimit
+	if !limited {
+		state.sentAt = now
+	}
+	h.mu.Unlock()
+
+	if limited {
+		return nil
+	}
+	return h.broadcastTyping("typing", key, client.user.Username, typingTimeout)
+}
+
+// stopTyping clears an indicator without announcing it, for when the
+// user's message arriving already tells clients they stopped.
+func (h *Hub) stopTyping(key typingKey) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if state, ok := h.typing[key]; ok {
+		state.timer.Stop()
+		delete(h.typing, key)
+	}
+}
+
+// expireTyping runs when an indicator's timer fires. Starts that arrived
+// since the timer was armed push the deadline out, so the timer is re-armed
+// until the user has really gone quiet.
+func (h *Hub) expireTyping(key typingKey) {
+	h.mu.Lock()
+	state, ok := h.typing[key]
+	if !ok {
+		h.mu.Unlock()
+		return
+	}
+	if remaining := time.Until(state.deadline); remaining > 0 {
+		state.timer.Reset(remaining)
+		h.mu.Unlock()
+		return
+	}
+	delete(h.typing, key)
+	h.mu.Unlock()
+
+	_ = h.broadcastTyping("typing_stop", key, state.username, 0)
+}
+
+// broadcastTyping sends a typing event to the stream in key, skipping
+// every connection of the typing user.
+func (h *Hub) broadcastTyping(eventType string, key typingKey, username string, timeout time.Duration) error {
+	encoded, err := json.Marshal(outboundEvent{Type: eventType, Data: typingData{
+		ChannelID: key.channelID,
+		ThreadID:  key.threadID,
+		UserID:    key.userID,
+		Username:  username,
+		TimeoutMs: timeout.Milliseconds(),
+	}})
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	subscribers := h.channels[key.channelID]
+	if key.threadID > 0 {
+		subscribers = h.threads[key.threadID]
+	}
+	targets := make([]*Client, 0, len(subscribers))
+	for client := range subscribers {
+		if client.user.ID != key.userID {
+			targets = append(targets, client)
+		}
+	}
+	h.mu.Unlock()
+
+	for _, client := range targets {
+		client.enqueue(encoded)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package realtime
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"openvoice/internal/database"
+)
+
+// VoiceState is one participant of a voice channel as the rest of the room
+// sees them. A ChannelID of zero means the user has left voice.
+// ScreenShareStreamID is the stream the participant's screen share arrives
+// in, set while ScreenShare is.
+type VoiceState struct {
+	UserID              int64      `json:"user_id"`
+	Username            string     `json:"username"`
+	ChannelID           int64      `json:"channel_id"`
+	SelfMute            bool       `json:"self_mute"`
+	SelfDeaf            bool       `json:"self_deaf"`
+	ServerMute          bool       `json:"server_mute"`
+	Video               bool       `json:"video"`
+	ScreenShare         bool       `json:"screen_share"`
+	ScreenShareStreamID string     `json:"screen_share_stream_id,omitempty"`
+	JoinedAt            *time.Time `json:"joined_at,omitempty"`
+}
+
+// voiceStatesData is sent to a participant as they join. Recording is set
+// while the room is being recorded.
+type voiceStatesData struct {
+	ChannelID    int64               `json:"channel_id"`
+	VoiceMode    string              `json:"voice_mode"`
+	Participants []VoiceState        `json:"participants"`
+	Recording    *database.Recording `json:"recording,omitempty"`
+}
+
+// VoiceStates lists the participants of a voice channel in the order they
+// joined.
+func (h *Hub) VoiceStates(channelID int64) []VoiceState {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.voiceStatesLocked(channelID)
+}
+
+func (h *Hub) voiceStatesLocked(channelID int64) []VoiceState {
+	states := make([]VoiceState, 0, len(h.voice[channelID]))
+	for client := range h.voice[channelID] {
+		states = append(states, client.voiceState)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		if !states[i].JoinedAt.Equal(*states[j].JoinedAt) {
+			return states[i].JoinedAt.Before(*states[j].JoinedAt)
+		}
+		return states[i].UserID < states[j].UserID
+	})
+	return states
+}
+
+// applyVoiceFlags copies the flags present in evt onto state. Deafening
+// also mutes, since a user who cannot hear the room should not talk to it.
+func applyVoiceFlags(state *VoiceState, evt inboundEvent) {
+	if evt.SelfMute != nil {
+		state.SelfMute = *evt.SelfMute
+	}
+	if evt.SelfDeaf != nil {
+		state.SelfDeaf = *evt.SelfDeaf
+		if state.SelfDeaf {
+			state.SelfMute = true
+		}
+	}
+	if evt.Video != nil {
+		state.Video = *evt.Video
+	}
+}
+
+// updateVoiceState handles voice_state_update from a participant changing
+// their own mute, deafen or video flags.
+func (h *Hub) updateVoiceState(client *Client, evt inboundEvent) error {
+	if evt.ScreenShare != nil {
+		return errScreenShareFlag
+	}
+	if evt.SelfMute == nil && evt.SelfDeaf == nil && evt.Video == nil {
+		return fmt.Errorf("no voice state fields given")
+	}
+
+	h.mu.Lock()
+	if client.voiceChannelID <= 0 {
+		h.mu.Unlock()
+		return fmt.Errorf("join a voice channel first")
+	}
+	before := client.voiceState
+	applyVoiceFlags(&client.voiceState, evt)
+	state := client.voiceState
+	h.mu.Unlock()
+
+	if state == before {
+		return nil
+	}
+	return h.broadcastVoiceState(state.ChannelID, state)
+}
+
+// broadcastVoiceState sends voice_state_update to everyone following
+// channelID, including its voice participants.
+func (h *Hub) broadcastVoiceState(channelID int64, state VoiceState) error {
+	encoded, err := json.Marshal(outboundEvent{Type: "voice_state_update", Data: state})
+	if err != nil {
+		return fmt.Errorf("marshal voice_state_update: %w", err)
+	}
+	h.broadcastToChannel(channelID, encoded)
+	return nil
+}
@@ -0,0 +1,260 @@
+package sfu
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/h264writer"
+	"github.com/pion/webrtc/v4/pkg/media/ivfwriter"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+)
+
+var (
+	ErrRoomEmpty        = errors.New("nobody is connected to this room's media server")
+	ErrAlreadyRecording = errors.New("this room is already being recorded")
+)
+
+// RecordedTrack is one file written by a recording: one track of one
+// participant, from when it was published or the recording started until
+// it ended or the recording stopped.
+type RecordedTrack struct {
+	UserID int64
+	// Kind is audio, video or screen.
+	Kind string
+	// FileName is relative to the recording's directory.
+	FileName  string
+	Size      int64
+	StartedAt time.Time
+	EndedAt   time.Time
+}
+
+// mediaWriter stores the packets of one track in a container file.
+type mediaWriter interface {
+	WriteRTP(packet *rtp.Packet) error
+	Close() error
+}
+
+// recording writes every track of a room to its own file while it runs,
+// including tracks published after it started.
+type recording struct {
+	dir   string
+	video bool
+	done  func([]RecordedTrack)
+
+	mu      sync.Mutex
+	stopped bool
+	files   []*recordedFile
+}
+
+// recordedFile receives a track like a subscriber does, taking its best
+// layer, but writes it to disk. info is guarded by the recording's mutex.
+type recordedFile struct {
+	rec    *recording
+	track  *forwardedTrack
+	sub    *subscription
+	writer mediaWriter
+	info   RecordedTrack
+}
+
+// StartRecording records the room of channelID into a directory called name
+// under the configured recordings directory. Audio is always recorded and
+// video only when asked for. The recording runs until StopRecording or
+// until everyone has left the room; done then receives the files written.
+func (s *SFU) StartRecording(channelID int64, name string, video bool, done func([]RecordedTrack)) error {
+	s.mu.Lock()
+	r, ok := s.rooms[channelID]
+	s.mu.Unlock()
+	if !ok {
+		return ErrRoomEmpty
+	}
+
+	dir := filepath.Join(s.recordingsDir, name)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("create recording directory: %w", err)
+	}
+	rec := &recording{dir: dir, video: video, done: done}
+
+	r.mu.Lock()
+	if r.recording != nil {
+		r.mu.Unlock()
+		return ErrAlreadyRecording
+	}
+	r.recording = rec
+	tracks := r.trackListLocked()
+	r.mu.Unlock()
+
+	for _, t := range tracks {
+		rec.attach(t)
+	}
+	return nil
+}
+
+// StopRecording ends the recording of channelID's room, if there is one,
+// and reports whether there was. Its done function has run by the time
+// StopRecording returns.
+func (s *SFU) StopRecording(channelID int64) bool {
+	s.mu.Lock()
+	r, ok := s.rooms[channelID]
+	s.mu.Unlock()
+	if !ok {
+		return false
+	}
+	return r.stopRecording()
+}
+
+func (r *room) stopRecording() bool {
+	r.mu.Lock()
+	rec := r.recording
+	r.recording = nil
+	r.mu.Unlock()
+	if rec == nil {
+		return false
+	}
+	rec.finish()
+	return true
+}
+
+// attach starts writing t to a new file, unless it is video and only audio
+// is being recorded.
+func (rec *recording) attach(t *forwardedTrack) {
+	if t.kind == webrtc.RTPCodecTypeVideo && !rec.video {
+		return
+	}
+	extension, open := containerFor(t.codec)
+	if open == nil {
+		log.Printf("sfu: cannot record %s, %s has no container", t.key, t.codec.MimeType)
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.recorder != nil {
+		return
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.stopped {
+		return
+	}
+
+	name := fmt.Sprintf("%d-%s-%d.%s", t.owner.userID, t.label(), len(rec.files)+1, extension)
+	writer, err := open(filepath.Join(rec.dir, name))
+	if err != nil {
+		log.Printf("sfu: record %s: %v", t.key, err)
+		return
+	}
+	f := &recordedFile{
+		rec:    rec,
+		track:  t,
+		sub:    &subscription{out: writer, current: -1, target: -1},
+		writer: writer,
+		info: RecordedTrack{
+			UserID:    t.owner.userID,
+			Kind:      t.label(),
+			FileName:  name,
+			StartedAt: time.Now().UTC(),
+		},
+	}
+	rec.files = append(rec.files, f)
+	t.recorder = f
+	t.retargetRecorderLocked()
+}
+
+// finish closes every file of the recording and hands them to done.
+func (rec *recording) finish() {
+	rec.mu.Lock()
+	rec.stopped = true
+	files := append([]*recordedFile(nil), rec.files...)
+	rec.mu.Unlock()
+
+	for _, f := range files {
+		f.track.mu.Lock()
+		if f.track.recorder == f {
+			f.track.closeRecorderLocked()
+		}
+		f.track.mu.Unlock()
+	}
+
+	tracks := make([]RecordedTrack, 0, len(files))
+	rec.mu.Lock()
+	for _, f := range files {
+		info := f.info
+		if stat, err := os.Stat(filepath.Join(rec.dir, info.FileName)); err == nil {
+			info.Size = stat.Size()
+		}
+		tracks = append(tracks, info)
+	}
+	rec.mu.Unlock()
+
+	rec.done(tracks)
+}
+
+// retargetRecorderLocked points the recorder at the best layer available.
+// t.mu must be held.
+func (t *forwardedTrack) retargetRecorderLocked() {
+	if t.recorder == nil {
+		return
+	}
+	sub := t.recorder.sub
+	level, ok := pickLevel(t.layers, levelHigh)
+	if !ok || level == sub.target {
+		return
+	}
+	sub.target = level
+	if sub.current != level {
+		t.requestKeyframeLocked(level)
+	}
+}
+
+// closeRecorderLocked finishes the file t is being recorded to. t.mu must
+// be held.
+func (t *forwardedTrack) closeRecorderLocked() {
+	f := t.recorder
+	if f == nil {
+		return
+	}
+	t.recorder = nil
+	if err := f.writer.Close(); err != nil {
+		log.Printf("sfu: close recording of %s: %v", t.key, err)
+	}
+	f.rec.mu.Lock()
+	f.info.EndedAt = time.Now().UTC()
+	f.rec.mu.Unlock()
+}
+
+// containerFor picks the file format a codec is recorded in.
+func containerFor(codec webrtc.RTPCodecCapability) (string, func(path string) (mediaWriter, error)) {
+	switch strings.ToLower(codec.MimeType) {
+	case strings.ToLower(webrtc.MimeTypeOpus):
+		channels := codec.Channels
+		if channels == 0 {
+			channels = 2
+		}
+		return "ogg", func(path string) (mediaWriter, error) {
+			return oggwriter.New(path, codec.ClockRate, channels)
+		}
+	case strings.ToLower(webrtc.MimeTypeVP8), strings.ToLower(webrtc.MimeTypeVP9), strings.ToLower(webrtc.MimeTypeAV1):
+		mimeType := map[string]string{
+			strings.ToLower(webrtc.MimeTypeVP8): webrtc.MimeTypeVP8,
+			strings.ToLower(webrtc.MimeTypeVP9): webrtc.MimeTypeVP9,
+			strings.ToLower(webrtc.MimeTypeAV1): webrtc.MimeTypeAV1,
+		}[strings.ToLower(codec.MimeType)]
+		return "ivf", func(path string) (mediaWriter, error) {
+			return ivfwriter.New(path, ivfwriter.WithCodec(mimeType))
+		}
+	case strings.ToLower(webrtc.MimeTypeH264):
+		return "h264", func(path string) (mediaWriter, error) {
+			return h264writer.New(path)
+		}
+	default:
+		return "", nil
+	}
+}
@@ -0,0 +1,651 @@
+package sfu
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// room is the media of one voice channel: who is connected and which
+// tracks they publish.
+type room struct {
+	channelID int64
+
+	mu        sync.Mutex
+	peers     map[int64]*peer
+	tracks    map[string]*forwardedTrack
+	recording *recording
+	// screenViewers holds, per sharer, who chose to watch their screen.
+	screenViewers map[int64]map[int64]struct{}
+}
+
+// forwardedTrack is a track received from its owner and forwarded to every
+// other peer of the room. Simulcast video arrives as several layers of the
+// same track, and each subscriber is sent one of them.
+type forwardedTrack struct {
+	key   string
+	id    string
+	owner *peer
+	kind  webrtc.RTPCodecType
+	codec webrtc.RTPCodecCapability
+	// screen marks a track of the owner's screen share.
+	screen bool
+
+	mu sync.Mutex
+	// muted stops an audio track from being forwarded or recorded while
+	// its owner is server-muted.
+	muted       bool
+	layers      map[int]*webrtc.TrackRemote
+	keyframeAt  map[int]time.Time
+	subscribers map[*peer]*subscription
+	// recorder is the file the track is written to while the room is
+	// being recorded.
+	recorder *recordedFile
+}
+
+// subscription is one subscriber's copy of a forwarded track. Its fields
+// are guarded by the track's mutex. A recording subscribes the same way,
+// with no peer or sender.
+type subscription struct {
+	peer   *peer
+	out    rtpWriter
+	sender *webrtc.RTPSender
+	// current is the layer being forwarded and target the one wanted; they
+	// differ until target sends a keyframe. current is -1 before the first.
+	current, target int
+	// Packets are renumbered so that switching layers looks like one
+	// continuous stream to the subscriber.
+	started   bool
+	lastSeq   uint16
+	lastTS    uint32
+	seqOffset uint16
+	tsOffset  uint32
+}
+
+// rtpWriter receives the packets of a subscription.
+type rtpWriter interface {
+	WriteRTP(packet *rtp.Packet) error
+}
+
+// peer is one participant's connection to the server.
+type peer struct {
+	userID int64
+	pc     *webrtc.PeerConnection
+	send   SendFunc
+	// screenStream is the stream the peer shares its screen in, if it
+	// does, and muted is set while it is server-muted. Both are guarded by
+	// the room's mutex.
+	screenStream string
+	muted        bool
+
+	// mu serialises negotiation. pending records that the tracks changed
+	// while an offer was outstanding, so another offer follows the answer.
+	mu      sync.Mutex
+	pending bool
+	senders map[string]*webrtc.RTPSender
+
+	// qualityMu guards what the peer asked to receive: a level per
+	// publisher and the bandwidth it reported, shared by its video
+	// subscriptions.
+	qualityMu   sync.Mutex
+	preferences map[int64]int
+	bandwidth   uint64
+	videoCount  int
+}
+
+func newRoom(channelID int64) *room {
+	return &room{
+		channelID:     channelID,
+		peers:         make(map[int64]*peer),
+		tracks:        make(map[string]*forwardedTrack),
+		screenViewers: make(map[int64]map[int64]struct{}),
+	}
+}
+
+func newPeer(userID int64, pc *webrtc.PeerConnection, send SendFunc) *peer {
+	return &peer{
+		userID:      userID,
+		pc:          pc,
+		send:        send,
+		senders:     make(map[string]*webrtc.RTPSender),
+		preferences: make(map[int64]int),
+	}
+}
+
+// add puts p in the room and subscribes it to every track already there,
+// save screen shares it has not chosen to watch. The caller sends the
+// first offer.
+func (r *room) add(p *peer) {
+	r.mu.Lock()
+	r.peers[p.userID] = p
+	existing := make([]*forwardedTrack, 0, len(r.tracks))
+	for _, t := range r.tracks {
+		if r.receivesLocked(p, t) {
+			existing = append(existing, t)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, t := range existing {
+		p.subscribe(t)
+	}
+	r.reselect(p)
+}
+
+// remove takes p out of the room, withdraws its tracks from everyone else
+// and drops its subscriptions to theirs. It does nothing if p has already
+// been replaced or removed.
+func (r *room) remove(p *peer) {
+	r.mu.Lock()
+	if r.peers[p.userID] != p {
+		r.mu.Unlock()
+		return
+	}
+	delete(r.peers, p.userID)
+	delete(r.screenViewers, p.userID)
+	for sharerID, viewers := range r.screenViewers {
+		delete(viewers, p.userID)
+		if len(viewers) == 0 {
+			delete(r.screenViewers, sharerID)
+		}
+	}
+	owned := make([]*forwardedTrack, 0, 2)
+	subscribed := make([]*forwardedTrack, 0, len(r.tracks))
+	for key, t := range r.tracks {
+		if t.owner == p {
+			owned = append(owned, t)
+			delete(r.tracks, key)
+		} else {
+			subscribed = append(subscribed, t)
+		}
+	}
+	others := r.peerListLocked()
+	r.mu.Unlock()
+
+	// The connection is closing, so there is nothing to renegotiate; the
+	// subscriptions only have to stop receiving packets.
+	for _, t := range subscribed {
+		t.mu.Lock()
+		delete(t.subscribers, p)
+		t.mu.Unlock()
+	}
+
+	for _, other := range others {
+		changed := false
+		for _, t := range owned {
+			if other.unsubscribe(t) {
+				changed = true
+			}
+		}
+		if changed {
+			r.reselect(other)
+			other.negotiate()
+		}
+	}
+}
+
+func (r *room) peer(userID int64) *peer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.peers[userID]
+}
+
+func (r *room) peerList() []*peer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.peerListLocked()
+}
+
+func (r *room) peerListLocked() []*peer {
+	peers := make([]*peer, 0, len(r.peers))
+	for _, p := range r.peers {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+func (r *room) trackListLocked() []*forwardedTrack {
+	tracks := make([]*forwardedTrack, 0, len(r.tracks))
+	for _, t := range r.tracks {
+		tracks = append(tracks, t)
+	}
+	return tracks
+}
+
+func (r *room) empty() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.peers) == 0
+}
+
+// publish starts forwarding a track, or one simulcast layer of it, that
+// arrived from p, and keeps doing so until it ends.
+func (r *room) publish(p *peer, remote *webrtc.TrackRemote) {
+	key := strconv.FormatInt(p.userID, 10) + "/" + remote.ID()
+	level := levelHigh
+	if remote.RID() != "" {
+		level = ridLevel(remote.RID())
+	}
+
+	r.mu.Lock()
+	if r.peers[p.userID] != p {
+		r.mu.Unlock()
+		return
+	}
+	t, exists := r.tracks[key]
+	if !exists {
+		t = &forwardedTrack{
+			key:         key,
+			id:          remote.ID(),
+			owner:       p,
+			kind:        remote.Kind(),
+			codec:       remote.Codec().RTPCodecCapability,
+			screen:      p.screenStream != "" && remote.StreamID() == p.screenStream,
+			muted:       p.muted && remote.Kind() == webrtc.RTPCodecTypeAudio,
+			layers:      make(map[int]*webrtc.TrackRemote),
+			keyframeAt:  make(map[int]time.Time),
+			subscribers: make(map[*peer]*subscription),
+		}
+		r.tracks[key] = t
+	}
+	subscribers := make([]*peer, 0, len(r.peers))
+	for _, other := range r.peers {
+		if r.receivesLocked(other, t) {
+			subscribers = append(subscribers, other)
+		}
+	}
+	rec := r.recording
+	r.mu.Unlock()
+
+	t.mu.Lock()
+	t.layers[level] = remote
+	t.retargetRecorderLocked()
+	t.mu.Unlock()
+	if rec != nil && !exists {
+		rec.attach(t)
+	}
+
+	for _, sub := range subscribers {
+		if !exists && sub.subscribe(t) {
+			r.reselect(sub)
+			sub.negotiate()
+			continue
+		}
+		t.retarget(sub)
+	}
+
+	go r.forward(t, level, remote)
+}
+
+// forward reads one layer from the publisher and hands each packet to the
+// subscribers currently receiving that layer.
+func (r *room) forward(t *forwardedTrack, level int, remote *webrtc.TrackRemote) {
+	for {
+		pkt, _, err := remote.ReadRTP()
+		if err != nil {
+			break
+		}
+		t.route(level, pkt)
+	}
+
+	t.mu.Lock()
+	if t.layers[level] == remote {
+		delete(t.layers, level)
+	}
+	remaining := len(t.layers)
+	subscribers := make([]*peer, 0, len(t.subscribers))
+	for p, sub := range t.subscribers {
+		if sub.current == level {
+			sub.current = -1
+		}
+		subscribers = append(subscribers, p)
+	}
+	if t.recorder != nil && t.recorder.sub.current == level {
+		t.recorder.sub.current = -1
+	}
+	if remaining == 0 {
+		t.closeRecorderLocked()
+	} else {
+		t.retargetRecorderLocked()
+	}
+	t.mu.Unlock()
+
+	if remaining == 0 {
+		r.unpublish(t)
+		return
+	}
+	for _, p := range subscribers {
+		t.retarget(p)
+	}
+}
+
+func (r *room) unpublish(t *forwardedTrack) {
+	r.mu.Lock()
+	if r.tracks[t.key] != t {
+		r.mu.Unlock()
+		return
+	}
+	delete(r.tracks, t.key)
+	subscribers := r.peerListLocked()
+	r.mu.Unlock()
+
+	for _, sub := range subscribers {
+		if sub.unsubscribe(t) {
+			r.reselect(sub)
+			sub.negotiate()
+		}
+	}
+}
+
+// reselect picks the layer p receives of every track it is subscribed
+// to, after its preferences or its share of bandwidth changed.
+func (r *room) reselect(p *peer) {
+	r.mu.Lock()
+	tracks := r.trackListLocked()
+	r.mu.Unlock()
+
+	for _, t := range tracks {
+		t.retarget(p)
+	}
+}
+
+// route writes pkt, which arrived on the given layer, to the subscribers
+// and recorder that receive it. One waiting to switch to this layer
+// switches on its next keyframe.
+func (t *forwardedTrack) route(level int, pkt *rtp.Packet) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.muted {
+		return
+	}
+
+	keyframe := -1
+	for _, sub := range t.subscribers {
+		if !t.acceptLocked(sub, level, pkt, &keyframe) {
+			continue
+		}
+		if err := sub.write(pkt); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			log.Printf("sfu: forward to user %d: %v", sub.peer.userID, err)
+		}
+	}
+	if t.recorder != nil && t.acceptLocked(t.recorder.sub, level, pkt, &keyframe) {
+		if err := t.recorder.sub.write(pkt); err != nil {
+			log.Printf("sfu: record %s: %v", t.key, err)
+			t.closeRecorderLocked()
+		}
+	}
+}
+
+// acceptLocked reports whether sub should be sent pkt, which arrived on
+// level, switching it to that layer if it was waiting for a keyframe
+// there. keyframe caches whether pkt is one: -1 until checked, then 0 or 1.
+func (t *forwardedTrack) acceptLocked(sub *subscription, level int, pkt *rtp.Packet, keyframe *int) bool {
+	if sub.current == level {
+		return true
+	}
+	if sub.target != level {
+		return false
+	}
+	if *keyframe < 0 {
+		*keyframe = 0
+		if t.kind != webrtc.RTPCodecTypeVideo || isKeyframe(t.codec.MimeType, pkt) {
+			*keyframe = 1
+		}
+	}
+	if *keyframe == 0 {
+		t.requestKeyframeLocked(level)
+		return false
+	}
+	sub.switchTo(level, pkt, t.codec.ClockRate)
+	return true
+}
+
+// retarget chooses which layer p should receive from its preference for
+// the publisher and its share of bandwidth.
+func (t *forwardedTrack) retarget(p *peer) {
+	want := levelHigh
+	if t.kind == webrtc.RTPCodecTypeVideo {
+		want = p.wantedLevel(t.owner.userID)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	sub, ok := t.subscribers[p]
+	if !ok {
+		return
+	}
+	level, ok := pickLevel(t.layers, want)
+	if !ok || level == sub.target {
+		return
+	}
+	sub.target = level
+	if sub.current != level {
+		t.requestKeyframeLocked(level)
+	}
+}
+
+// requestKeyframeLocked asks the publisher for a full frame on a layer, so
+// a subscriber that lost packets or is switching to it can decode again.
+func (t *forwardedTrack) requestKeyframeLocked(level int) {
+	remote, ok := t.layers[level]
+	if !ok || t.kind != webrtc.RTPCodecTypeVideo || time.Since(t.keyframeAt[level]) < keyframeInterval {
+		return
+	}
+	t.keyframeAt[level] = time.Now()
+	_ = t.owner.pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(remote.SSRC())}})
+}
+
+// switchTo makes level the forwarded layer, starting at pkt, and shifts
+// the numbering of its packets to carry on from the last one sent.
+func (s *subscription) switchTo(level int, pkt *rtp.Packet, clockRate uint32) {
+	s.current = level
+	if !s.started {
+		s.started = true
+		return
+	}
+	// Leave one frame's worth of time at 30fps between the two layers.
+	gap := clockRate / 30
+	s.seqOffset = s.lastSeq + 1 - pkt.SequenceNumber
+	s.tsOffset = s.lastTS + gap - pkt.Timestamp
+}
+
+func (s *subscription) write(pkt *rtp.Packet) error {
+	out := *pkt
+	out.SequenceNumber += s.seqOffset
+	out.Timestamp += s.tsOffset
+	s.lastSeq, s.lastTS = out.SequenceNumber, out.Timestamp
+	return s.out.WriteRTP(&out)
+}
+
+// subscribe adds t to p's connection. It reports whether anything changed,
+// in which case the caller renegotiates.
+func (p *peer) subscribe(t *forwardedTrack) bool {
+	p.mu.Lock()
+	if _, ok := p.senders[t.key]; ok {
+		p.mu.Unlock()
+		return false
+	}
+	local, err := webrtc.NewTrackLocalStaticRTP(t.codec, t.id, t.streamID())
+	if err != nil {
+		p.mu.Unlock()
+		log.Printf("sfu: subscribe user %d to %s: %v", p.userID, t.key, err)
+		return false
+	}
+	sender, err := p.pc.AddTrack(local)
+	if err != nil {
+		p.mu.Unlock()
+		log.Printf("sfu: subscribe user %d to %s: %v", p.userID, t.key, err)
+		return false
+	}
+	p.senders[t.key] = sender
+	p.mu.Unlock()
+
+	if t.kind == webrtc.RTPCodecTypeVideo {
+		p.qualityMu.Lock()
+		p.videoCount++
+		p.qualityMu.Unlock()
+	}
+
+	sub := &subscription{peer: p, out: local, sender: sender, current: -1, target: -1}
+	t.mu.Lock()
+	t.subscribers[p] = sub
+	t.mu.Unlock()
+	go readFeedback(t, sub)
+	return true
+}
+
+func (p *peer) unsubscribe(t *forwardedTrack) bool {
+	t.mu.Lock()
+	delete(t.subscribers, p)
+	t.mu.Unlock()
+
+	p.mu.Lock()
+	sender, ok := p.senders[t.key]
+	if ok {
+		delete(p.senders, t.key)
+		if err := p.pc.RemoveTrack(sender); err != nil && !errors.Is(err, webrtc.ErrConnectionClosed) {
+			log.Printf("sfu: unsubscribe user %d from %s: %v", p.userID, t.key, err)
+		}
+	}
+	p.mu.Unlock()
+
+	if ok && t.kind == webrtc.RTPCodecTypeVideo {
+		p.qualityMu.Lock()
+		p.videoCount--
+		p.qualityMu.Unlock()
+	}
+	return ok
+}
+
+// wantedLevel is the highest video layer p should receive from
+// publisherID: its preference, lowered until the layer fits in an even
+// share of the bandwidth it reported.
+func (p *peer) wantedLevel(publisherID int64) int {
+	p.qualityMu.Lock()
+	defer p.qualityMu.Unlock()
+
+	want, ok := p.preferences[publisherID]
+	if !ok {
+		want = levelHigh
+	}
+	if p.bandwidth == 0 || p.videoCount == 0 {
+		return want
+	}
+	share := p.bandwidth / uint64(p.videoCount)
+	for want > levelLow && levelBitrates[want] > share {
+		want--
+	}
+	return want
+}
+
+// readFeedback drains RTCP from a subscriber, passing keyframe requests on
+// to the layer it receives. Reading is also what lets the interceptors
+// run.
+func readFeedback(t *forwardedTrack, sub *subscription) {
+	for {
+		packets, _, err := sub.sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, packet := range packets {
+			switch packet.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				t.mu.Lock()
+				level := sub.current
+				if level < 0 {
+					level = sub.target
+				}
+				t.requestKeyframeLocked(level)
+				t.mu.Unlock()
+			}
+		}
+	}
+}
+
+// negotiate sends p a fresh offer, or defers it until the outstanding one
+// has been answered.
+func (p *peer) negotiate() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.pc.ConnectionState() == webrtc.PeerConnectionStateClosed {
+		return
+	}
+	if p.pc.SignalingState() != webrtc.SignalingStateStable {
+		p.pending = true
+		return
+	}
+	offer, err := p.pc.CreateOffer(nil)
+	if err != nil {
+		log.Printf("sfu: create offer for user %d: %v", p.userID, err)
+		return
+	}
+	if err := p.pc.SetLocalDescription(offer); err != nil {
+		log.Printf("sfu: set local offer for user %d: %v", p.userID, err)
+		return
+	}
+	p.send(Signal{Type: SignalOffer, SDP: offer.SDP})
+}
+
+func (p *peer) acceptAnswer(sdp string) error {
+	p.mu.Lock()
+	if p.pc.SignalingState() != webrtc.SignalingStateHaveLocalOffer {
+		p.mu.Unlock()
+		return fmt.Errorf("%w: no offer is waiting for an answer", ErrInvalidSignal)
+	}
+	if err := p.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: sdp}); err != nil {
+		p.mu.Unlock()
+		return fmt.Errorf("%w: %v", ErrInvalidSignal, err)
+	}
+	again := p.pending
+	p.pending = false
+	p.mu.Unlock()
+
+	if again {
+		p.negotiate()
+	}
+	return nil
+}
+
+// acceptOffer answers an offer from the client, which it sends to publish
+// more tracks or simulcast layers. If both sides offered at once the
+// server backs down and offers again afterwards.
+func (p *peer) acceptOffer(sdp string) error {
+	p.mu.Lock()
+	if p.pc.SignalingState() == webrtc.SignalingStateHaveLocalOffer {
+		if err := p.pc.SetLocalDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeRollback}); err != nil {
+			p.mu.Unlock()
+			return fmt.Errorf("roll back offer: %w", err)
+		}
+		p.pending = true
+	}
+	if err := p.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: sdp}); err != nil {
+		p.mu.Unlock()
+		return fmt.Errorf("%w: %v", ErrInvalidSignal, err)
+	}
+	answer, err := p.pc.CreateAnswer(nil)
+	if err != nil {
+		p.mu.Unlock()
+		return fmt.Errorf("create answer: %w", err)
+	}
+	if err := p.pc.SetLocalDescription(answer); err != nil {
+		p.mu.Unlock()
+		return fmt.Errorf("set local answer: %w", err)
+	}
+	p.send(Signal{Type: SignalAnswer, SDP: answer.SDP})
+	again := p.pending
+	p.pending = false
+	p.mu.Unlock()
+
+	if again {
+		p.negotiate()
+	}
+	return nil
+}
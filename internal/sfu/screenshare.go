@@ -0,0 +1,98 @@
+package sfu
+
+// ScreenStreamID is the stream a participant's screen share is forwarded
+// in, apart from the one carrying their camera and microphone.
+func ScreenStreamID(userID int64) string {
+	return streamID(userID) + "-screen"
+}
+
+// SetScreenShare names the stream userID publishes their screen in. Its
+// tracks are only forwarded to participants who chose to watch. An empty
+// streamID ends the share, and the next one starts with no viewers.
+func (s *SFU) SetScreenShare(channelID, userID int64, streamID string) error {
+	r, p, err := s.lookup(channelID, userID)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	p.screenStream = streamID
+	if streamID == "" {
+		delete(r.screenViewers, userID)
+	}
+	r.mu.Unlock()
+	return nil
+}
+
+// WatchScreenShare starts or stops forwarding sharerID's screen share to
+// viewerID. Watching before the share's tracks arrive is allowed; they are
+// forwarded once published.
+func (s *SFU) WatchScreenShare(channelID, viewerID, sharerID int64, watch bool) error {
+	r, viewer, err := s.lookup(channelID, viewerID)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	viewers, ok := r.screenViewers[sharerID]
+	if watch && !ok {
+		viewers = make(map[int64]struct{})
+		r.screenViewers[sharerID] = viewers
+	}
+	if watch {
+		viewers[viewerID] = struct{}{}
+	} else if ok {
+		delete(viewers, viewerID)
+		if len(viewers) == 0 {
+			delete(r.screenViewers, sharerID)
+		}
+	}
+	shared := make([]*forwardedTrack, 0, 2)
+	for _, t := range r.tracks {
+		if t.screen && t.owner.userID == sharerID {
+			shared = append(shared, t)
+		}
+	}
+	r.mu.Unlock()
+
+	changed := false
+	for _, t := range shared {
+		if watch && viewer.subscribe(t) || !watch && viewer.unsubscribe(t) {
+			changed = true
+		}
+	}
+	if changed {
+		r.reselect(viewer)
+		viewer.negotiate()
+	}
+	return nil
+}
+
+// receivesLocked reports whether p is sent t: every track but a screen
+// share, which goes only to its viewers. r.mu must be held.
+func (r *room) receivesLocked(p *peer, t *forwardedTrack) bool {
+	if t.owner == p {
+		return false
+	}
+	if !t.screen {
+		return true
+	}
+	_, ok := r.screenViewers[t.owner.userID][p.userID]
+	return ok
+}
+
+// streamID is the stream t is forwarded in.
+func (t *forwardedTrack) streamID() string {
+	if t.screen {
+		return ScreenStreamID(t.owner.userID)
+	}
+	return streamID(t.owner.userID)
+}
+
+// label names what t carries: audio, video or screen.
+func (t *forwardedTrack) label() string {
+	if t.screen {
+		return "screen"
+	}
+	return t.kind.String()
+}
@@ -0,0 +1,320 @@
+// Package sfu is a selective forwarding unit for voice channels. Each
+// participant keeps one peer connection to the server and publishes its
+// tracks there; the server forwards every track to the other participants
+// of the room without decoding it.
+//
+// The package knows nothing about users or sockets. Signaling goes through
+// the Signal type and a SendFunc supplied on Join, so the realtime hub can
+// carry it over its own signal event and a Go peer can drive it directly.
+package sfu
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v4"
+)
+
+// Signal types, matching what browser clients exchange with each other in
+// mesh mode.
+const (
+	SignalOffer     = "offer"
+	SignalAnswer    = "answer"
+	SignalCandidate = "ice-candidate"
+)
+
+var (
+	ErrNotInRoom     = errors.New("not connected to this room's media server")
+	ErrInvalidSignal = errors.New("invalid signal payload")
+)
+
+// Signal is one offer, answer or ICE candidate exchanged with a
+// participant.
+type Signal struct {
+	Type      string                   `json:"type"`
+	SDP       string                   `json:"sdp,omitempty"`
+	Candidate *webrtc.ICECandidateInit `json:"candidate,omitempty"`
+}
+
+// SendFunc delivers a signal from the server to one participant. It may be
+// called from any goroutine.
+type SendFunc func(Signal)
+
+// Config controls how the server's peer connections gather candidates.
+type Config struct {
+	// ICEServers are used by the server's own peer connections.
+	ICEServers []webrtc.ICEServer
+	// PublicIPs replace the host candidates the server advertises, for
+	// deployments behind a 1:1 NAT.
+	PublicIPs []string
+	// PortMin and PortMax limit the UDP ports used for media; zero means
+	// any ephemeral port.
+	PortMin, PortMax uint16
+	// RecordingsDir is where recordings are written, one directory each.
+	RecordingsDir string
+}
+
+// SFU holds one room per voice channel that has media flowing through the
+// server.
+type SFU struct {
+	api           *webrtc.API
+	config        webrtc.Configuration
+	recordingsDir string
+
+	mu    sync.Mutex
+	rooms map[int64]*room
+}
+
+func New(cfg Config) (*SFU, error) {
+	media := &webrtc.MediaEngine{}
+	if err := media.RegisterDefaultCodecs(); err != nil {
+		return nil, fmt.Errorf("register codecs: %w", err)
+	}
+	registry := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(media, registry); err != nil {
+		return nil, fmt.Errorf("register interceptors: %w", err)
+	}
+
+	settings := webrtc.SettingEngine{}
+	if len(cfg.PublicIPs) > 0 {
+		settings.SetNAT1To1IPs(cfg.PublicIPs, webrtc.ICECandidateTypeHost)
+	}
+	if cfg.PortMin > 0 || cfg.PortMax > 0 {
+		if err := settings.SetEphemeralUDPPortRange(cfg.PortMin, cfg.PortMax); err != nil {
+			return nil, fmt.Errorf("set udp port range: %w", err)
+		}
+	}
+
+	return &SFU{
+		api: webrtc.NewAPI(
+			webrtc.WithMediaEngine(media),
+			webrtc.WithInterceptorRegistry(registry),
+			webrtc.WithSettingEngine(settings),
+		),
+		config:        webrtc.Configuration{ICEServers: cfg.ICEServers},
+		recordingsDir: cfg.RecordingsDir,
+		rooms:         make(map[int64]*room),
+	}, nil
+}
+
+// Join connects userID to the room of channelID and sends them an offer
+// carrying every track already published there. Joining again replaces
+// the previous connection.
+func (s *SFU) Join(channelID, userID int64, send SendFunc) error {
+	s.Leave(channelID, userID)
+
+	pc, err := s.api.NewPeerConnection(s.config)
+	if err != nil {
+		return fmt.Errorf("create peer connection: %w", err)
+	}
+	// One audio and one video track can be published without any client
+	// side renegotiation; anything more is added with a client offer.
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+		if _, err := pc.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+			_ = pc.Close()
+			return fmt.Errorf("add %s transceiver: %w", kind, err)
+		}
+	}
+
+	p := newPeer(userID, pc, send)
+
+	s.mu.Lock()
+	r, ok := s.rooms[channelID]
+	if !ok {
+		r = newRoom(channelID)
+		s.rooms[channelID] = r
+	}
+	r.add(p)
+	s.mu.Unlock()
+
+	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate == nil {
+			return
+		}
+		init := candidate.ToJSON()
+		send(Signal{Type: SignalCandidate, Candidate: &init})
+	})
+	pc.OnTrack(func(remote *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		r.publish(p, remote)
+	})
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateFailed {
+			log.Printf("sfu: media connection of user %d in channel %d failed", userID, channelID)
+			s.drop(channelID, r, p)
+		}
+	})
+
+	p.negotiate()
+	return nil
+}
+
+// Leave disconnects userID from the room and stops forwarding their tracks.
+func (s *SFU) Leave(channelID, userID int64) {
+	s.mu.Lock()
+	r, ok := s.rooms[channelID]
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	if p := r.peer(userID); p != nil {
+		s.drop(channelID, r, p)
+	}
+}
+
+// CloseRoom disconnects everyone from the room of channelID.
+func (s *SFU) CloseRoom(channelID int64) {
+	s.mu.Lock()
+	r, ok := s.rooms[channelID]
+	delete(s.rooms, channelID)
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	for _, p := range r.peerList() {
+		r.remove(p)
+		_ = p.pc.Close()
+	}
+	r.stopRecording()
+}
+
+// HandleSignal applies a signal sent by userID to their connection in the
+// room of channelID.
+func (s *SFU) HandleSignal(channelID, userID int64, sig Signal) error {
+	_, p, err := s.lookup(channelID, userID)
+	if err != nil {
+		return err
+	}
+
+	switch sig.Type {
+	case SignalAnswer:
+		if sig.SDP == "" {
+			return ErrInvalidSignal
+		}
+		return p.acceptAnswer(sig.SDP)
+	case SignalOffer:
+		if sig.SDP == "" {
+			return ErrInvalidSignal
+		}
+		return p.acceptOffer(sig.SDP)
+	case SignalCandidate:
+		if sig.Candidate == nil {
+			return ErrInvalidSignal
+		}
+		if err := p.pc.AddICECandidate(*sig.Candidate); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidSignal, err)
+		}
+		return nil
+	default:
+		return ErrInvalidSignal
+	}
+}
+
+// SetVideoQuality sets the highest quality userID wants to receive of
+// publisherID's video. QualityAuto removes the limit. The layer actually
+// forwarded also depends on what the publisher sends and on the bandwidth
+// reported with SetBandwidth.
+func (s *SFU) SetVideoQuality(channelID, userID, publisherID int64, quality string) error {
+	level, ok := parseQuality(quality)
+	if !ok && quality != QualityAuto {
+		return ErrInvalidQuality
+	}
+	r, p, err := s.lookup(channelID, userID)
+	if err != nil {
+		return err
+	}
+
+	p.qualityMu.Lock()
+	if quality == QualityAuto {
+		delete(p.preferences, publisherID)
+	} else {
+		p.preferences[publisherID] = level
+	}
+	p.qualityMu.Unlock()
+
+	r.reselect(p)
+	return nil
+}
+
+// SetBandwidth records how many bits per second userID can receive. It is
+// split evenly across the videos they are subscribed to, and each gets the
+// best layer that fits its share. Zero removes the limit.
+func (s *SFU) SetBandwidth(channelID, userID int64, bitsPerSecond uint64) error {
+	r, p, err := s.lookup(channelID, userID)
+	if err != nil {
+		return err
+	}
+
+	p.qualityMu.Lock()
+	p.bandwidth = bitsPerSecond
+	p.qualityMu.Unlock()
+
+	r.reselect(p)
+	return nil
+}
+
+// SetMuted stops or resumes forwarding userID's audio, for a server mute.
+// A recording leaves it out for as long as the mute lasts.
+func (s *SFU) SetMuted(channelID, userID int64, muted bool) error {
+	r, p, err := s.lookup(channelID, userID)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	p.muted = muted
+	audio := make([]*forwardedTrack, 0, 1)
+	for _, t := range r.tracks {
+		if t.owner == p && t.kind == webrtc.RTPCodecTypeAudio {
+			audio = append(audio, t)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, t := range audio {
+		t.mu.Lock()
+		t.muted = muted
+		t.mu.Unlock()
+	}
+	return nil
+}
+
+func (s *SFU) lookup(channelID, userID int64) (*room, *peer, error) {
+	s.mu.Lock()
+	r, ok := s.rooms[channelID]
+	s.mu.Unlock()
+	if !ok {
+		return nil, nil, ErrNotInRoom
+	}
+	p := r.peer(userID)
+	if p == nil {
+		return nil, nil, ErrNotInRoom
+	}
+	return r, p, nil
+}
+
+// drop removes p from r, if it is still the user's connection there, and
+// closes it. The room goes away with its last peer.
+func (s *SFU) drop(channelID int64, r *room, p *peer) {
+	r.remove(p)
+	_ = p.pc.Close()
+
+	s.mu.Lock()
+	closed := s.rooms[channelID] == r && r.empty()
+	if closed {
+		delete(s.rooms, channelID)
+	}
+	s.mu.Unlock()
+	if closed {
+		r.stopRecording()
+	}
+}
+
+// streamID labels the tracks of a publisher so subscribers can tell whose
+// media they are receiving.
+func streamID(userID int64) string {
+	return strconv.FormatInt(userID, 10)
+}
@@ -0,0 +1,560 @@
+package sfu
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	testChannel = 1
+	testTimeout = 10 * time.Second
+
+	midExtensionURI = "urn:ietf:params:rtp-hdrext:sdes:mid"
+	ridExtensionURI = "urn:ietf:params:rtp-hdrext:sdes:rtp-stream-id"
+)
+
+var (
+	testOpus = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}
+	testVP8  = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}
+)
+
+// testPeer is a participant driven the way the hub drives one: signals
+// from the server arrive through its SendFunc and its own go back through
+// HandleSignal.
+type testPeer struct {
+	t      *testing.T
+	sfu    *SFU
+	userID int64
+	pc     *webrtc.PeerConnection
+
+	signals chan Signal
+	work    chan func()
+	stop    chan struct{}
+	stopped chan struct{}
+	// publish is added to the connection when the server's first offer is
+	// answered, the way a browser publishes its microphone and camera.
+	publish []webrtc.TrackLocal
+
+	mu       sync.Mutex
+	received []*receivedTrack
+}
+
+// receivedTrack is a track the server forwarded to a test peer.
+type receivedTrack struct {
+	streamID string
+	kind     webrtc.RTPCodecType
+
+	mu      sync.Mutex
+	packets int
+	last    []byte
+	seen    map[byte]bool
+	ended   bool
+}
+
+func newTestSFU(t *testing.T) *SFU {
+	t.Helper()
+	s, err := New(Config{})
+	if err != nil {
+		t.Fatalf("new sfu: %v", err)
+	}
+	t.Cleanup(func() { s.CloseRoom(testChannel) })
+	return s
+}
+
+// newTestAPI builds a client with only the codecs the tests send, plus the
+// header extensions simulcast needs.
+func newTestAPI(t *testing.T) *webrtc.API {
+	t.Helper()
+	media := &webrtc.MediaEngine{}
+	codecs := []struct {
+		params webrtc.RTPCodecParameters
+		kind   webrtc.RTPCodecType
+	}{
+		{webrtc.RTPCodecParameters{RTPCodecCapability: testOpus, PayloadType: 111}, webrtc.RTPCodecTypeAudio},
+		{webrtc.RTPCodecParameters{RTPCodecCapability: testVP8, PayloadType: 96}, webrtc.RTPCodecTypeVideo},
+	}
+	for _, codec := range codecs {
+		if err := media.RegisterCodec(codec.params, codec.kind); err != nil {
+			t.Fatalf("register %s: %v", codec.params.MimeType, err)
+		}
+	}
+	for _, uri := range []string{midExtensionURI, ridExtensionURI} {
+		if err := media.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: uri}, webrtc.RTPCodecTypeVideo); err != nil {
+			t.Fatalf("register %s: %v", uri, err)
+		}
+	}
+	return webrtc.NewAPI(webrtc.WithMediaEngine(media))
+}
+
+// joinTestPeer connects userID to the test room, publishing the given
+// tracks in its first answer.
+func joinTestPeer(t *testing.T, s *SFU, userID int64, publish ...webrtc.TrackLocal) *testPeer {
+	t.Helper()
+	pc, err := newTestAPI(t).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("new peer connection: %v", err)
+	}
+	p := &testPeer{
+		t:       t,
+		sfu:     s,
+		userID:  userID,
+		pc:      pc,
+		signals: make(chan Signal, 256),
+		work:    make(chan func()),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		publish: publish,
+	}
+	pc.OnTrack(func(remote *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		rt := &receivedTrack{streamID: remote.StreamID(), kind: remote.Kind(), seen: make(map[byte]bool)}
+		p.mu.Lock()
+		p.received = append(p.received, rt)
+		p.mu.Unlock()
+		go rt.read(remote)
+	})
+	go p.run()
+	t.Cleanup(func() {
+		close(p.stop)
+		_ = pc.Close()
+		<-p.stopped
+	})
+
+	if err := s.Join(testChannel, userID, func(sig Signal) {
+		select {
+		case p.signals <- sig:
+		case <-p.stop:
+		}
+	}); err != nil {
+		t.Fatalf("join user %d: %v", userID, err)
+	}
+	return p
+}
+
+// run handles signals one at a time, like a client's message loop.
+func (p *testPeer) run() {
+	defer close(p.stopped)
+	for {
+		select {
+		case sig := <-p.signals:
+			p.handle(sig)
+		case fn := <-p.work:
+			fn()
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+func (p *testPeer) handle(sig Signal) {
+	switch sig.Type {
+	case SignalOffer:
+		// An offer of ours is outstanding; the server rolls its own back
+		// and offers again once it has answered.
+		if p.pc.SignalingState() == webrtc.SignalingStateHaveLocalOffer {
+			return
+		}
+		if err := p.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: sig.SDP}); err != nil {
+			p.fail("set remote offer: %v", err)
+			return
+		}
+		for _, track := range p.publish {
+			if _, err := p.pc.AddTrack(track); err != nil {
+				p.fail("add track: %v", err)
+				return
+			}
+		}
+		p.publish = nil
+		answer, err := p.pc.CreateAnswer(nil)
+		if err != nil {
+			p.fail("create answer: %v", err)
+			return
+		}
+		p.signal(SignalAnswer, answer)
+	case SignalAnswer:
+		if err := p.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: sig.SDP}); err != nil {
+			p.fail("set remote answer: %v", err)
+		}
+	case SignalCandidate:
+		if err := p.pc.AddICECandidate(*sig.Candidate); err != nil {
+			p.fail("add candidate: %v", err)
+		}
+	}
+}
+
+// signal applies a local description and sends it once gathering is
+// done, so the client needs no trickle of its own.
+func (p *testPeer) signal(kind string, desc webrtc.SessionDescription) {
+	gathered := webrtc.GatheringCompletePromise(p.pc)
+	if err := p.pc.SetLocalDescription(desc); err != nil {
+		p.fail("set local %s: %v", kind, err)
+		return
+	}
+	<-gathered
+	if err := p.sfu.HandleSignal(testChannel, p.userID, Signal{Type: kind, SDP: p.pc.LocalDescription().SDP}); err != nil {
+		p.fail("send %s: %v", kind, err)
+	}
+}
+
+// offer runs add on the peer's loop and then offers, to publish tracks
+// beyond the first audio and video.
+func (p *testPeer) offer(add func(pc *webrtc.PeerConnection) error) {
+	p.t.Helper()
+	done := make(chan error, 1)
+	p.work <- func() {
+		if err := add(p.pc); err != nil {
+			done <- err
+			return
+		}
+		offer, err := p.pc.CreateOffer(nil)
+		if err != nil {
+			done <- err
+			return
+		}
+		p.signal(SignalOffer, offer)
+		done <- nil
+	}
+	if err := <-done; err != nil {
+		p.t.Fatalf("offer from user %d: %v", p.userID, err)
+	}
+}
+
+func (p *testPeer) fail(format string, args ...any) {
+	select {
+	case <-p.stop:
+	default:
+		p.t.Errorf("user %d: "+format, append([]any{p.userID}, args...)...)
+	}
+}
+
+// track returns the track received in stream of the given kind, or nil.
+func (p *testPeer) track(stream string, kind webrtc.RTPCodecType) *receivedTrack {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, rt := range p.received {
+		if rt.streamID == stream && rt.kind == kind {
+			return rt
+		}
+	}
+	return nil
+}
+
+// waitTrack waits for a track in stream to arrive and carry media.
+func (p *testPeer) waitTrack(stream string, kind webrtc.RTPCodecType) *receivedTrack {
+	p.t.Helper()
+	var rt *receivedTrack
+	waitFor(p.t, "user "+streamID(p.userID)+" to receive "+kind.String()+" in stream "+stream, func() bool {
+		rt = p.track(stream, kind)
+		return rt != nil && rt.count() > 0
+	})
+	return rt
+}
+
+func (rt *receivedTrack) read(remote *webrtc.TrackRemote) {
+	for {
+		pkt, _, err := remote.ReadRTP()
+		rt.mu.Lock()
+		if err != nil {
+			rt.ended = true
+			rt.mu.Unlock()
+			return
+		}
+		rt.packets++
+		rt.last = pkt.Payload
+		if len(pkt.Payload) > 0 {
+			rt.seen[pkt.Payload[len(pkt.Payload)-1]] = true
+		}
+		rt.mu.Unlock()
+	}
+}
+
+func (rt *receivedTrack) count() int {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return rt.packets
+}
+
+// tag is the last byte of the latest payload, which the tests use to tell
+// apart what was sent.
+func (rt *receivedTrack) tag() byte {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if len(rt.last) == 0 {
+		return 0
+	}
+	return rt.last[len(rt.last)-1]
+}
+
+// saw reports whether any packet arrived with the given tag.
+func (rt *receivedTrack) saw(tag byte) bool {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return rt.seen[tag]
+}
+
+func (rt *receivedTrack) isEnded() bool {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return rt.ended
+}
+
+// sendPackets writes a packet to track every 20ms until the test ends.
+// VP8 payloads are keyframes so a subscriber can switch to them at once.
+// prepare, if set, can change each packet before it is written and
+// reports false to skip it.
+func sendPackets(t *testing.T, track *webrtc.TrackLocalStaticRTP, tag byte, prepare func(*rtp.Packet) bool) {
+	payload := []byte{tag}
+	if track.Codec().MimeType == webrtc.MimeTypeVP8 {
+		payload = []byte{0x10, 0x00, tag}
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		close(stop)
+		<-done
+	})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		for seq := uint16(0); ; seq++ {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			pkt := &rtp.Packet{
+				Header:  rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: uint32(seq) * 960},
+				Payload: append([]byte(nil), payload...),
+			}
+			if prepare != nil && !prepare(pkt) {
+				continue
+			}
+			_ = track.WriteRTP(pkt)
+		}
+	}()
+}
+
+func newTestTrack(t *testing.T, codec webrtc.RTPCodecCapability, id, streamID string, options ...func(*webrtc.TrackLocalStaticRTP)) *webrtc.TrackLocalStaticRTP {
+	t.Helper()
+	track, err := webrtc.NewTrackLocalStaticRTP(codec, id, streamID, options...)
+	if err != nil {
+		t.Fatalf("new track %s: %v", id, err)
+	}
+	return track
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// serverTracks returns the tracks userID publishes in the test room.
+func serverTracks(s *SFU, userID int64) []*forwardedTrack {
+	s.mu.Lock()
+	r, ok := s.rooms[testChannel]
+	s.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var tracks []*forwardedTrack
+	for _, t := range r.tracks {
+		if t.owner.userID == userID {
+			tracks = append(tracks, t)
+		}
+	}
+	return tracks
+}
+
+func subscribed(t *forwardedTrack, userID int64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for p := range t.subscribers {
+		if p.userID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+func TestForwardAndWithdraw(t *testing.T) {
+	s := newTestSFU(t)
+	audio := newTestTrack(t, testOpus, "audio", "a-mic")
+	sendPackets(t, audio, 'a', nil)
+
+	joinTestPeer(t, s, 1, audio)
+	b := joinTestPeer(t, s, 2)
+	c := joinTestPeer(t, s, 3)
+
+	received := b.waitTrack(streamID(1), webrtc.RTPCodecTypeAudio)
+	if tag := received.tag(); tag != 'a' {
+		t.Fatalf("user 2 received payload tagged %q, want 'a'", tag)
+	}
+	c.waitTrack(streamID(1), webrtc.RTPCodecTypeAudio)
+
+	// A peer that leaves stops being written to, even though the
+	// publisher stays.
+	s.Leave(testChannel, 3)
+	for _, track := range serverTracks(s, 1) {
+		if subscribed(track, 3) {
+			t.Fatalf("user 3 is still subscribed to %s after leaving", track.key)
+		}
+	}
+
+	s.Leave(testChannel, 1)
+	if tracks := serverTracks(s, 1); len(tracks) != 0 {
+		t.Fatalf("user 1 still publishes %d tracks after leaving", len(tracks))
+	}
+	waitFor(t, "user 1's audio to be withdrawn from user 2", received.isEnded)
+}
+
+func TestSimulcastLayerSwitch(t *testing.T) {
+	s := newTestSFU(t)
+	a := joinTestPeer(t, s, 1)
+
+	low := newTestTrack(t, testVP8, "camera", "a-camera", webrtc.WithRTPStreamID("q"))
+	high := newTestTrack(t, testVP8, "camera", "a-camera", webrtc.WithRTPStreamID("f"))
+	// Simulcast layers are told apart by the mid and rid header
+	// extensions, which the sender has to add itself.
+	var (
+		transceiver  *webrtc.RTPTransceiver
+		midID, ridID uint8
+	)
+	a.offer(func(pc *webrtc.PeerConnection) error {
+		var err error
+		transceiver, err = pc.AddTransceiverFromTrack(high, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
+		if err != nil {
+			return err
+		}
+		if err := transceiver.Sender().AddEncoding(low); err != nil {
+			return err
+		}
+		for _, extension := range transceiver.Sender().GetParameters().HeaderExtensions {
+			switch extension.URI {
+			case midExtensionURI:
+				midID = uint8(extension.ID)
+			case ridExtensionURI:
+				ridID = uint8(extension.ID)
+			}
+		}
+		return nil
+	})
+	for _, layer := range []*webrtc.TrackLocalStaticRTP{low, high} {
+		rid := layer.RID()
+		sendPackets(t, layer, rid[0], func(pkt *rtp.Packet) bool {
+			mid := transceiver.Mid()
+			if mid == "" {
+				return false
+			}
+			return pkt.Header.SetExtension(midID, []byte(mid)) == nil &&
+				pkt.Header.SetExtension(ridID, []byte(rid)) == nil
+		})
+	}
+
+	b := joinTestPeer(t, s, 2)
+	video := b.waitTrack(streamID(1), webrtc.RTPCodecTypeVideo)
+	waitFor(t, "user 2 to receive the high layer", func() bool { return video.tag() == 'f' })
+
+	if err := s.SetVideoQuality(testChannel, 2, 1, QualityLow); err != nil {
+		t.Fatalf("set video quality: %v", err)
+	}
+	waitFor(t, "user 2 to switch to the low layer", func() bool { return video.tag() == 'q' })
+
+	if err := s.SetVideoQuality(testChannel, 2, 1, QualityAuto); err != nil {
+		t.Fatalf("set video quality: %v", err)
+	}
+	waitFor(t, "user 2 to switch back to the high layer", func() bool { return video.tag() == 'f' })
+}
+
+func TestScreenShareOptIn(t *testing.T) {
+	s := newTestSFU(t)
+	a := joinTestPeer(t, s, 1)
+	b := joinTestPeer(t, s, 2)
+
+	if err := s.SetScreenShare(testChannel, 1, "a-screen"); err != nil {
+		t.Fatalf("set screen share: %v", err)
+	}
+	screen := newTestTrack(t, testVP8, "screen", "a-screen")
+	sendPackets(t, screen, 's', nil)
+	a.offer(func(pc *webrtc.PeerConnection) error {
+		_, err := pc.AddTransceiverFromTrack(screen, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
+		return err
+	})
+
+	var shared *forwardedTrack
+	waitFor(t, "the server to receive user 1's screen", func() bool {
+		for _, track := range serverTracks(s, 1) {
+			if track.screen {
+				shared = track
+			}
+		}
+		return shared != nil
+	})
+	if subscribed(shared, 2) {
+		t.Fatal("user 2 receives the screen share without watching it")
+	}
+
+	if err := s.WatchScreenShare(testChannel, 2, 1, true); err != nil {
+		t.Fatalf("watch screen share: %v", err)
+	}
+	received := b.waitTrack(ScreenStreamID(1), webrtc.RTPCodecTypeVideo)
+	if tag := received.tag(); tag != 's' {
+		t.Fatalf("user 2 received payload tagged %q, want 's'", tag)
+	}
+
+	if err := s.WatchScreenShare(testChannel, 2, 1, false); err != nil {
+		t.Fatalf("unwatch screen share: %v", err)
+	}
+	if subscribed(shared, 2) {
+		t.Fatal("user 2 still receives the screen share after unwatching it")
+	}
+}
+
+func TestServerMute(t *testing.T) {
+	s := newTestSFU(t)
+	// Every packet carries the phase of the test it was sent in. Video is
+	// never muted, so its arrival shows that the server has handled what
+	// was sent before it.
+	var phase atomic.Uint32
+	phase.Store('a')
+	retag := func(pkt *rtp.Packet) bool {
+		pkt.Payload[len(pkt.Payload)-1] = byte(phase.Load())
+		return true
+	}
+	audio := newTestTrack(t, testOpus, "audio", "a-media")
+	video := newTestTrack(t, testVP8, "video", "a-media")
+	sendPackets(t, audio, 'a', retag)
+	sendPackets(t, video, 'a', retag)
+	joinTestPeer(t, s, 1, audio, video)
+	b := joinTestPeer(t, s, 2)
+	heard := b.waitTrack(streamID(1), webrtc.RTPCodecTypeAudio)
+	seen := b.waitTrack(streamID(1), webrtc.RTPCodecTypeVideo)
+
+	if err := s.SetMuted(testChannel, 1, true); err != nil {
+		t.Fatalf("mute: %v", err)
+	}
+	phase.Store('m')
+	waitFor(t, "video sent during the mute", func() bool { return seen.tag() == 'm' })
+	phase.Store('u')
+	waitFor(t, "video sent after the mute", func() bool { return seen.tag() == 'u' })
+	if heard.saw('m') {
+		t.Fatal("user 2 heard user 1 while they were muted")
+	}
+
+	if err := s.SetMuted(testChannel, 1, false); err != nil {
+		t.Fatalf("unmute: %v", err)
+	}
+	waitFor(t, "user 1's audio to resume", func() bool { return heard.tag() == 'u' })
+}
@@ -0,0 +1,143 @@
+package sfu
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+)
+
+// Video qualities a subscriber can ask for. A simulcast publisher sends up
+// to one layer of each; a plain video track counts as high.
+const (
+	QualityLow    = "low"
+	QualityMedium = "medium"
+	QualityHigh   = "high"
+	// QualityAuto drops a preference, leaving the choice to bandwidth.
+	QualityAuto = "auto"
+)
+
+var ErrInvalidQuality = errors.New("quality must be low, medium, high or auto")
+
+// Layers are ranked so they can be compared; levelBitrates holds the rate
+// each one is assumed to need when splitting a subscriber's bandwidth.
+const (
+	levelLow = iota
+	levelMedium
+	levelHigh
+)
+
+var (
+	levelNames    = [...]string{QualityLow, QualityMedium, QualityHigh}
+	levelBitrates = [...]uint64{150_000, 500_000, 1_500_000}
+)
+
+// keyframeInterval limits how often one layer is asked for a keyframe.
+const keyframeInterval = 500 * time.Millisecond
+
+// QualityForHeight picks the quality that suits a video tile of the given
+// height in pixels.
+func QualityForHeight(height int) string {
+	switch {
+	case height <= 180:
+		return QualityLow
+	case height <= 360:
+		return QualityMedium
+	default:
+		return QualityHigh
+	}
+}
+
+func parseQuality(quality string) (int, bool) {
+	for level, name := range levelNames {
+		if name == quality {
+			return level, true
+		}
+	}
+	return 0, false
+}
+
+// ridLevel maps the RID a browser gives a simulcast layer to its level.
+// The common names are understood; anything else is treated as full size.
+func ridLevel(rid string) int {
+	switch strings.ToLower(rid) {
+	case "q", "l", "low", "quarter":
+		return levelLow
+	case "h", "m", "mid", "medium", "half":
+		return levelMedium
+	default:
+		return levelHigh
+	}
+}
+
+// pickLevel returns the best of the available levels that does not exceed
+// want, or the lowest available one when they all do.
+func pickLevel(available map[int]*webrtc.TrackRemote, want int) (int, bool) {
+	best, lowest, found := -1, -1, false
+	for level := range available {
+		found = true
+		if lowest < 0 || level < lowest {
+			lowest = level
+		}
+		if level <= want && level > best {
+			best = level
+		}
+	}
+	if !found {
+		return 0, false
+	}
+	if best < 0 {
+		best = lowest
+	}
+	return best, true
+}
+
+// isKeyframe reports whether pkt starts a frame a decoder can begin from.
+// Switching layers waits for one so subscribers never see a broken
+// picture. It returns true for codecs it cannot inspect.
+func isKeyframe(mimeType string, pkt *rtp.Packet) bool {
+	switch strings.ToLower(mimeType) {
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		var vp8 codecs.VP8Packet
+		if _, err := vp8.Unmarshal(pkt.Payload); err != nil {
+			return false
+		}
+		return vp8.S == 1 && vp8.PID == 0 && len(vp8.Payload) > 0 && vp8.Payload[0]&0x01 == 0
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		var vp9 codecs.VP9Packet
+		if _, err := vp9.Unmarshal(pkt.Payload); err != nil {
+			return false
+		}
+		return !vp9.P && vp9.B
+	case strings.ToLower(webrtc.MimeTypeH264):
+		return h264Keyframe(pkt.Payload)
+	default:
+		return true
+	}
+}
+
+func h264Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	switch nalType := payload[0] & 0x1f; nalType {
+	case 5, 7:
+		return true
+	case 24: // STAP-A: several NAL units, each behind a two byte size
+		for i := 1; i+2 < len(payload); {
+			size := int(payload[i])<<8 | int(payload[i+1])
+			if t := payload[i+2] & 0x1f; t == 5 || t == 7 {
+				return true
+			}
+			i += 2 + size
+		}
+		return false
+	case 28: // FU-A: only the first fragment names the NAL type
+		return len(payload) > 1 && payload[1]&0x80 != 0 && payload[1]&0x1f == 5
+	default:
+		return false
+	}
+}
@@ -7,20 +7,26 @@ import (
 	"embed"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/fs"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
 	"openvoice/internal/auth"
 	"openvoice/internal/database"
+	"openvoice/internal/ice"
+	"openvoice/internal/permissions"
 	"openvoice/internal/realtime"
+	"openvoice/internal/sfu"
 )
 
 const (
@@ -31,8 +37,10 @@ const (
 	sessionDuration     = 24 * time.Hour
 	requestTimeout      = 3 * time.Second
 	minimumPasswordSize = 8
+	maxTopicLength      = 1024
 	maxUploadSize       = 10 << 20
 	uploadDir           = "uploads"
+	recordingsDir       = "recordings"
 )
 
 var (
@@ -49,23 +57,78 @@ type User struct {
 	AvatarURL string `json:"avatar_url"`
 }
 
-type channel struct {
-	ID   int64  `json:"id"`
-	Name string `json:"name"`
-	Type string `json:"type"`
-}
-
 type meResponse struct {
 	User User `json:"user"`
 }
 
 type channelsResponse struct {
-	Channels []channel `json:"channels"`
+	Channels   []channelListing    `json:"channels"`
+	Categories []database.Category `json:"categories"`
+}
+
+// channelListing is a channel as seen by the requesting user, with their
+// read marker and badge counts alongside.
+type channelListing struct {
+	database.Channel
+	LastReadMessageID int64 `json:"last_read_message_id"`
+	UnreadCount       int   `json:"unread_count"`
+	MentionCount      int   `json:"mention_count"`
 }
 
 type createChannelRequest struct {
-	Name string `json:"name"`
-	Type string `json:"type"`
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	Private    bool   `json:"private"`
+	Topic      string `json:"topic"`
+	CategoryID *int64 `json:"category_id"`
+	VoiceMode  string `json:"voice_mode"`
+}
+
+type updateChannelRequest struct {
+	Name       *string `json:"name"`
+	Topic      *string `json:"topic"`
+	CategoryID *int64  `json:"category_id"`
+	VoiceMode  *string `json:"voice_mode"`
+}
+
+type reorderChannelsRequest struct {
+	Channels []database.ChannelPosition `json:"channels"`
+}
+
+type categoryRequest struct {
+	Name     *string `json:"name"`
+	Position *int    `json:"position"`
+}
+
+type addChannelMemberRequest struct {
+	UserID int64 `json:"user_id"`
+}
+
+type editMessageRequest struct {
+	Content string `json:"content"`
+}
+
+type openDMRequest struct {
+	UserIDs []int64 `json:"user_ids"`
+}
+
+type createRoleRequest struct {
+	Name        string                 `json:"name"`
+	Permissions permissions.Permission `json:"permissions"`
+}
+
+type updateRoleRequest struct {
+	Name        *string                 `json:"name"`
+	Permissions *permissions.Permission `json:"permissions"`
+}
+
+type channelOverrideRequest struct {
+	Allow permissions.Permission `json:"allow"`
+	Deny  permissions.Permission `json:"deny"`
+}
+
+type banRequest struct {
+	Reason string `json:"reason"`
 }
 
 type updateProfileRequest struct {
@@ -78,14 +141,51 @@ type publicUser struct {
 	Username  string `json:"username"`
 	AvatarURL string `json:"avatar_url"`
 	Online    bool   `json:"online"`
+	// Status is online, idle, dnd or offline; invisible only for oneself.
+	Status       string                 `json:"status"`
+	CustomStatus *database.CustomStatus `json:"custom_status,omitempty"`
+}
+
+type iceServersResponse struct {
+	ICEServers []ice.ICEServer `json:"ice_servers"`
+	ExpiresAt  *time.Time      `json:"expires_at,omitempty"`
 }
 
 type application struct {
 	db  *sql.DB
 	hub *realtime.Hub
+	// turn is nil unless the embedded STUN/TURN listener is enabled.
+	turn *ice.Server
 }
 
 func main() {
+	migrateStatus := flag.Bool("migrate-status", false, "print schema migration status and exit")
+	migrateDryRun := flag.Bool("migrate-dry-run", false, "print pending schema migrations without applying them and exit")
+	migrateDownTo := flag.Int("migrate-down-to", -1, "roll the schema back to the given version and exit")
+	sfuPublicIPs := flag.String("sfu-public-ip", "", "comma-separated public IPs the SFU advertises when behind a 1:1 NAT")
+	sfuUDPPorts := flag.String("sfu-udp-ports", "", "UDP port range for SFU media, such as 50000-50100")
+	turnListen := flag.String("turn-listen", "", "address of the embedded STUN/TURN listener, such as :3478; empty disables it")
+	turnPublicIP := flag.String("turn-public-ip", "", "public IP the TURN server relays media on")
+	turnHost := flag.String("turn-host", "", "host name clients use to reach the STUN/TURN listener; defaults to -turn-public-ip")
+	turnRelayPorts := flag.String("turn-relay-ports", "", "UDP port range for TURN relays, such as 49152-49252")
+	flag.Parse()
+
+	if *migrateStatus || *migrateDryRun || *migrateDownTo >= 0 {
+		if err := runMigrationCommand(*migrateDryRun, *migrateDownTo); err != nil {
+			log.Fatalf("migration command failed: %v", err)
+		}
+		return
+	}
+
+	mediaConfig, err := sfuConfig(*sfuPublicIPs, *sfuUDPPorts)
+	if err != nil {
+		log.Fatalf("invalid sfu settings: %v", err)
+	}
+	relayConfig, err := turnConfig(*turnListen, *turnPublicIP, *turnHost, *turnRelayPorts)
+	if err != nil {
+		log.Fatalf("invalid turn settings: %v", err)
+	}
+
 	db, err := database.InitDB(dbPath)
 	if err != nil {
 		log.Fatalf("database initialization failed: %v", err)
@@ -95,13 +195,35 @@ func main() {
 	if err := os.MkdirAll(uploadDir, 0o755); err != nil {
 		log.Fatalf("create uploads directory: %v", err)
 	}
+	if err := os.MkdirAll(recordingsDir, 0o755); err != nil {
+		log.Fatalf("create recordings directory: %v", err)
+	}
+	if err := database.EndInterruptedRecordings(context.Background(), db); err != nil {
+		log.Fatalf("recordings cleanup failed: %v", err)
+	}
 
 	distFS, err := fs.Sub(embeddedDist, embedPath)
 	if err != nil {
 		log.Fatalf("frontend assets unavailable: %v", err)
 	}
 
-	a := &application{db: db, hub: realtime.NewHub(db)}
+	mediaConfig.RecordingsDir = recordingsDir
+	media, err := sfu.New(mediaConfig)
+	if err != nil {
+		log.Fatalf("sfu initialization failed: %v", err)
+	}
+
+	a := &application{db: db, hub: realtime.NewHub(db, media)}
+
+	if relayConfig.Listen != "" {
+		relayConfig.SessionActive = a.sessionActive
+		a.turn, err = ice.Start(relayConfig)
+		if err != nil {
+			log.Fatalf("turn server initialization failed: %v", err)
+		}
+		defer a.turn.Close()
+		log.Printf("stun/turn listening on %s", relayConfig.Listen)
+	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/api/health", a.handleHealth)
@@ -111,6 +233,35 @@ func main() {
 	mux.HandleFunc("/api/me", a.handleMe)
 	mux.Handle("/api/users", a.authMiddleware(http.HandlerFunc(a.handleListUsers)))
 	mux.Handle("/api/channels", a.authMiddleware(http.HandlerFunc(a.handleChannels)))
+	mux.Handle("/api/channels/{id}", a.authMiddleware(http.HandlerFunc(a.handleChannel)))
+	mux.Handle("/api/categories", a.authMiddleware(http.HandlerFunc(a.handleCategories)))
+	mux.Handle("/api/categories/{id}", a.authMiddleware(http.HandlerFunc(a.handleCategory)))
+	mux.Handle("/api/dms", a.authMiddleware(http.HandlerFunc(a.handleDMs)))
+	mux.Handle("/api/channels/{id}/members", a.authMiddleware(http.HandlerFunc(a.handleChannelMembers)))
+	mux.Handle("/api/channels/{id}/members/{userID}", a.authMiddleware(http.HandlerFunc(a.handleRemoveChannelMember)))
+	mux.Handle("/api/channels/{id}/messages", a.authMiddleware(http.HandlerFunc(a.handleChannelMessages)))
+	mux.Handle("/api/channels/{id}/pins", a.authMiddleware(http.HandlerFunc(a.handleChannelPins)))
+	mux.Handle("/api/channels/{id}/pins/{messageID}", a.authMiddleware(http.HandlerFunc(a.handleChannelPin)))
+	mux.Handle("/api/channels/{id}/voice", a.authMiddleware(http.HandlerFunc(a.handleChannelVoice)))
+	mux.Handle("/api/channels/{id}/recordings", a.authMiddleware(http.HandlerFunc(a.handleChannelRecordings)))
+	mux.Handle("/api/recordings/{id}/tracks/{trackID}", a.authMiddleware(http.HandlerFunc(a.handleRecordingTrack)))
+	mux.Handle("/api/voice/ice-servers", a.authMiddleware(http.HandlerFunc(a.handleICEServers)))
+	mux.Handle("/api/channels/{id}/threads", a.authMiddleware(http.HandlerFunc(a.handleChannelThreads)))
+	mux.Handle("/api/threads/{id}", a.authMiddleware(http.HandlerFunc(a.handleThread)))
+	mux.Handle("/api/threads/{id}/messages", a.authMiddleware(http.HandlerFunc(a.handleThreadMessages)))
+	mux.Handle("/api/messages/{id}", a.authMiddleware(http.HandlerFunc(a.handleMessage)))
+	mux.Handle("/api/messages/{id}/reactions/{emoji}", a.authMiddleware(http.HandlerFunc(a.handleMessageReactions)))
+	mux.Handle("/api/mentions", a.authMiddleware(http.HandlerFunc(a.handleMentions)))
+	mux.Handle("/api/mentions/read", a.authMiddleware(http.HandlerFunc(a.handleMarkMentionsRead)))
+	mux.Handle("/api/search", a.authMiddleware(http.HandlerFunc(a.handleSearch)))
+	mux.Handle("/api/permissions", a.authMiddleware(http.HandlerFunc(a.handleMyPermissions)))
+	mux.Handle("/api/roles", a.authMiddleware(http.HandlerFunc(a.handleRoles)))
+	mux.Handle("/api/roles/{id}", a.authMiddleware(http.HandlerFunc(a.handleRole)))
+	mux.Handle("/api/users/{id}/roles/{roleID}", a.authMiddleware(http.HandlerFunc(a.handleUserRole)))
+	mux.Handle("/api/users/{id}/kick", a.authMiddleware(http.HandlerFunc(a.handleKickUser)))
+	mux.Handle("/api/users/{id}/ban", a.authMiddleware(http.HandlerFunc(a.handleBanUser)))
+	mux.Handle("/api/channels/{id}/permissions", a.authMiddleware(http.HandlerFunc(a.handleListChannelOverrides)))
+	mux.Handle("/api/channels/{id}/permissions/{roleID}", a.authMiddleware(http.HandlerFunc(a.handleSetChannelOverride)))
 	mux.Handle("/api/ws", a.authMiddleware(http.HandlerFunc(a.handleWebSocket)))
 	mux.Handle("/api/upload", a.authMiddleware(http.HandlerFunc(a.handleUpload)))
 	mux.Handle("/uploads/", http.StripPrefix("/uploads/", http.FileServer(http.Dir(uploadDir))))
@@ -130,6 +281,109 @@ func main() {
 	}
 }
 
+// sfuConfig builds the media server settings from the -sfu-* flags.
+func sfuConfig(publicIPs, udpPorts string) (sfu.Config, error) {
+	var cfg sfu.Config
+	for _, ip := range strings.Split(publicIPs, ",") {
+		if ip = strings.TrimSpace(ip); ip != "" {
+			cfg.PublicIPs = append(cfg.PublicIPs, ip)
+		}
+	}
+	if udpPorts == "" {
+		return cfg, nil
+	}
+
+	var err error
+	cfg.PortMin, cfg.PortMax, err = parsePortRange(udpPorts)
+	if err != nil {
+		return sfu.Config{}, err
+	}
+	return cfg, nil
+}
+
+// turnConfig builds the STUN/TURN listener settings from the -turn-* flags.
+// An empty listen address leaves the listener off.
+func turnConfig(listen, publicIP, host, relayPorts string) (ice.Config, error) {
+	if listen == "" {
+		return ice.Config{}, nil
+	}
+	cfg := ice.Config{Listen: listen, Host: host}
+	if publicIP == "" {
+		return ice.Config{}, fmt.Errorf("-turn-public-ip is required with -turn-listen")
+	}
+	if cfg.PublicIP = net.ParseIP(publicIP); cfg.PublicIP == nil {
+		return ice.Config{}, fmt.Errorf("invalid turn public ip %q", publicIP)
+	}
+	if relayPorts == "" {
+		return cfg, nil
+	}
+
+	var err error
+	cfg.RelayPortMin, cfg.RelayPortMax, err = parsePortRange(relayPorts)
+	if err != nil {
+		return ice.Config{}, err
+	}
+	return cfg, nil
+}
+
+func parsePortRange(ports string) (uint16, uint16, error) {
+	low, high, ok := strings.Cut(ports, "-")
+	portMin, errMin := strconv.ParseUint(strings.TrimSpace(low), 10, 16)
+	portMax, errMax := strconv.ParseUint(strings.TrimSpace(high), 10, 16)
+	if !ok || errMin != nil || errMax != nil || portMin == 0 || portMin > portMax {
+		return 0, 0, fmt.Errorf("udp ports must look like 50000-50100, got %q", ports)
+	}
+	return uint16(portMin), uint16(portMax), nil
+}
+
+func runMigrationCommand(dryRun bool, downTo int) error {
+	db, err := database.OpenDB(dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var (
+		results []database.MigrationStatus
+		verb    string
+	)
+	switch {
+	case downTo >= 0:
+		results, err = database.Rollback(ctx, db, downTo, dryRun)
+		verb = "reverted"
+		if dryRun {
+			verb = "would revert"
+		}
+	case dryRun:
+		results, err = database.Migrate(ctx, db, true)
+		verb = "pending"
+	default:
+		results, err = database.Status(ctx, db)
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("binary schema version: %d", database.LatestVersion())
+	for _, m := range results {
+		switch {
+		case verb != "":
+			log.Printf("%s: %03d %s", verb, m.Version, m.Name)
+		case m.Applied:
+			log.Printf("applied: %03d %s (%s)", m.Version, m.Name, m.AppliedAt.Format(time.RFC3339))
+		default:
+			log.Printf("pending: %03d %s", m.Version, m.Name)
+		}
+	}
+	if len(results) == 0 {
+		log.Printf("nothing to do")
+	}
+	return nil
+}
+
 func (a *application) handleHealth(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
@@ -164,6 +418,10 @@ func (a *application) handleRegister(w http.ResponseWriter, r *http.Request) {
 		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "username must be alphanumeric and 3-20 characters"})
 		return
 	}
+	if database.IsReservedMention(req.Username) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "this username is reserved"})
+		return
+	}
 	if len(req.Password) < minimumPasswordSize {
 		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "password must be at least 8 characters"})
 		return
@@ -194,6 +452,10 @@ func (a *application) handleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := permissions.AssignInitialOwner(ctx, a.db, id); err != nil {
+		log.Printf("assign initial owner: %v", err)
+	}
+
 	writeJSON(w, http.StatusCreated, map[string]any{"user": User{ID: id, Username: req.Username, AvatarURL: ""}})
 }
 
@@ -235,6 +497,16 @@ func (a *application) handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	banned, err := permissions.IsBanned(ctx, a.db, user.ID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to login"})
+		return
+	}
+	if banned {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "this account has been banned"})
+		return
+	}
+
 	token, err := auth.GenerateSessionToken()
 	if err != nil {
 		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to create session"})
@@ -304,6 +576,10 @@ func (a *application) handleUpdateProfile(w http.ResponseWriter, r *http.Request
 		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "username must be alphanumeric and 3-20 characters"})
 		return
 	}
+	if database.IsReservedMention(req.Username) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "this username is reserved"})
+		return
+	}
 	if req.AvatarURL != "" && !strings.HasPrefix(req.AvatarURL, "/uploads/") {
 		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "avatar url must be an uploaded asset"})
 		return
@@ -330,6 +606,12 @@ func (a *application) handleListUsers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	user, err := a.userFromRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
 	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
 	defer cancel()
 
@@ -340,7 +622,7 @@ func (a *application) handleListUsers(w http.ResponseWriter, r *http.Request) {
 	}
 	defer rows.Close()
 
-	active := a.hub.ActiveUserIDs()
+	presences := a.hub.PresenceOf(user.ID)
 	users := make([]publicUser, 0)
 	for rows.Next() {
 		var u publicUser
@@ -348,7 +630,12 @@ func (a *application) handleListUsers(w http.ResponseWriter, r *http.Request) {
 			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to parse users"})
 			return
 		}
-		u.Online = active[u.ID]
+		u.Status = database.PresenceOffline
+		if presence, ok := presences[u.ID]; ok {
+			u.Status = presence.Status
+			u.CustomStatus = presence.CustomStatus
+		}
+		u.Online = u.Status != database.PresenceOffline
 		users = append(users, u)
 	}
 	if err := rows.Err(); err != nil {
@@ -436,41 +723,60 @@ func (a *application) handleChannels(w http.ResponseWriter, r *http.Request) {
 		a.handleGetChannels(w, r)
 	case http.MethodPost:
 		a.handleCreateChannel(w, r)
+	case http.MethodPatch:
+		a.handleReorderChannels(w, r)
 	default:
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 	}
 }
 
 func (a *application) handleGetChannels(w http.ResponseWriter, r *http.Request) {
+	user, err := a.userFromRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
 	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
 	defer cancel()
 
-	rows, err := a.db.QueryContext(ctx, `SELECT id, name, type FROM channels ORDER BY id ASC`)
+	channels, err := database.ListChannels(ctx, a.db, permissions.VisibleChannels(user.ID))
 	if err != nil {
 		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to fetch channels"})
 		return
 	}
-	defer rows.Close()
 
-	channels := make([]channel, 0)
-	for rows.Next() {
-		var c channel
-		if err := rows.Scan(&c.ID, &c.Name, &c.Type); err != nil {
-			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to parse channels"})
-			return
-		}
-		channels = append(channels, c)
+	ids := make([]int64, len(channels))
+	for i, c := range channels {
+		ids[i] = c.ID
+	}
+	states, err := database.ReadStates(ctx, a.db, user.ID, ids)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to fetch read state"})
+		return
+	}
+	listings := make([]channelListing, len(channels))
+	for i, c := range channels {
+		state := states[c.ID]
+		listings[i] = channelListing{Channel: c, LastReadMessageID: state.LastReadMessageID, UnreadCount: state.UnreadCount, MentionCount: state.MentionCount}
 	}
 
-	if err := rows.Err(); err != nil {
-		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to read channels"})
+	categories, err := database.ListCategories(ctx, a.db)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to fetch categories"})
 		return
 	}
 
-	writeJSON(w, http.StatusOK, channelsResponse{Channels: channels})
+	writeJSON(w, http.StatusOK, channelsResponse{Channels: listings, Categories: categories})
 }
 
 func (a *application) handleCreateChannel(w http.ResponseWriter, r *http.Request) {
+	user, err := a.userFromRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
 	var req createChannelRequest
 	if err := decodeJSONBody(r, &req); err != nil {
 		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
@@ -479,91 +785,1880 @@ func (a *application) handleCreateChannel(w http.ResponseWriter, r *http.Request
 
 	req.Name = strings.TrimSpace(req.Name)
 	req.Type = strings.TrimSpace(req.Type)
+	req.Topic = strings.TrimSpace(req.Topic)
 	if !channelRegex.MatchString(req.Name) {
 		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "channel name must be 1-30 characters (letters, numbers, spaces, _ or -)"})
 		return
 	}
+	if len(req.Topic) > maxTopicLength {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "channel topic must be at most 1024 characters"})
+		return
+	}
 	if req.Type == "" {
-		req.Type = "text"
+		req.Type = database.ChannelTypeText
+	}
+	if database.IsDMType(req.Type) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "use /api/dms to start a direct conversation"})
+		return
 	}
+	if !database.IsServerChannelType(req.Type) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "channel type must be one of " + strings.Join(database.ServerChannelTypes, ", ")})
+		return
+	}
+	if req.CategoryID != nil && *req.CategoryID <= 0 {
+		req.CategoryID = nil
+	}
+	req.VoiceMode = strings.TrimSpace(req.VoiceMode)
 
 	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
 	defer cancel()
 
-	res, err := a.db.ExecContext(ctx, `INSERT INTO channels (name, type) VALUES (?, ?)`, req.Name, req.Type)
+	if err := permissions.Check(ctx, a.db, user.ID, 0, permissions.CreateChannel); err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	created, err := database.CreateChannel(ctx, a.db, user.ID, database.Channel{
+		Name:       req.Name,
+		Type:       req.Type,
+		Private:    req.Private,
+		Topic:      req.Topic,
+		CategoryID: req.CategoryID,
+		VoiceMode:  req.VoiceMode,
+	})
 	if err != nil {
-		if strings.Contains(strings.ToLower(err.Error()), "unique") {
-			writeJSON(w, http.StatusConflict, map[string]string{"error": "channel already exists"})
-			return
-		}
-		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to create channel"})
+		writeChannelUpdateError(w, err, "failed to create channel")
 		return
 	}
 
-	id, err := res.LastInsertId()
+	a.notifyChannelViewers(created.ID, "channel_created", created)
+
+	writeJSON(w, http.StatusCreated, map[string]any{"channel": created})
+}
+
+// handleReorderChannels applies a bulk position change, typically after a
+// drag-and-drop in the sidebar.
+func (a *application) handleReorderChannels(w http.ResponseWriter, r *http.Request) {
+	user, err := a.userFromRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	var req reorderChannelsRequest
+	if err := decodeJSONBody(r, &req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if len(req.Channels) == 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "channels are required"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	if err := permissions.Check(ctx, a.db, user.ID, 0, permissions.ManageChannels); err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	channels, err := database.ReorderChannels(ctx, a.db, req.Channels)
 	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to fetch channel id"})
+		writeChannelUpdateError(w, err, "failed to reorder channels")
 		return
 	}
 
-	writeJSON(w, http.StatusCreated, map[string]any{"channel": channel{ID: id, Name: req.Name, Type: req.Type}})
+	for _, c := range channels {
+		a.notifyChannelViewers(c.ID, "channel_updated", c)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"channels": channels})
 }
 
-func (a *application) authMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if _, err := a.userFromRequest(r); err != nil {
-			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+func (a *application) handleChannel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPatch:
+		a.handleUpdateChannel(w, r)
+	case http.MethodDelete:
+		a.handleDeleteChannel(w, r)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *application) handleUpdateChannel(w http.ResponseWriter, r *http.Request) {
+	user, err := a.userFromRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	channelID, err := pathID(r, "id")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid channel id"})
+		return
+	}
+
+	var req updateChannelRequest
+	if err := decodeJSONBody(r, &req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if !channelRegex.MatchString(name) {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "channel name must be 1-30 characters (letters, numbers, spaces, _ or -)"})
 			return
 		}
-		next.ServeHTTP(w, r)
+		req.Name = &name
+	}
+	if req.Topic != nil {
+		topic := strings.TrimSpace(*req.Topic)
+		if len(topic) > maxTopicLength {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "channel topic must be at most 1024 characters"})
+			return
+		}
+		req.Topic = &topic
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	if err := permissions.Check(ctx, a.db, user.ID, channelID, permissions.ViewChannel|permissions.ManageChannels); err != nil {
+		writeChannelAccessError(w, err)
+		return
+	}
+
+	updated, err := database.UpdateChannel(ctx, a.db, channelID, database.ChannelUpdate{
+		Name:       req.Name,
+		Topic:      req.Topic,
+		CategoryID: req.CategoryID,
+		VoiceMode:  req.VoiceMode,
 	})
+	if err != nil {
+		writeChannelUpdateError(w, err, "failed to update channel")
+		return
+	}
+	if req.VoiceMode != nil {
+		a.hub.ChangeVoiceMode(updated.ID, updated.VoiceMode)
+	}
+
+	a.notifyChannelViewers(updated.ID, "channel_updated", updated)
+
+	writeJSON(w, http.StatusOK, map[string]any{"channel": updated})
 }
 
-func (a *application) userFromRequest(r *http.Request) (User, error) {
-	cookie, err := r.Cookie(sessionCookieName)
-	if err != nil || cookie.Value == "" {
-		return User{}, fmt.Errorf("missing session cookie")
+func (a *application) handleDeleteChannel(w http.ResponseWriter, r *http.Request) {
+	user, err := a.userFromRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	channelID, err := pathID(r, "id")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid channel id"})
+		return
 	}
 
 	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
 	defer cancel()
 
-	session, err := auth.GetSession(ctx, a.db, cookie.Value)
+	if err := permissions.Check(ctx, a.db, user.ID, channelID, permissions.ViewChannel|permissions.DeleteChannel); err != nil {
+		writeChannelAccessError(w, err)
+		return
+	}
+
+	// Viewers must be resolved while the channel and its overrides still
+	// exist, and recordings before their rows go with it.
+	viewers := a.hub.ChannelViewers(channelID)
+	recordings, err := database.ListRecordings(ctx, a.db, channelID)
 	if err != nil {
-		return User{}, fmt.Errorf("get session: %w", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to delete channel"})
+		return
+	}
+	if err := database.DeleteChannel(ctx, a.db, channelID); err != nil {
+		writeChannelUpdateError(w, err, "failed to delete channel")
+		return
 	}
 
-	var avatarURL string
-	if err := a.db.QueryRowContext(ctx, `SELECT COALESCE(avatar_url, '') FROM users WHERE id = ?`, session.UserID).Scan(&avatarURL); err != nil {
-		return User{}, fmt.Errorf("load user profile: %w", err)
+	// Closing the channel stops a recording in progress, so its files are
+	// no longer being written when they are removed.
+	a.hub.CloseChannel(channelID)
+	for _, recording := range recordings {
+		if err := os.RemoveAll(recordingPath(recording.ID)); err != nil {
+			log.Printf("remove recording %d: %v", recording.ID, err)
+		}
+	}
+	payload := map[string]int64{"channel_id": channelID}
+	if err := a.hub.SendToUsers(viewers, "channel_deleted", payload); err != nil {
+		log.Printf("notify channel_deleted: %v", err)
 	}
 
-	return User{ID: session.UserID, Username: session.Username, AvatarURL: avatarURL}, nil
+	writeJSON(w, http.StatusOK, payload)
 }
 
-func setSessionCookie(w http.ResponseWriter, token string, expiresAt time.Time) {
-	http.SetCookie(w, &http.Cookie{
-		Name:     sessionCookieName,
-		Value:    token,
-		Path:     "/",
-		Expires:  expiresAt,
-		HttpOnly: true,
-		Secure:   auth.SessionCookieSecure,
-		SameSite: auth.SessionCookieSameSite,
-	})
+// notifyChannelViewers pushes a channel lifecycle event to every connected
+// user who can see the channel.
+func (a *application) notifyChannelViewers(channelID int64, eventType string, data any) {
+	if err := a.hub.SendToUsers(a.hub.ChannelViewers(channelID), eventType, data); err != nil {
+		log.Printf("notify %s: %v", eventType, err)
+	}
 }
 
-func clearSessionCookie(w http.ResponseWriter) {
-	http.SetCookie(w, &http.Cookie{
-		Name:     sessionCookieName,
-		Value:    "",
-		Path:     "/",
-		Expires:  time.Unix(0, 0),
-		MaxAge:   -1,
-		HttpOnly: true,
-		Secure:   auth.SessionCookieSecure,
-		SameSite: auth.SessionCookieSameSite,
-	})
+func (a *application) handleCategories(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		a.handleListCategories(w, r)
+	case http.MethodPost:
+		a.handleCreateCategory(w, r)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *application) handleListCategories(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	categories, err := database.ListCategories(ctx, a.db)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to fetch categories"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"categories": categories})
+}
+
+func (a *application) handleCreateCategory(w http.ResponseWriter, r *http.Request) {
+	user, err := a.userFromRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	var req categoryRequest
+	if err := decodeJSONBody(r, &req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if req.Name == nil || !channelRegex.MatchString(strings.TrimSpace(*req.Name)) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "category name must be 1-30 characters (letters, numbers, spaces, _ or -)"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	if err := permissions.Check(ctx, a.db, user.ID, 0, permissions.ManageChannels); err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	category, err := database.CreateCategory(ctx, a.db, strings.TrimSpace(*req.Name))
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to create category"})
+		return
+	}
+
+	a.broadcastCategoryEvent("category_created", category)
+
+	writeJSON(w, http.StatusCreated, map[string]any{"category": category})
+}
+
+func (a *application) handleCategory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPatch && r.Method != http.MethodDelete {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := a.userFromRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	categoryID, err := pathID(r, "id")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid category id"})
+		return
+	}
+
+	var req categoryRequest
+	if r.Method == http.MethodPatch {
+		if err := decodeJSONBody(r, &req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		if req.Name != nil {
+			name := strings.TrimSpace(*req.Name)
+			if !channelRegex.MatchString(name) {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "category name must be 1-30 characters (letters, numbers, spaces, _ or -)"})
+				return
+			}
+			req.Name = &name
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	if err := permissions.Check(ctx, a.db, user.ID, 0, permissions.ManageChannels); err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		moved, err := database.DeleteCategory(ctx, a.db, categoryID)
+		if err != nil {
+			writeChannelUpdateError(w, err, "failed to delete category")
+			return
+		}
+		payload := map[string]any{"category_id": categoryID, "channel_ids": moved}
+		a.broadcastCategoryEvent("category_deleted", payload)
+		writeJSON(w, http.StatusOK, payload)
+		return
+	}
+
+	category, err := database.UpdateCategory(ctx, a.db, categoryID, req.Name, req.Position)
+	if err != nil {
+		writeChannelUpdateError(w, err, "failed to update category")
+		return
+	}
+
+	a.broadcastCategoryEvent("category_updated", category)
+
+	writeJSON(w, http.StatusOK, map[string]any{"category": category})
+}
+
+// broadcastCategoryEvent sends category changes to everyone online;
+// categories themselves carry no access restrictions.
+func (a *application) broadcastCategoryEvent(eventType string, data any) {
+	online := make([]int64, 0)
+	for userID := range a.hub.ConnectedUserIDs() {
+		online = append(online, userID)
+	}
+	if err := a.hub.SendToUsers(online, eventType, data); err != nil {
+		log.Printf("notify %s: %v", eventType, err)
+	}
+}
+
+func writeChannelUpdateError(w http.ResponseWriter, err error, fallback string) {
+	switch {
+	case errors.Is(err, database.ErrChannelNotFound):
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "channel not found"})
+	case errors.Is(err, database.ErrCategoryNotFound):
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "category not found"})
+	case errors.Is(err, database.ErrChannelNameTaken):
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "channel already exists"})
+	case errors.Is(err, database.ErrDMNotManageable), errors.Is(err, database.ErrInvalidVoiceMode):
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	case errors.Is(err, database.ErrNotVoiceChannel):
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "voice_mode only applies to voice and stage channels"})
+	default:
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fallback})
+	}
+}
+
+func (a *application) handleChannelMembers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		a.handleListChannelMembers(w, r)
+	case http.MethodPost:
+		a.handleAddChannelMember(w, r)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *application) handleListChannelMembers(w http.ResponseWriter, r *http.Request) {
+	user, err := a.userFromRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	channelID, err := pathID(r, "id")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid channel id"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	if err := permissions.Check(ctx, a.db, user.ID, channelID, permissions.ViewChannel); err != nil {
+		writeChannelAccessError(w, err)
+		return
+	}
+
+	members, err := database.ListChannelMembers(ctx, a.db, channelID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to fetch channel members"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"members": members})
+}
+
+func (a *application) handleAddChannelMember(w http.ResponseWriter, r *http.Request) {
+	user, err := a.userFromRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	channelID, err := pathID(r, "id")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid channel id"})
+		return
+	}
+
+	var req addChannelMemberRequest
+	if err := decodeJSONBody(r, &req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if req.UserID <= 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "user_id is required"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	// Any member of a private channel may invite others into it, as may
+	// anyone who manages channels server-wide.
+	if err := permissions.Check(ctx, a.db, user.ID, 0, permissions.ManageChannels); err != nil {
+		if err := permissions.Check(ctx, a.db, user.ID, channelID, permissions.ViewChannel); err != nil {
+			writeChannelAccessError(w, err)
+			return
+		}
+	}
+
+	if err := database.AddChannelMember(ctx, a.db, channelID, req.UserID); err != nil {
+		writeChannelMemberError(w, err, "failed to add channel member")
+		return
+	}
+
+	payload := map[string]int64{"channel_id": channelID, "user_id": req.UserID}
+	if err := a.hub.BroadcastToChannel(channelID, "channel_member_added", payload); err != nil {
+		log.Printf("broadcast channel_member_added: %v", err)
+	}
+	if err := a.hub.SendToUsers([]int64{req.UserID}, "channel_member_added", payload); err != nil {
+		log.Printf("notify added channel member: %v", err)
+	}
+
+	writeJSON(w, http.StatusCreated, payload)
+}
+
+func (a *application) handleRemoveChannelMember(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := a.userFromRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	channelID, err := pathID(r, "id")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid channel id"})
+		return
+	}
+	targetID, err := pathID(r, "userID")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid user id"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	// Members may always leave; removing someone else is reserved for the
+	// channel's creator and anyone who manages channels server-wide.
+	manager := permissions.Check(ctx, a.db, user.ID, 0, permissions.ManageChannels) == nil
+	if !manager {
+		if err := permissions.Check(ctx, a.db, user.ID, channelID, permissions.ViewChannel); err != nil {
+			writeChannelAccessError(w, err)
+			return
+		}
+	}
+	if targetID != user.ID && !manager {
+		creator, err := database.ChannelCreator(ctx, a.db, channelID)
+		if err != nil {
+			writeChannelAccessError(w, err)
+			return
+		}
+		if creator != user.ID {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "only the channel creator can remove other members"})
+			return
+		}
+	}
+
+	if err := database.RemoveChannelMember(ctx, a.db, channelID, targetID); err != nil {
+		writeChannelMemberError(w, err, "failed to remove channel member")
+		return
+	}
+
+	a.hub.RemoveUserFromChannel(targetID, channelID)
+	payload := map[string]int64{"channel_id": channelID, "user_id": targetID}
+	if err := a.hub.BroadcastToChannel(channelID, "channel_member_removed", payload); err != nil {
+		log.Printf("broadcast channel_member_removed: %v", err)
+	}
+	if err := a.hub.SendToUsers([]int64{targetID}, "channel_member_removed", payload); err != nil {
+		log.Printf("notify removed channel member: %v", err)
+	}
+
+	writeJSON(w, http.StatusOK, payload)
+}
+
+func writeChannelMemberError(w http.ResponseWriter, err error, fallback string) {
+	switch {
+	case errors.Is(err, database.ErrChannelNotFound):
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "channel not found"})
+	case errors.Is(err, database.ErrUserNotFound), errors.Is(err, database.ErrMemberNotFound):
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+	case errors.Is(err, database.ErrChannelNotPrivate):
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	case errors.Is(err, database.ErrAlreadyChannelMember):
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+	default:
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fallback})
+	}
+}
+
+func (a *application) handleChannelMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	channelID, err := pathID(r, "id")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid channel id"})
+		return
+	}
+
+	query, err := parseHistoryQuery(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	user, err := a.userFromRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	if err := permissions.Check(ctx, a.db, user.ID, channelID, permissions.ViewChannel); err != nil {
+		writeChannelAccessError(w, err)
+		return
+	}
+
+	page, err := database.GetMessages(ctx, a.db, channelID, query)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to fetch messages"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, historyResponse(page, map[string]any{"channel_id": channelID}))
+}
+
+// parseHistoryQuery reads the before/after/around cursors and limit shared
+// by every history endpoint.
+func parseHistoryQuery(r *http.Request) (database.HistoryQuery, error) {
+	var query database.HistoryQuery
+	params := r.URL.Query()
+	for name, dst := range map[string]*int64{"before": &query.Before, "after": &query.After, "around": &query.Around} {
+		if raw := params.Get(name); raw != "" {
+			value, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil || value <= 0 {
+				return database.HistoryQuery{}, fmt.Errorf("invalid %s cursor", name)
+			}
+			*dst = value
+		}
+	}
+	if (query.Before > 0 && query.After > 0) || (query.Before > 0 && query.Around > 0) || (query.After > 0 && query.Around > 0) {
+		return database.HistoryQuery{}, fmt.Errorf("only one of before, after or around may be set")
+	}
+	if raw := params.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit <= 0 {
+			return database.HistoryQuery{}, fmt.Errorf("invalid limit")
+		}
+		query.Limit = limit
+	}
+	return query, nil
+}
+
+func (a *application) handleChannelThreads(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := a.userFromRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	channelID, err := pathID(r, "id")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid channel id"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	if err := permissions.Check(ctx, a.db, user.ID, channelID, permissions.ViewChannel); err != nil {
+		writeChannelAccessError(w, err)
+		return
+	}
+
+	threads, err := database.ListThreads(ctx, a.db, channelID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to fetch threads"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"threads": threads})
+}
+
+func (a *application) handleThread(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := a.userFromRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	threadID, err := pathID(r, "id")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid thread id"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	thread, ok := a.authorizeThread(ctx, w, user.ID, threadID)
+	if !ok {
+		return
+	}
+
+	participants, err := database.ThreadParticipants(ctx, a.db, threadID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to fetch thread participants"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"thread": thread, "participants": participants})
+}
+
+func (a *application) handleThreadMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	threadID, err := pathID(r, "id")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid thread id"})
+		return
+	}
+
+	query, err := parseHistoryQuery(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	user, err := a.userFromRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	thread, ok := a.authorizeThread(ctx, w, user.ID, threadID)
+	if !ok {
+		return
+	}
+
+	page, err := database.GetThreadMessages(ctx, a.db, threadID, query)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to fetch messages"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, historyResponse(page, map[string]any{"channel_id": thread.ChannelID, "thread_id": threadID}))
+}
+
+// authorizeThread loads a thread the user can view through its channel,
+// writing the error response itself when they cannot.
+func (a *application) authorizeThread(ctx context.Context, w http.ResponseWriter, userID, threadID int64) (database.Thread, bool) {
+	thread, err := database.GetThread(ctx, a.db, threadID)
+	if err != nil {
+		if errors.Is(err, database.ErrThreadNotFound) {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "thread not found"})
+			return database.Thread{}, false
+		}
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to fetch thread"})
+		return database.Thread{}, false
+	}
+	if err := permissions.Check(ctx, a.db, userID, thread.ChannelID, permissions.ViewChannel); err != nil {
+		writeChannelAccessError(w, err)
+		return database.Thread{}, false
+	}
+	return thread, true
+}
+
+func (a *application) handleDMs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		a.handleListDMs(w, r)
+	case http.MethodPost:
+		a.handleOpenDM(w, r)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *application) handleListDMs(w http.ResponseWriter, r *http.Request) {
+	user, err := a.userFromRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	dms, err := database.ListDMs(ctx, a.db, user.ID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to fetch conversations"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"dms": dms})
+}
+
+func (a *application) handleOpenDM(w http.ResponseWriter, r *http.Request) {
+	user, err := a.userFromRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	var req openDMRequest
+	if err := decodeJSONBody(r, &req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	dm, created, err := database.OpenDM(ctx, a.db, append(req.UserIDs, user.ID))
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrInvalidDMMembers):
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		case errors.Is(err, database.ErrUserNotFound):
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "user not found"})
+		default:
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to open conversation"})
+		}
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+		memberIDs := make([]int64, 0, len(dm.Members))
+		for _, member := range dm.Members {
+			memberIDs = append(memberIDs, member.ID)
+		}
+		if err := a.hub.SendToUsers(memberIDs, "dm_created", dm); err != nil {
+			log.Printf("notify dm members: %v", err)
+		}
+	}
+
+	writeJSON(w, status, map[string]any{"dm": dm})
+}
+
+func (a *application) handleSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := a.userFromRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	params := r.URL.Query()
+	query, err := database.ParseSearchQuery(params.Get("q"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	var cursor int64
+	if raw := params.Get("cursor"); raw != "" {
+		cursor, err = strconv.ParseInt(raw, 10, 64)
+		if err != nil || cursor <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid cursor"})
+			return
+		}
+	}
+	limit := 0
+	if raw := params.Get("limit"); raw != "" {
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid limit"})
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	page, err := database.SearchMessages(ctx, a.db, permissions.VisibleChannels(user.ID), query, cursor, limit)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to search messages"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, page)
+}
+
+type markMentionsReadRequest struct {
+	MessageIDs []int64 `json:"message_ids"`
+}
+
+// handleMentions serves the caller's mentions inbox, newest first.
+func (a *application) handleMentions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := a.userFromRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	var query database.MentionQuery
+	params := r.URL.Query()
+	if raw := params.Get("before"); raw != "" {
+		query.Before, err = strconv.ParseInt(raw, 10, 64)
+		if err != nil || query.Before <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid before cursor"})
+			return
+		}
+	}
+	if raw := params.Get("limit"); raw != "" {
+		query.Limit, err = strconv.Atoi(raw)
+		if err != nil || query.Limit <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid limit"})
+			return
+		}
+	}
+	query.UnreadOnly = params.Get("unread") == "true"
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	notifications, more, err := database.ListMentions(ctx, a.db, user.ID, permissions.VisibleChannels(user.ID), query)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to fetch mentions"})
+		return
+	}
+	unread, err := database.UnreadMentionCount(ctx, a.db, user.ID, permissions.VisibleChannels(user.ID))
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to fetch mentions"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"mentions": notifications, "has_more": more, "unread_count": unread})
+}
+
+// handleMarkMentionsRead marks inbox entries read: the listed message_ids,
+// or everything when the list is empty.
+func (a *application) handleMarkMentionsRead(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := a.userFromRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	var req markMentionsReadRequest
+	if r.ContentLength != 0 {
+		if err := decodeJSONBody(r, &req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+	if len(req.MessageIDs) > database.MaxHistoryLimit {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "too many message ids"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	updated, err := database.MarkMentionsRead(ctx, a.db, user.ID, req.MessageIDs)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to update mentions"})
+		return
+	}
+	unread, err := database.UnreadMentionCount(ctx, a.db, user.ID, permissions.VisibleChannels(user.ID))
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to update mentions"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"updated": updated, "unread_count": unread})
+}
+
+func (a *application) handleMessage(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPatch:
+		a.handleEditMessage(w, r)
+	case http.MethodDelete:
+		a.handleDeleteMessage(w, r)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *application) handleEditMessage(w http.ResponseWriter, r *http.Request) {
+	user, err := a.userFromRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	messageID, err := pathID(r, "id")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid message id"})
+		return
+	}
+
+	var req editMessageRequest
+	if err := decodeJSONBody(r, &req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	content, err := realtime.ValidateMessageContent(req.Content)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	message, err := a.hub.EditMessage(user.ID, messageID, content)
+	if err != nil {
+		writeMessageError(w, err, "failed to edit message")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"message": message})
+}
+
+func (a *application) handleDeleteMessage(w http.ResponseWriter, r *http.Request) {
+	user, err := a.userFromRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	messageID, err := pathID(r, "id")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid message id"})
+		return
+	}
+
+	message, err := a.hub.DeleteMessage(user.ID, messageID)
+	if err != nil {
+		writeMessageError(w, err, "failed to delete message")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"message": message})
+}
+
+func (a *application) handleChannelPins(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := a.userFromRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	channelID, err := pathID(r, "id")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid channel id"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	if err := permissions.Check(ctx, a.db, user.ID, channelID, permissions.ViewChannel); err != nil {
+		writeChannelAccessError(w, err)
+		return
+	}
+
+	pins, err := database.ListPins(ctx, a.db, channelID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to fetch pins"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"channel_id": channelID, "pins": pins, "limit": database.MaxPinsPerChannel})
+}
+
+// handleChannelVoice lists who is in a voice channel right now, with their
+// mute, deafen, video and screen share state.
+func (a *application) handleChannelVoice(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := a.userFromRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	channelID, err := pathID(r, "id")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid channel id"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	if err := permissions.Check(ctx, a.db, user.ID, channelID, permissions.ViewChannel); err != nil {
+		writeChannelAccessError(w, err)
+		return
+	}
+	channel, err := database.GetChannel(ctx, a.db, channelID)
+	if err != nil {
+		writeChannelAccessError(w, err)
+		return
+	}
+	if !database.SupportsVoice(channel.Type) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": database.ErrNotVoiceChannel.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"channel_id": channelID, "participants": a.hub.VoiceStates(channelID)})
+}
+
+// handleChannelRecordings lists the recordings of a voice channel with the
+// files each produced, newest first.
+func (a *application) handleChannelRecordings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := a.userFromRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	channelID, err := pathID(r, "id")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid channel id"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	if err := permissions.Check(ctx, a.db, user.ID, channelID, permissions.ViewChannel|permissions.ConnectVoice); err != nil {
+		writeChannelAccessError(w, err)
+		return
+	}
+
+	recordings, err := database.ListRecordings(ctx, a.db, channelID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to fetch recordings"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"channel_id": channelID, "recordings": recordings})
+}
+
+// handleRecordingTrack downloads one file of a recording to anyone who can
+// join the channel it was made in.
+func (a *application) handleRecordingTrack(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := a.userFromRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	recordingID, err := pathID(r, "id")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid recording id"})
+		return
+	}
+	trackID, err := pathID(r, "trackID")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid track id"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	recording, err := database.GetRecording(ctx, a.db, recordingID)
+	if err != nil {
+		if errors.Is(err, database.ErrRecordingNotFound) {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to fetch recording"})
+		return
+	}
+	if err := permissions.Check(ctx, a.db, user.ID, recording.ChannelID, permissions.ViewChannel|permissions.ConnectVoice); err != nil {
+		// Recordings of channels the caller cannot see do not exist to them.
+		if errors.Is(err, database.ErrChannelNotFound) || errors.Is(err, database.ErrNotChannelMember) || errors.Is(err, permissions.ErrForbidden) {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": database.ErrRecordingNotFound.Error()})
+			return
+		}
+		writeChannelAccessError(w, err)
+		return
+	}
+
+	var track *database.RecordingTrack
+	for i := range recording.Tracks {
+		if recording.Tracks[i].ID == trackID {
+			track = &recording.Tracks[i]
+		}
+	}
+	if track == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "recording track not found"})
+		return
+	}
+
+	file, err := os.Open(filepath.Join(recordingPath(recording.ID), filepath.Base(track.FileName)))
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "recording file is missing"})
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", recordingContentType(track.FileName))
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="recording-%d-%s"`, recording.ID, track.FileName))
+	http.ServeContent(w, r, track.FileName, track.EndedAt, file)
+}
+
+func recordingPath(recordingID int64) string {
+	return filepath.Join(recordingsDir, strconv.FormatInt(recordingID, 10))
+}
+
+func recordingContentType(fileName string) string {
+	switch filepath.Ext(fileName) {
+	case ".ogg":
+		return "audio/ogg"
+	case ".ivf":
+		return "video/x-ivf"
+	case ".h264":
+		return "video/h264"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+// handleICEServers returns the ICE servers voice clients should use. With
+// the embedded STUN/TURN listener on, that is it, with TURN credentials
+// bound to the caller's session; otherwise the list is empty and peers
+// connect over their own addresses.
+func (a *application) handleICEServers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil || cookie.Value == "" {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	session, err := auth.GetSession(ctx, a.db, cookie.Value)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	if a.turn == nil {
+		writeJSON(w, http.StatusOK, iceServersResponse{ICEServers: []ice.ICEServer{}})
+		return
+	}
+	servers, expiresAt := a.turn.Credentials(session.UserID, session.Token, session.ExpiresAt)
+	writeJSON(w, http.StatusOK, iceServersResponse{ICEServers: servers, ExpiresAt: &expiresAt})
+}
+
+// handleChannelPin pins (PUT) or unpins (DELETE) one message of the channel.
+func (a *application) handleChannelPin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := a.userFromRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	channelID, err := pathID(r, "id")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid channel id"})
+		return
+	}
+	messageID, err := pathID(r, "messageID")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid message id"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	existing, err := database.GetMessage(ctx, a.db, messageID)
+	if err != nil || existing.ChannelID != channelID {
+		if err == nil {
+			err = database.ErrMessageNotFound
+		}
+		writeMessageError(w, err, "failed to fetch message")
+		return
+	}
+
+	message, err := a.hub.SetPinned(user.ID, messageID, r.Method == http.MethodPut)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrTooManyPins):
+			writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		case errors.Is(err, database.ErrMessageNotFound):
+			writeMessageError(w, err, "failed to update pin")
+		case errors.Is(err, database.ErrChannelNotFound), errors.Is(err, database.ErrNotChannelMember), errors.Is(err, permissions.ErrForbidden):
+			writeChannelAccessError(w, err)
+		default:
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to update pin"})
+		}
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"message": message})
+}
+
+// handleMessageReactions lists the users who reacted to a message with one
+// emoji, which arrives URL-escaped in the path.
+func (a *application) handleMessageReactions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := a.userFromRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	messageID, err := pathID(r, "id")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid message id"})
+		return
+	}
+
+	emoji, err := database.NormalizeEmoji(r.PathValue("emoji"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	message, err := database.GetMessage(ctx, a.db, messageID)
+	if err != nil {
+		writeMessageError(w, err, "failed to fetch message")
+		return
+	}
+	if err := permissions.Check(ctx, a.db, user.ID, message.ChannelID, permissions.ViewChannel); err != nil {
+		writeChannelAccessError(w, err)
+		return
+	}
+
+	users, err := database.ListReactionUsers(ctx, a.db, messageID, emoji)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to fetch reactions"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"message_id": messageID, "emoji": emoji, "users": users})
+}
+
+// handleMyPermissions reports the caller's effective permissions, server-wide
+// or in the channel named by ?channel_id=, so clients can hide controls the
+// user cannot use.
+func (a *application) handleMyPermissions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := a.userFromRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	var channelID int64
+	if raw := r.URL.Query().Get("channel_id"); raw != "" {
+		channelID, err = strconv.ParseInt(raw, 10, 64)
+		if err != nil || channelID <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid channel id"})
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	effective, err := permissions.Resolve(ctx, a.db, user.ID, channelID)
+	if err != nil {
+		writeChannelAccessError(w, err)
+		return
+	}
+	roles, err := permissions.UserRoles(ctx, a.db, user.ID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to fetch roles"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"permissions": effective,
+		"names":       effective.Names(),
+		"roles":       roles,
+	})
+}
+
+func (a *application) handleRoles(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		a.handleListRoles(w, r)
+	case http.MethodPost:
+		a.handleCreateRole(w, r)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *application) handleListRoles(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	roles, err := permissions.ListRoles(ctx, a.db)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to fetch roles"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"roles": roles})
+}
+
+func (a *application) handleCreateRole(w http.ResponseWriter, r *http.Request) {
+	user, err := a.userFromRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	var req createRoleRequest
+	if err := decodeJSONBody(r, &req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	if err := permissions.Check(ctx, a.db, user.ID, 0, permissions.ManageRoles); err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	role, err := permissions.CreateRole(ctx, a.db, user.ID, req.Name, req.Permissions)
+	if err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, map[string]any{"role": role})
+}
+
+func (a *application) handleRole(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPatch && r.Method != http.MethodDelete {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := a.userFromRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	roleID, err := pathID(r, "id")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid role id"})
+		return
+	}
+
+	var req updateRoleRequest
+	if r.Method == http.MethodPatch {
+		if err := decodeJSONBody(r, &req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	if err := permissions.Check(ctx, a.db, user.ID, 0, permissions.ManageRoles); err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		if err := permissions.DeleteRole(ctx, a.db, user.ID, roleID); err != nil {
+			writePermissionError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int64{"role_id": roleID})
+		return
+	}
+
+	role, err := permissions.UpdateRole(ctx, a.db, user.ID, roleID, req.Name, req.Permissions)
+	if err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"role": role})
+}
+
+func (a *application) handleUserRole(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := a.userFromRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	targetID, err := pathID(r, "id")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid user id"})
+		return
+	}
+	roleID, err := pathID(r, "roleID")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid role id"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	if err := permissions.Check(ctx, a.db, user.ID, 0, permissions.ManageRoles); err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		err = permissions.AssignRole(ctx, a.db, user.ID, targetID, roleID)
+	} else {
+		err = permissions.UnassignRole(ctx, a.db, user.ID, targetID, roleID)
+	}
+	if err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	roles, err := permissions.UserRoles(ctx, a.db, targetID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to fetch roles"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"user_id": targetID, "roles": roles})
+}
+
+func (a *application) handleKickUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := a.userFromRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	targetID, err := pathID(r, "id")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid user id"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	if err := permissions.Check(ctx, a.db, user.ID, 0, permissions.KickMembers); err != nil {
+		writePermissionError(w, err)
+		return
+	}
+	if err := permissions.CanManageUser(ctx, a.db, user.ID, targetID); err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	// A kick only drops live connections; the account can reconnect.
+	a.hub.DisconnectUser(targetID)
+
+	writeJSON(w, http.StatusOK, map[string]int64{"user_id": targetID})
+}
+
+func (a *application) handleBanUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := a.userFromRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	targetID, err := pathID(r, "id")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid user id"})
+		return
+	}
+
+	var req banRequest
+	if r.Method == http.MethodPost && r.ContentLength != 0 {
+		if err := decodeJSONBody(r, &req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	if err := permissions.Check(ctx, a.db, user.ID, 0, permissions.BanMembers); err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		if err := permissions.Unban(ctx, a.db, user.ID, targetID); err != nil {
+			writePermissionError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int64{"user_id": targetID})
+		return
+	}
+
+	if err := permissions.Ban(ctx, a.db, user.ID, targetID, strings.TrimSpace(req.Reason)); err != nil {
+		writePermissionError(w, err)
+		return
+	}
+	a.hub.DisconnectUser(targetID)
+
+	writeJSON(w, http.StatusOK, map[string]int64{"user_id": targetID})
+}
+
+func (a *application) handleListChannelOverrides(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := a.userFromRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	channelID, err := pathID(r, "id")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid channel id"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	if err := permissions.Check(ctx, a.db, user.ID, channelID, permissions.ViewChannel); err != nil {
+		writeChannelAccessError(w, err)
+		return
+	}
+
+	overrides, err := permissions.ListChannelOverrides(ctx, a.db, channelID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to fetch channel permissions"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"overrides": overrides})
+}
+
+func (a *application) handleSetChannelOverride(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := a.userFromRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	channelID, err := pathID(r, "id")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid channel id"})
+		return
+	}
+	roleID, err := pathID(r, "roleID")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid role id"})
+		return
+	}
+
+	var req channelOverrideRequest
+	if err := decodeJSONBody(r, &req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	if err := permissions.Check(ctx, a.db, user.ID, channelID, permissions.ManageRoles); err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	override := permissions.Override{ChannelID: channelID, RoleID: roleID, Allow: req.Allow, Deny: req.Deny}
+	if err := permissions.SetChannelOverride(ctx, a.db, user.ID, override); err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"override": override})
+}
+
+func writeChannelAccessError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, database.ErrChannelNotFound):
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "channel not found"})
+	case errors.Is(err, database.ErrNotChannelMember), errors.Is(err, permissions.ErrForbidden):
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": err.Error()})
+	default:
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to fetch channel"})
+	}
+}
+
+func writePermissionError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, permissions.ErrRoleNotFound):
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "role not found"})
+	case errors.Is(err, database.ErrUserNotFound):
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "user not found"})
+	case errors.Is(err, database.ErrChannelNotFound):
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "channel not found"})
+	case errors.Is(err, permissions.ErrBuiltinRole), errors.Is(err, permissions.ErrInvalidRole):
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	case errors.Is(err, permissions.ErrLastOwner):
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+	case errors.Is(err, permissions.ErrForbidden), errors.Is(err, permissions.ErrRoleHierarchy), errors.Is(err, database.ErrNotChannelMember):
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": err.Error()})
+	default:
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to update permissions"})
+	}
+}
+
+// historyResponse adds a page of history to response. Around queries also
+// report has_more_before and has_more_after.
+func historyResponse(page database.HistoryPage, response map[string]any) map[string]any {
+	response["messages"] = page.Messages
+	response["has_more"] = page.HasMore
+	if page.HasMoreBefore != nil {
+		response["has_more_before"] = *page.HasMoreBefore
+	}
+	if page.HasMoreAfter != nil {
+		response["has_more_after"] = *page.HasMoreAfter
+	}
+	return response
+}
+
+func writeMessageError(w http.ResponseWriter, err error, fallback string) {
+	switch {
+	case errors.Is(err, database.ErrMessageNotFound):
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "message not found"})
+	case errors.Is(err, database.ErrNotMessageAuthor):
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "only the author can change this message"})
+	case errors.Is(err, database.ErrChannelNotFound):
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "message not found"})
+	case errors.Is(err, database.ErrNotChannelMember), errors.Is(err, permissions.ErrForbidden):
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": err.Error()})
+	default:
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fallback})
+	}
+}
+
+func (a *application) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := a.userFromRequest(r); err != nil {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *application) userFromRequest(r *http.Request) (User, error) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil || cookie.Value == "" {
+		return User{}, fmt.Errorf("missing session cookie")
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	session, err := auth.GetSession(ctx, a.db, cookie.Value)
+	if err != nil {
+		return User{}, fmt.Errorf("get session: %w", err)
+	}
+
+	var avatarURL string
+	if err := a.db.QueryRowContext(ctx, `SELECT COALESCE(avatar_url, '') FROM users WHERE id = ?`, session.UserID).Scan(&avatarURL); err != nil {
+		return User{}, fmt.Errorf("load user profile: %w", err)
+	}
+
+	return User{ID: session.UserID, Username: session.Username, AvatarURL: avatarURL}, nil
+}
+
+// sessionActive reports whether userID still has the session whose tag a
+// TURN credential carries.
+func (a *application) sessionActive(userID int64, tag string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	tokens, err := auth.SessionTokens(ctx, a.db, userID)
+	if err != nil {
+		log.Printf("check turn session of user %d: %v", userID, err)
+		return false
+	}
+	for _, token := range tokens {
+		if ice.SessionTag(token) == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func setSessionCookie(w http.ResponseWriter, token string, expiresAt time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expiresAt,
+		HttpOnly: true,
+		Secure:   auth.SessionCookieSecure,
+		SameSite: auth.SessionCookieSameSite,
+	})
+}
+
+func clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		Expires:  time.Unix(0, 0),
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   auth.SessionCookieSecure,
+		SameSite: auth.SessionCookieSameSite,
+	})
+}
+
+func pathID(r *http.Request, name string) (int64, error) {
+	id, err := strconv.ParseInt(r.PathValue(name), 10, 64)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("invalid %s", name)
+	}
+	return id, nil
 }
 
 func decodeJSONBody(r *http.Request, dst any) error {
@@ -595,7 +2690,7 @@ func corsMiddleware(next http.Handler) http.Handler {
 			w.Header().Set("Access-Control-Allow-Origin", origin)
 			w.Header().Set("Access-Control-Allow-Credentials", "true")
 			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
 		}
 
 		if r.Method == http.MethodOptions {
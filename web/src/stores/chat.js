@@ -8,7 +8,18 @@ export const useChatStore = defineStore('chat', {
     ws: null,
     connected: false,
     messages: [],
+    channels: [],
+    categories: [],
+    hasMoreHistory: false,
     activeChannelId: null,
+    unreadMentions: 0,
+    typingUsers: {},
+    typingSentAt: 0,
+    presence: {},
+    sessionId: null,
+    freshSessionId: null,
+    lastSeq: 0,
+    resuming: false,
     error: '',
     reconnecting: false,
   }),
@@ -25,7 +36,10 @@ export const useChatStore = defineStore('chat', {
         this.connected = true
         this.reconnecting = false
         this.error = ''
-        if (this.activeChannelId) {
+        if (this.sessionId) {
+          this.resuming = true
+          this.sendEvent({ type: 'resume', session_id: this.sessionId, seq: this.lastSeq })
+        } else if (this.activeChannelId) {
           this.joinChannel(this.activeChannelId)
         }
       })
@@ -50,19 +64,196 @@ export const useChatStore = defineStore('chat', {
           return
         }
 
+        if (payload.seq) {
+          this.lastSeq = payload.seq
+        }
+
+        if (payload.type === 'hello') {
+          this.freshSessionId = payload.data?.session_id
+          this.lastSeq = 0
+          if (!this.resuming) {
+            this.sessionId = this.freshSessionId
+          }
+          return
+        }
+
+        if (payload.type === 'resumed') {
+          this.resuming = false
+          this.sessionId = payload.data?.session_id
+          this.lastSeq = payload.data?.seq || 0
+          return
+        }
+
+        if (payload.type === 'resume_failed') {
+          this.resuming = false
+          this.sessionId = this.freshSessionId
+          if (this.activeChannelId) {
+            this.joinChannel(this.activeChannelId)
+          }
+          return
+        }
+
         if (payload.type === 'channel_history') {
           this.messages = payload.data?.messages || []
+          this.hasMoreHistory = Boolean(payload.data?.has_more)
+          if (payload.data?.channel_id === this.activeChannelId && !payload.data?.thread_id) {
+            this.ackChannel(this.activeChannelId)
+          }
+          return
+        }
+
+        if (payload.type === 'unread_update') {
+          const channel = this.channels.find((existing) => existing.id === payload.data?.channel_id)
+          if (channel) {
+            channel.last_read_message_id = payload.data.last_read_message_id
+            channel.unread_count = payload.data.unread_count
+            channel.mention_count = payload.data.mention_count
+          }
+          return
+        }
+
+        if (payload.type === 'history_page') {
+          if (payload.data?.channel_id === this.activeChannelId && payload.data?.before) {
+            this.messages = [...(payload.data?.messages || []), ...this.messages]
+            this.hasMoreHistory = Boolean(payload.data?.has_more)
+          }
           return
         }
 
         if (payload.type === 'new_message') {
-          if (payload.data?.channel_id === this.activeChannelId) {
+          this.clearTyping(payload.data?.channel_id, payload.data?.user_id)
+          if (payload.data?.channel_id === this.activeChannelId && !payload.data?.thread_id) {
             this.messages.push(payload.data)
+            this.ackChannel(this.activeChannelId, payload.data.id)
+          }
+          return
+        }
+
+        if (payload.type === 'thread_created') {
+          const parent = this.messages.find((msg) => msg.id === payload.data?.parent_message_id)
+          if (parent) {
+            parent.thread = {
+              id: payload.data.id,
+              name: payload.data.name,
+              message_count: payload.data.message_count,
+            }
+          }
+          return
+        }
+
+        if (payload.type === 'thread_message_count') {
+          const parent = this.messages.find((msg) => msg.thread?.id === payload.data?.thread_id)
+          if (parent) {
+            parent.thread = {
+              ...parent.thread,
+              message_count: payload.data.message_count,
+              last_message_at: payload.data.last_message_at,
+            }
+          }
+          return
+        }
+
+        if (payload.type === 'message_updated') {
+          const index = this.messages.findIndex((msg) => msg.id === payload.data?.id)
+          if (index !== -1) {
+            this.messages[index] = payload.data
+          }
+          return
+        }
+
+        if (payload.type === 'message_deleted') {
+          const index = this.messages.findIndex((msg) => msg.id === payload.data?.id)
+          if (index !== -1) {
+            this.messages[index] = { ...this.messages[index], content: '', deleted: true, reactions: [] }
+          }
+          return
+        }
+
+        if (payload.type === 'typing' && !payload.data?.thread_id) {
+          const { channel_id: channelId, user_id: userId, username, timeout_ms: timeoutMs } = payload.data
+          const channelTyping = { ...(this.typingUsers[channelId] || {}) }
+          clearTimeout(channelTyping[userId]?.timer)
+          channelTyping[userId] = {
+            username,
+            timer: setTimeout(() => this.clearTyping(channelId, userId), timeoutMs || 8000),
           }
+          this.typingUsers = { ...this.typingUsers, [channelId]: channelTyping }
           return
         }
 
-        if (payload.type === 'signal' || payload.type === 'user_joined_voice' || payload.type === 'leave_voice') {
+        if (payload.type === 'typing_stop') {
+          this.clearTyping(payload.data?.channel_id, payload.data?.user_id)
+          return
+        }
+
+        if (payload.type === 'presence_update') {
+          this.presence = { ...this.presence, [payload.data.user_id]: payload.data }
+          return
+        }
+
+        if (payload.type === 'mention') {
+          this.unreadMentions += 1
+          return
+        }
+
+        if (payload.type === 'message_pinned' || payload.type === 'message_unpinned') {
+          const index = this.messages.findIndex((msg) => msg.id === payload.data?.message?.id)
+          if (index !== -1) {
+            this.messages[index] = payload.data.message
+          }
+          return
+        }
+
+        if (payload.type === 'reaction_added' || payload.type === 'reaction_removed') {
+          const message = this.messages.find((msg) => msg.id === payload.data?.message_id)
+          if (message) {
+            const reactions = (message.reactions || []).filter((reaction) => reaction.emoji !== payload.data.emoji)
+            if (payload.data.count > 0) {
+              const existing = (message.reactions || []).findIndex((reaction) => reaction.emoji === payload.data.emoji)
+              const entry = { emoji: payload.data.emoji, count: payload.data.count }
+              reactions.splice(existing === -1 ? reactions.length : existing, 0, entry)
+            }
+            message.reactions = reactions
+          }
+          return
+        }
+
+        if (payload.type === 'channel_created' || payload.type === 'channel_updated') {
+          this.upsertChannel(payload.data)
+          return
+        }
+
+        if (payload.type === 'channel_deleted') {
+          const channelId = payload.data?.channel_id
+          this.channels = this.channels.filter((channel) => channel.id !== channelId)
+          if (this.activeChannelId === channelId) {
+            this.activeChannelId = null
+            this.messages = []
+          }
+          return
+        }
+
+        if (payload.type === 'category_created' || payload.type === 'category_updated') {
+          const index = this.categories.findIndex((category) => category.id === payload.data?.id)
+          if (index === -1) {
+            this.categories.push(payload.data)
+          } else {
+            this.categories[index] = payload.data
+          }
+          this.categories.sort((a, b) => a.position - b.position || a.id - b.id)
+          return
+        }
+
+        if (payload.type === 'category_deleted') {
+          const categoryId = payload.data?.category_id
+          this.categories = this.categories.filter((category) => category.id !== categoryId)
+          this.channels = this.channels.map((channel) =>
+            channel.category_id === categoryId ? { ...channel, category_id: null } : channel,
+          )
+          return
+        }
+
+        if (['signal', 'user_joined_voice', 'leave_voice', 'voice_states', 'voice_state_update', 'voice_mode_changed'].includes(payload.type)) {
           const { useVoiceStore } = await import('./voice')
           const voiceStore = useVoiceStore()
           await voiceStore.handleRealtimeEvent(payload)
@@ -81,9 +272,27 @@ export const useChatStore = defineStore('chat', {
       this.ws = null
       this.connected = false
       this.reconnecting = false
+      this.sessionId = null
+      this.lastSeq = 0
       this.activeChannelId = null
       this.messages = []
     },
+    setChannels(channels, categories) {
+      this.channels = channels || []
+      this.categories = categories || []
+    },
+    upsertChannel(channel) {
+      if (!channel) {
+        return
+      }
+      const index = this.channels.findIndex((existing) => existing.id === channel.id)
+      if (index === -1) {
+        this.channels.push(channel)
+      } else {
+        this.channels[index] = { ...this.channels[index], ...channel }
+      }
+      this.channels.sort((a, b) => a.position - b.position || a.id - b.id)
+    },
     sendEvent(eventPayload) {
       if (!this.ws || this.ws.readyState !== WebSocket.OPEN) {
         this.error = 'Not connected to realtime service'
@@ -106,7 +315,31 @@ export const useChatStore = defineStore('chat', {
         channel_id: channelId,
       })
     },
-    sendMessage(content) {
+    loadOlderMessages() {
+      if (!this.activeChannelId || !this.hasMoreHistory || this.messages.length === 0) {
+        return
+      }
+
+      this.sendEvent({
+        type: 'load_history',
+        channel_id: this.activeChannelId,
+        before: this.messages[0].id,
+      })
+    },
+    editMessage(messageId, content) {
+      this.sendEvent({
+        type: 'edit_message',
+        message_id: messageId,
+        content,
+      })
+    },
+    deleteMessage(messageId) {
+      this.sendEvent({
+        type: 'delete_message',
+        message_id: messageId,
+      })
+    },
+    sendMessage(content, replyToId = null) {
       if (!this.activeChannelId) {
         this.error = 'No active channel selected'
         return
@@ -116,7 +349,55 @@ export const useChatStore = defineStore('chat', {
         type: 'send_message',
         channel_id: this.activeChannelId,
         content,
+        ...(replyToId ? { reply_to_id: replyToId } : {}),
+      })
+    },
+    createThread(messageId, name) {
+      this.sendEvent({
+        type: 'create_thread',
+        message_id: messageId,
+        name,
       })
     },
+    clearTyping(channelId, userId) {
+      const channelTyping = this.typingUsers[channelId]
+      if (!channelTyping?.[userId]) {
+        return
+      }
+      clearTimeout(channelTyping[userId].timer)
+      const { [userId]: _removed, ...rest } = channelTyping
+      this.typingUsers = { ...this.typingUsers, [channelId]: rest }
+    },
+    setPresence(status, customStatus) {
+      this.sendEvent({
+        type: 'set_presence',
+        ...(status ? { status } : {}),
+        ...(customStatus !== undefined ? { custom_status: customStatus } : {}),
+      })
+    },
+    sendTyping() {
+      const now = Date.now()
+      if (!this.activeChannelId || now - this.typingSentAt < 3000) {
+        return
+      }
+      this.typingSentAt = now
+      this.sendEvent({ type: 'typing_start', channel_id: this.activeChannelId })
+    },
+    ackChannel(channelId, messageId = null) {
+      this.sendEvent({
+        type: 'ack',
+        channel_id: channelId,
+        ...(messageId ? { message_id: messageId } : {}),
+      })
+    },
+    setPinned(messageId, pinned) {
+      this.sendEvent({ type: pinned ? 'pin_message' : 'unpin_message', message_id: messageId })
+    },
+    addReaction(messageId, emoji) {
+      this.sendEvent({ type: 'add_reaction', message_id: messageId, emoji })
+    },
+    removeReaction(messageId, emoji) {
+      this.sendEvent({ type: 'remove_reaction', message_id: messageId, emoji })
+    },
   },
 })
@@ -2,12 +2,17 @@ import { defineStore } from 'pinia'
 import { useAuthStore } from './auth'
 import { useChatStore } from './chat'
 
-const rtcConfig = {
-  iceServers: [
-    { urls: 'stun:stun.l.google.com:19302' },
-    { urls: 'stun:stun1.l.google.com:19302' },
-  ],
-}
+// In SFU mode the server is the only peer, under this id.
+const mediaServerID = 'sfu'
+
+// Camera video sent to the SFU is encoded three times, at a quarter, half
+// and full size, and the server forwards each viewer the layer that suits
+// them.
+const simulcastEncodings = [
+  { rid: 'q', scaleResolutionDownBy: 4, maxBitrate: 150000 },
+  { rid: 'h', scaleResolutionDownBy: 2, maxBitrate: 500000 },
+  { rid: 'f', maxBitrate: 1500000 },
+]
 
 export const useVoiceStore = defineStore('voice', {
   state: () => ({
@@ -15,7 +20,9 @@ export const useVoiceStore = defineStore('voice', {
     peers: {},
     remoteStreams: {},
     participants: {},
+    voiceStates: {},
     joinedChannelId: null,
+    voiceMode: 'mesh',
     muted: false,
     deafened: false,
     cameraOff: false,
@@ -24,6 +31,14 @@ export const useVoiceStore = defineStore('voice', {
     selectedAudioInputId: localStorage.getItem('openvoice.audioInputId') || '',
     selectedVideoInputId: localStorage.getItem('openvoice.videoInputId') || '',
     peerVolumes: {},
+    videoQualities: {},
+    iceServers: [],
+    recording: null,
+    screenStream: null,
+    screenSenders: {},
+    screenStreamIds: {},
+    remoteScreens: {},
+    watchedScreens: {},
     error: '',
     beforeUnloadBound: false,
   }),
@@ -34,7 +49,14 @@ export const useVoiceStore = defineStore('voice', {
         stream,
         username: state.participants[userId] || `User ${userId}`,
       })),
-    participantList: (state) => Object.entries(state.participants).map(([id, username]) => ({ id, username })),
+    remoteScreenEntries: (state) =>
+      Object.entries(state.remoteScreens).map(([userId, stream]) => ({
+        userId,
+        stream,
+        username: state.participants[userId] || `User ${userId}`,
+      })),
+    participantList: (state) =>
+      Object.entries(state.participants).map(([id, username]) => ({ id, username, ...(state.voiceStates[id] || {}) })),
     isConnected: (state) => Boolean(state.joinedChannelId),
   },
   actions: {
@@ -76,8 +98,35 @@ export const useVoiceStore = defineStore('voice', {
       this.joinedChannelId = channelId
       this.participants[String(authStore.user.id)] = authStore.user.username
 
+      await this.loadIceServers()
       chatStore.connect()
-      chatStore.sendEvent({ type: 'join_voice', channel_id: channelId })
+      this.sendJoin()
+    },
+    // loadIceServers fetches the STUN/TURN servers to connect through. The
+    // TURN credentials are short-lived, so this runs on every join.
+    async loadIceServers() {
+      try {
+        const response = await fetch('/api/voice/ice-servers', {
+          credentials: 'include',
+        })
+        const payload = await response.json()
+        if (!response.ok) {
+          throw new Error(payload.error || 'Failed to load ICE servers')
+        }
+        this.iceServers = payload.ice_servers || []
+      } catch (error) {
+        // Without them peers can still reach each other directly.
+        this.iceServers = []
+      }
+    },
+    sendJoin() {
+      useChatStore().sendEvent({
+        type: 'join_voice',
+        channel_id: this.joinedChannelId,
+        self_mute: this.muted,
+        self_deaf: this.deafened,
+        video: !this.cameraOff,
+      })
     },
     leaveRoom() {
       const chatStore = useChatStore()
@@ -94,12 +143,26 @@ export const useVoiceStore = defineStore('voice', {
       if (this.localStream) {
         this.localStream.getTracks().forEach((track) => track.stop())
       }
+      if (this.screenStream) {
+        this.screenStream.getTracks().forEach((track) => {
+          track.onended = null
+          track.stop()
+        })
+      }
 
       this.localStream = null
+      this.screenStream = null
+      this.screenSenders = {}
+      this.screenStreamIds = {}
+      this.remoteScreens = {}
+      this.watchedScreens = {}
       this.peers = {}
       this.remoteStreams = {}
+      this.videoQualities = {}
       this.participants = {}
       this.joinedChannelId = null
+      this.voiceMode = 'mesh'
+      this.recording = null
       this.muted = false
       this.deafened = false
       this.cameraOff = false
@@ -124,6 +187,7 @@ export const useVoiceStore = defineStore('voice', {
       this.localStream.getAudioTracks().forEach((track) => {
         track.enabled = !this.muted
       })
+      this.sendVoiceState({ self_mute: this.muted })
     },
     toggleCamera() {
       if (!this.localStream) {
@@ -134,9 +198,100 @@ export const useVoiceStore = defineStore('voice', {
       this.localStream.getVideoTracks().forEach((track) => {
         track.enabled = !this.cameraOff
       })
+      this.sendVoiceState({ video: !this.cameraOff })
     },
     toggleDeafen() {
       this.deafened = !this.deafened
+      this.sendVoiceState({ self_deaf: this.deafened })
+    },
+    async startScreenShare() {
+      if (!this.joinedChannelId || this.screenStream) {
+        return
+      }
+      let stream
+      try {
+        stream = await navigator.mediaDevices.getDisplayMedia({ video: true })
+      } catch (error) {
+        this.error = error.message || 'Screen capture was denied'
+        return
+      }
+      this.screenStream = stream
+      stream.getVideoTracks().forEach((track) => {
+        track.onended = () => this.stopScreenShare()
+      })
+      // The track is sent once the server accepts the share: through the
+      // server it is published right away, directly it goes to each
+      // viewer as they opt in.
+      useChatStore().sendEvent({ type: 'start_screen_share', stream_id: stream.id })
+    },
+    stopScreenShare() {
+      if (!this.screenStream) {
+        return
+      }
+      this.screenStream.getTracks().forEach((track) => {
+        track.onended = null
+        track.stop()
+      })
+      Object.entries(this.screenSenders).forEach(([peerID, sender]) => {
+        const pc = this.peers[peerID]
+        if (!pc) {
+          return
+        }
+        pc.removeTrack(sender)
+        if (peerID !== mediaServerID) {
+          this.createOffer(peerID)
+        }
+      })
+      this.screenSenders = {}
+      this.screenStream = null
+      useChatStore().sendEvent({ type: 'stop_screen_share' })
+    },
+    watchScreenShare(userId) {
+      if (!this.joinedChannelId) {
+        return
+      }
+      this.watchedScreens[userId] = true
+      useChatStore().sendEvent({ type: 'watch_screen_share', user_id: Number(userId) })
+    },
+    unwatchScreenShare(userId) {
+      delete this.watchedScreens[userId]
+      delete this.remoteScreens[userId]
+      if (this.joinedChannelId) {
+        useChatStore().sendEvent({ type: 'unwatch_screen_share', user_id: Number(userId) })
+      }
+    },
+    // publishScreenToServer sends the screen share to the server once it
+    // has accepted it; onnegotiationneeded carries the new track.
+    publishScreenToServer() {
+      const pc = this.peers[mediaServerID]
+      if (!pc || !this.screenStream || this.screenSenders[mediaServerID]) {
+        return
+      }
+      const [track] = this.screenStream.getVideoTracks()
+      if (track) {
+        this.screenSenders[mediaServerID] = pc.addTrack(track, this.screenStream)
+      }
+    },
+    isScreenStream(userId, streamId) {
+      return streamId === this.screenStreamIds[userId] || streamId === this.voiceStates[userId]?.screen_share_stream_id
+    },
+    startRecording(video) {
+      if (this.voiceMode !== 'sfu' || !this.joinedChannelId) {
+        return
+      }
+      useChatStore().sendEvent({ type: 'start_recording', channel_id: this.joinedChannelId, video })
+    },
+    stopRecording() {
+      if (!this.joinedChannelId) {
+        return
+      }
+      useChatStore().sendEvent({ type: 'stop_recording', channel_id: this.joinedChannelId })
+    },
+    sendVoiceState(flags) {
+      if (!this.joinedChannelId) {
+        return
+      }
+      useChatStore().sendEvent({ type: 'voice_state_update', ...flags })
     },
 
     async listDevices() {
@@ -166,6 +321,74 @@ export const useVoiceStore = defineStore('voice', {
 
       const myID = String(authStore.user.id)
 
+      if (payload.type === 'voice_states') {
+        const data = payload.data || {}
+        if (data.channel_id !== this.joinedChannelId) {
+          return
+        }
+        this.voiceMode = data.voice_mode || 'mesh'
+        this.recording = data.recording || null
+        this.voiceStates = {}
+        ;(data.participants || []).forEach((state) => {
+          this.voiceStates[String(state.user_id)] = state
+          this.participants[String(state.user_id)] = state.username
+        })
+        if (this.voiceMode === 'sfu') {
+          this.reportBandwidth()
+        }
+        return
+      }
+
+      if (payload.type === 'voice_state_update') {
+        const data = payload.data || {}
+        const userID = String(data.user_id)
+        if (data.channel_id === this.joinedChannelId) {
+          this.voiceStates[userID] = data
+        } else {
+          delete this.voiceStates[userID]
+        }
+        if (!data.screen_share) {
+          delete this.remoteScreens[userID]
+          delete this.watchedScreens[userID]
+        } else if (userID === myID && this.voiceMode === 'sfu') {
+          this.publishScreenToServer()
+        }
+        return
+      }
+
+      if (payload.type === 'screen_share_watch') {
+        const data = payload.data || {}
+        if (data.channel_id !== this.joinedChannelId || this.voiceMode !== 'mesh' || !this.screenStream) {
+          return
+        }
+        // Directly connected viewers get the screen track only while they
+        // watch.
+        const viewerID = String(data.user_id)
+        const pc = this.peers[viewerID]
+        const [track] = this.screenStream.getVideoTracks()
+        if (!pc || !track) {
+          return
+        }
+        if (data.watching && !this.screenSenders[viewerID]) {
+          this.screenSenders[viewerID] = pc.addTrack(track, this.screenStream)
+          await this.createOffer(viewerID)
+        } else if (!data.watching && this.screenSenders[viewerID]) {
+          pc.removeTrack(this.screenSenders[viewerID])
+          delete this.screenSenders[viewerID]
+          await this.createOffer(viewerID)
+        }
+        return
+      }
+
+      if (payload.type === 'recording_started' || payload.type === 'recording_stopped') {
+        const data = payload.data || {}
+        if (data.channel_id !== this.joinedChannelId) {
+          return
+        }
+        this.recording = payload.type === 'recording_started' ? data : null
+        return
+      }
+
       if (payload.type === 'user_joined_voice') {
         const data = payload.data || {}
         if (data.channel_id !== this.joinedChannelId) {
@@ -175,12 +398,29 @@ export const useVoiceStore = defineStore('voice', {
         const remoteID = String(data.user_id)
         this.participants[remoteID] = data.username || `User ${remoteID}`
 
-        if (remoteID !== myID) {
+        if (remoteID !== myID && this.voiceMode === 'mesh') {
           await this.createOffer(remoteID)
         }
         return
       }
 
+      if (payload.type === 'voice_mode_changed') {
+        const data = payload.data || {}
+        if (data.channel_id !== this.joinedChannelId) {
+          return
+        }
+        // The server took everyone out of voice; rejoin to set media up
+        // the new way.
+        Object.keys(this.peers).forEach((userId) => {
+          this.closePeer(userId)
+        })
+        this.remoteStreams = {}
+        this.videoQualities = {}
+        this.stopScreenShare()
+        this.sendJoin()
+        return
+      }
+
       if (payload.type === 'leave_voice') {
         const data = payload.data || {}
         if (data.channel_id !== this.joinedChannelId) {
@@ -204,8 +444,16 @@ export const useVoiceStore = defineStore('voice', {
           return
         }
 
+        if (!data.from_user_id && data.from_name === mediaServerID) {
+          await this.handleSignal(mediaServerID, data.payload)
+          return
+        }
+
         const fromUserID = String(data.from_user_id)
         this.participants[fromUserID] = data.from_name || `User ${fromUserID}`
+        if (data.screen_share_stream_id) {
+          this.screenStreamIds[fromUserID] = data.screen_share_stream_id
+        }
         await this.handleSignal(fromUserID, data.payload)
       }
     },
@@ -218,6 +466,11 @@ export const useVoiceStore = defineStore('voice', {
       const pc = await this.ensurePeer(fromUserID)
 
       if (signalType === 'offer') {
+        // The server gives way when both sides offer at once and offers
+        // again after answering ours.
+        if (fromUserID === mediaServerID && (pc.makingOffer || pc.signalingState === 'have-local-offer')) {
+          return
+        }
         await pc.setRemoteDescription(
           new RTCSessionDescription({
             type: 'offer',
@@ -265,11 +518,15 @@ export const useVoiceStore = defineStore('voice', {
         return this.peers[remoteUserID]
       }
 
-      const pc = new RTCPeerConnection(rtcConfig)
+      const pc = new RTCPeerConnection({ iceServers: this.iceServers })
 
-      this.localStream.getTracks().forEach((track) => {
-        pc.addTrack(track, this.localStream)
-      })
+      if (remoteUserID === mediaServerID) {
+        this.publishToServer(pc)
+      } else {
+        this.localStream.getTracks().forEach((track) => {
+          pc.addTrack(track, this.localStream)
+        })
+      }
 
       pc.onicecandidate = (event) => {
         if (event.candidate) {
@@ -283,7 +540,14 @@ export const useVoiceStore = defineStore('voice', {
       pc.ontrack = (event) => {
         const [stream] = event.streams
         if (stream) {
-          this.remoteStreams[remoteUserID] = stream
+          // The server labels each forwarded stream with its publisher's
+          // id, and screen shares with the id followed by -screen.
+          const ownerID = remoteUserID === mediaServerID ? stream.id.replace(/-screen$/, '') : remoteUserID
+          if (this.isScreenStream(ownerID, stream.id)) {
+            this.remoteScreens[ownerID] = stream
+          } else {
+            this.remoteStreams[ownerID] = stream
+          }
         }
       }
 
@@ -296,6 +560,63 @@ export const useVoiceStore = defineStore('voice', {
       this.peers[remoteUserID] = pc
       return pc
     },
+    publishToServer(pc) {
+      this.localStream.getAudioTracks().forEach((track) => {
+        pc.addTrack(track, this.localStream)
+      })
+      this.localStream.getVideoTracks().forEach((track) => {
+        pc.addTransceiver(track, {
+          direction: 'sendonly',
+          streams: [this.localStream],
+          sendEncodings: simulcastEncodings,
+        })
+      })
+
+      // Simulcast can only be set up by the side that offers, so the
+      // video is published with an offer of our own once the server's
+      // first offer has been answered.
+      pc.onnegotiationneeded = async () => {
+        try {
+          pc.makingOffer = true
+          const offer = await pc.createOffer()
+          if (pc.signalingState !== 'stable') {
+            return
+          }
+          await pc.setLocalDescription(offer)
+          this.sendSignal(mediaServerID, { type: 'offer', sdp: offer.sdp })
+        } catch (error) {
+          this.error = error.message || 'Failed to publish video'
+        } finally {
+          pc.makingOffer = false
+        }
+      }
+    },
+    setVideoQuality(userId, quality) {
+      this.sendVideoQuality(userId, { quality })
+    },
+    fitVideoToTile(userId, height) {
+      if (height > 0) {
+        this.sendVideoQuality(userId, { height })
+      }
+    },
+    sendVideoQuality(userId, request) {
+      if (this.voiceMode !== 'sfu' || !this.joinedChannelId) {
+        return
+      }
+      const key = JSON.stringify(request)
+      if (this.videoQualities[userId] === key) {
+        return
+      }
+      this.videoQualities[userId] = key
+      useChatStore().sendEvent({ type: 'set_video_quality', user_id: Number(userId), ...request })
+    },
+    reportBandwidth() {
+      // downlink is an estimate in megabits per second, where supported.
+      const downlink = navigator.connection?.downlink
+      if (downlink) {
+        useChatStore().sendEvent({ type: 'set_video_quality', bandwidth_kbps: Math.round(downlink * 1000) })
+      }
+    },
     sendSignal(targetUserID, payload) {
       const chatStore = useChatStore()
       if (!this.joinedChannelId) {
@@ -315,10 +636,13 @@ export const useVoiceStore = defineStore('voice', {
         pc.ontrack = null
         pc.onicecandidate = null
         pc.onconnectionstatechange = null
+        pc.onnegotiationneeded = null
         pc.close()
       }
       delete this.peers[remoteUserID]
       delete this.remoteStreams[remoteUserID]
+      delete this.remoteScreens[remoteUserID]
+      delete this.screenSenders[remoteUserID]
     },
     handleBeforeUnload: function () {
       this.leaveRoom()